@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"seedstore/types"
+	"seedstore/util"
+	"syscall"
+
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// brokerCmd represents the broker command
+var brokerCmd = &cobra.Command{
+	Use:   "broker",
+	Short: "Run an MQTT broker for the publishers and subscribers",
+	Long: `Run an MQTT broker configured under broker in the config, so a small setup
+	doesn't need one of its own. The subscriber can also run it with --embedded-broker.
+`,
+	Args: cobra.NoArgs,
+	Run:  runBroker,
+}
+
+func init() {
+	rootCmd.AddCommand(brokerCmd)
+}
+
+func runBroker(cmd *cobra.Command, args []string) {
+	server, err := startEmbeddedBroker()
+	if err != nil {
+		slog.Error("Could not start the broker: " + err.Error())
+		os.Exit(1)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	slog.Info("Stopping the broker")
+	server.Close()
+}
+
+// startEmbeddedBroker runs the broker from the config in this process. A config without mqtt.host connects to it.
+func startEmbeddedBroker() (*broker.Server, error) {
+	var rules types.BrokerRules
+	if err := viper.UnmarshalKey("broker", &rules); err != nil {
+		return nil, err
+	}
+	options := util.BrokerOptions{Listen: util.BrokerListen(rules.Listen, rules.Users), Users: rules.Users}
+	if rules.TLS.Cert != "" || rules.TLS.Key != "" {
+		tlsConfig, err := util.BrokerTLSConfig(rules.TLS.Cert, rules.TLS.Key, rules.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		options.TLS = tlsConfig
+	}
+	if rules.PersistRetained {
+		options.RetainedFile = filepath.Join(stateDir(), "broker", "retained.json")
+	}
+	if len(options.Users) == 0 && rules.Listen != "" {
+		slog.Warn("The broker has no users, anyone who can reach " + options.Listen + " may connect")
+	}
+	server, err := util.NewBroker(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.Serve(); err != nil {
+		return nil, err
+	}
+	if viper.GetString("mqtt.host") == "" {
+		_, port, _ := net.SplitHostPort(options.Listen)
+		viper.Set("mqtt.host", "127.0.0.1")
+		viper.Set("mqtt.port", port)
+	}
+	slog.Info("MQTT broker listening on " + options.Listen)
+	return server, nil
+}
@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"seedstore/types"
+	"seedstore/util"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// claims is set once claimsReady is closed, it stays nil unless the subscribers split the queue through claims
+var claims *util.Claims
+var claimsReady = make(chan struct{})
+
+// errClaimed is returned by acceptMessage for items another subscriber took
+var errClaimed = errors.New("claimed by another subscriber")
+
+// standby keeps the messages other subscribers took, to take them over if their owner dies. It is set along with claims.
+var standby *util.Standby
+
+// claimsEnabled tells whether the subscribers that share the queue agree on who takes each item through claims.
+// It is meant for brokers without shared subscriptions, where every subscriber gets every message.
+func claimsEnabled() bool {
+	return viper.GetBool("mqtt.claims.enabled")
+}
+
+func claimsTopic() string {
+	topic := viper.GetString("mqtt.claims.topic")
+	if topic == "" {
+		topic = "seedstore/claims"
+	}
+	return topic
+}
+
+// claimLease is how long a claim holds without being renewed, and so how long the others wait for a subscriber
+// that died before taking over its items.
+func claimLease() time.Duration {
+	lease := viper.GetDuration("mqtt.claims.lease")
+	if lease <= 0 {
+		lease = time.Minute
+	}
+	return lease
+}
+
+// claimSettle is how long a claim waits for the competing ones.
+func claimSettle() time.Duration {
+	settle := viper.GetDuration("mqtt.claims.settle")
+	if settle <= 0 {
+		settle = 2 * time.Second
+	}
+	return settle
+}
+
+// claimKeepDone is how long the others hear that an item is done once its owner finished it, and so how long a
+// subscriber may be away and still skip the items the others took while it was.
+func claimKeepDone() time.Duration {
+	keep := viper.GetDuration("mqtt.claims.keepDone")
+	if keep <= 0 {
+		keep = 7 * 24 * time.Hour
+	}
+	return keep
+}
+
+// startClaims follows the claims of the subscribers that share the queue. The jobs restored from the journal are
+// claimed again, and the items the others took are taken over when their lease runs out.
+func startClaims(ctx context.Context, client mqtt.Client) error {
+	if !claimsEnabled() {
+		return nil
+	}
+	defer close(claimsReady)
+	var err error
+	standby, err = util.OpenStandby(filepath.Join(stateDir(), "standby.jsonl"))
+	if err != nil {
+		return fmt.Errorf("could not read the messages on standby: %w", err)
+	}
+	options := client.OptionsReader()
+	following := util.NewClaims(client, options.ClientID(), claimsTopic(), claimLease(), claimSettle(), claimKeepDone())
+	if err := following.Start(ctx); err != nil {
+		return fmt.Errorf("could not follow the claims: %w", err)
+	}
+	claims = following
+	jobsLock.Lock()
+	for _, tracked := range trackedJobs {
+		// Whether they are still ours is checked again before they start
+		go claims.Claim(util.ClaimID(tracked.job.Message), tracked.job.Message.Force)
+	}
+	jobsLock.Unlock()
+	go watchStandby(ctx)
+	slog.Info("Sharing the queue through the claims on " + claimsTopic())
+	return nil
+}
+
+// waitForClaims waits until the claims are followed, it returns nil when they are not used.
+func waitForClaims(ctx context.Context) (*util.Claims, error) {
+	if !claimsEnabled() {
+		return nil, nil
+	}
+	select {
+	case <-claimsReady:
+		return claims, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// claimMessage takes the item of msg for this subscriber. An item another subscriber took is kept on standby,
+// and one another subscriber is done with is a duplicate.
+func claimMessage(ctx context.Context, topic string, msg types.MQTTMessage, replyTo *types.ReplyTo) error {
+	following, err := waitForClaims(ctx)
+	if following == nil {
+		return err
+	}
+	id := util.ClaimID(msg)
+	winner, won, err := following.Claim(id, msg.Force)
+	if err != nil {
+		return fmt.Errorf("could not claim \"%s\": %w", msg.Name, err)
+	}
+	if winner.Done {
+		return fmt.Errorf("%w: \"%s\" was downloaded by %s", errDuplicate, msg.Name, winner.Owner)
+	}
+	if !won {
+		standBy(topic, msg, replyTo)
+		return fmt.Errorf("%w: \"%s\" is taken by %s", errClaimed, msg.Name, winner.Owner)
+	}
+	return nil
+}
+
+// holdClaim checks that job is still ours before it starts, another subscriber may have taken it over while this
+// one was down. A job lost that way is forgotten and kept on standby instead.
+func holdClaim(ctx context.Context, job *types.Job) bool {
+	following, err := waitForClaims(ctx)
+	if following == nil {
+		return err == nil
+	}
+	id := util.ClaimID(job.Message)
+	winner, won, err := following.Claim(id, job.Message.Force)
+	if err != nil {
+		// It was ours when it was accepted
+		slog.Warn("Could not check the claim on \"" + job.Message.Name + "\", starting it anyway: " + err.Error())
+		return true
+	}
+	if winner.Done {
+		slog.Info(fmt.Sprintf("\"%s\" was downloaded by %s meanwhile, dropping it", job.Message.Name, winner.Owner))
+		forgetJob(job)
+		return false
+	}
+	if !won {
+		slog.Info(fmt.Sprintf("\"%s\" was taken over by %s, standing by", job.Message.Name, winner.Owner))
+		standBy(job.Topic, job.Message, job.ReplyTo)
+		forgetJob(job)
+		return false
+	}
+	return true
+}
+
+// releaseClaim tells the other subscribers that the item of msg is taken care of.
+func releaseClaim(msg types.MQTTMessage) {
+	select {
+	case <-claimsReady:
+		if claims != nil {
+			claims.Release(util.ClaimID(msg))
+		}
+	default:
+	}
+}
+
+func standBy(topic string, msg types.MQTTMessage, replyTo *types.ReplyTo) {
+	if err := standby.Add(topic, msg, replyTo); err != nil {
+		slog.Error("Could not keep \"" + msg.Name + "\" on standby, it is lost if the subscriber restarts: " + err.Error())
+	}
+}
+
+// watchStandby takes over the items of the subscribers whose lease ran out, and drops the ones they are done with.
+func watchStandby(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	// takingOver keeps an item from being taken over twice while its claim settles
+	takingOver := make(map[string]bool)
+	done := make(chan string)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-done:
+			delete(takingOver, id)
+			continue
+		case <-ticker.C:
+		}
+		now := time.Now()
+		for id, waiting := range standby.All() {
+			claim, found := claims.Current(id)
+			if takingOver[id] || found && !claim.Done && claim.Live(now) {
+				continue
+			}
+			// Released, the owner is done with it
+			if !found || claim.Done {
+				if err := standby.Remove(id); err != nil {
+					slog.Error("Could not take \"" + waiting.Message.Name + "\" off standby: " + err.Error())
+				}
+				continue
+			}
+			slog.Info(fmt.Sprintf("The lease of %s on \"%s\" ran out, taking it over", claim.Owner, waiting.Message.Name))
+			takingOver[id] = true
+			go func() {
+				takeOver(ctx, id, waiting)
+				select {
+				case done <- id:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+}
+
+// takeOver accepts the message of waiting and takes it off standby. It stays there if another subscriber claimed it
+// first, or if the subscriber stops meanwhile.
+func takeOver(ctx context.Context, id string, waiting types.Job) {
+	_, err := acceptMessage(ctx, waiting.Topic, waiting.Message, waiting.ReplyTo)
+	switch {
+	case errors.Is(err, errClaimed):
+		slog.Info("Standing by: " + err.Error())
+		return
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		slog.Error("Could not take over \"" + waiting.Message.Name + "\": " + err.Error())
+	}
+	if err := standby.Remove(id); err != nil {
+		slog.Error("Could not take \"" + waiting.Message.Name + "\" off standby: " + err.Error())
+	}
+}
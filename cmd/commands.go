@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"seedstore/types"
+	"seedstore/util"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+var bandwidth *util.Bandwidth
+
+// rateOverride is the bandwidth limit set at runtime through a command, it wins over the config while set
+var rateOverride *int64
+var rateLock sync.Mutex
+
+// commandTopic is the MQTT topic a running subscriber takes commands on.
+func commandTopic() string {
+	topic := viper.GetString("mqtt.commandTopic")
+	if topic == "" {
+		topic = "seedstore/command"
+	}
+	return topic
+}
+
+// onCommandReceived is the callback for messages on the command topic.
+func onCommandReceived(client mqtt.Client, msg mqtt.Message) {
+	defer msg.Ack()
+	var command types.Command
+	if err := json.Unmarshal(msg.Payload(), &command); err != nil {
+		slog.Error("Command formatting error: " + err.Error())
+		return
+	}
+	if err := verifyCommand(command); err != nil {
+		slog.Warn("Ignoring the command \"" + command.Command + "\": " + err.Error())
+		return
+	}
+	if err := handleCommand(command); err != nil {
+		slog.Error("Command \"" + command.Command + "\" failed: " + err.Error())
+	}
+}
+
+func handleCommand(command types.Command) error {
+	switch command.Command {
+	case types.CommandSetRate:
+		return setRateOverride(command.Value)
+	case types.CommandCancel, types.CommandPause, types.CommandResume:
+		return controlJobs(command)
+	case types.CommandPauseAll:
+		pauseAll()
+		return nil
+	case types.CommandResumeAll:
+		return resumeAll()
+	}
+	return fmt.Errorf("unknown command")
+}
+
+// setRateOverride sets the global bandwidth limit until it is set again, an empty value goes back to the config.
+func setRateOverride(value string) error {
+	rateLock.Lock()
+	if value == "" {
+		rateOverride = nil
+	} else {
+		rate, err := util.ParseRate(value)
+		if err != nil {
+			rateLock.Unlock()
+			return err
+		}
+		rateOverride = &rate
+	}
+	rateLock.Unlock()
+	applyRate()
+	return nil
+}
+
+// applyRate works out the global bandwidth limit: the one set at runtime, else the one of the current
+// download window, else the configured one.
+func applyRate() {
+	rate, err := util.ParseRate(viper.GetString("client.bandwidth.limit"))
+	if err != nil {
+		slog.Error("Bandwidth limit is invalid: " + err.Error())
+	}
+	if windowRate := schedule.RateLimit(time.Now()); windowRate > 0 {
+		rate = windowRate
+	}
+	rateLock.Lock()
+	if rateOverride != nil {
+		rate = *rateOverride
+	}
+	rateLock.Unlock()
+
+	if rate == bandwidth.Rate() {
+		return
+	}
+	bandwidth.SetRate(rate)
+	if rate == 0 {
+		slog.Info("Bandwidth is unlimited")
+	} else {
+		slog.Info(fmt.Sprintf("Bandwidth is limited to %d bytes/s across all transfers", rate))
+	}
+}
+
+// sendCommand publishes a command for the running subscriber, signed when the config has signing keys.
+func sendCommand(command types.Command) error {
+	if err := signCommand(&command); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	client := util.InitMQTTDefault()
+	defer client.Disconnect(250)
+	token := client.Publish(commandTopic(), 1, false, payload)
+	token.Wait()
+	return token.Error()
+}
@@ -0,0 +1,384 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"seedstore/types"
+	"seedstore/util"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedJob is a job the running subscriber still has to finish, along with what it takes to stop it
+type trackedJob struct {
+	job *types.Job
+	// cancel stops whatever the job is waiting on, its transfer or its retry backoff, nil while it is queued
+	cancel context.CancelFunc
+	// action is a pause or cancel requested while the job couldn't be stopped right away
+	action *jobAction
+	// announced is closed once the accepted event of a new job is out, its other events wait for it
+	announced chan struct{}
+}
+
+type jobAction struct {
+	command       string
+	deletePartial bool
+}
+
+// actionHold stops a transfer the download schedule no longer allows and queues it again, it is never sent as a command
+const actionHold = "hold"
+
+// trackedJobs holds every unfinished job by ID, jobsLock also guards the state of the jobs
+var trackedJobs = make(map[string]*trackedJob)
+var jobsLock sync.Mutex
+
+// queueHeld keeps queued jobs from starting after a pause-all
+var queueHeld atomic.Bool
+
+func trackJob(job *types.Job) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	trackedJobs[job.ID] = &trackedJob{job: job}
+}
+
+// trackNewJob tracks a job that was just accepted. Its events are held back until announce is called, once its
+// accepted event is out.
+func trackNewJob(job *types.Job) (announce func()) {
+	announced := make(chan struct{})
+	jobsLock.Lock()
+	trackedJobs[job.ID] = &trackedJob{job: job, announced: announced}
+	jobsLock.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(announced) })
+	}
+}
+
+// waitAnnounced waits for the accepted event of a new job to be out.
+func waitAnnounced(job *types.Job) {
+	jobsLock.Lock()
+	tracked, found := trackedJobs[job.ID]
+	jobsLock.Unlock()
+	if found && tracked.announced != nil {
+		<-tracked.announced
+	}
+}
+
+func untrackJob(job *types.Job) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	delete(trackedJobs, job.ID)
+}
+
+// startJob registers cancel as the way to stop the job. If a pause or cancel came in while nothing could
+// stop the job, it is returned instead and the caller must apply it.
+func startJob(job *types.Job, cancel context.CancelFunc) *jobAction {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	tracked, found := trackedJobs[job.ID]
+	if !found {
+		return nil
+	}
+	if action := tracked.action; action != nil {
+		tracked.action = nil
+		return action
+	}
+	tracked.cancel = cancel
+	return nil
+}
+
+// finishJob unregisters the cancel function of the job and returns the pause or cancel that stopped it, if any.
+func finishJob(job *types.Job) *jobAction {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	tracked, found := trackedJobs[job.ID]
+	if !found {
+		return nil
+	}
+	action := tracked.action
+	tracked.action = nil
+	tracked.cancel = nil
+	return action
+}
+
+// findJobs returns the unfinished jobs with the given ID or torrent hash.
+func findJobs(target string) []*types.Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	var found []*types.Job
+	for _, tracked := range trackedJobs {
+		job := tracked.job
+		if job.ID == target || (job.Message.Hash != "" && strings.EqualFold(job.Message.Hash, target)) {
+			found = append(found, job)
+		}
+	}
+	return found
+}
+
+// snapshotJobs returns a copy of every unfinished job, the queued ones first in the order they will start
+// and the others from the oldest.
+func snapshotJobs() []types.Job {
+	queued := fullQueue.Items()
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	snapshot := make([]types.Job, 0, len(trackedJobs))
+	seen := make(map[string]bool, len(queued))
+	for _, job := range queued {
+		if _, found := trackedJobs[job.ID]; found {
+			snapshot = append(snapshot, *job)
+			seen[job.ID] = true
+		}
+	}
+	var others []types.Job
+	for id, tracked := range trackedJobs {
+		if !seen[id] {
+			others = append(others, *tracked.job)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].CreatedAt.Before(others[j].CreatedAt) })
+	return append(snapshot, others...)
+}
+
+// findJobsFor returns the unfinished jobs about the same item as msg.
+func findJobsFor(msg types.MQTTMessage) []*types.Job {
+	key := util.HistoryKey(msg)
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	var found []*types.Job
+	for _, tracked := range trackedJobs {
+		if util.HistoryKey(tracked.job.Message) == key {
+			found = append(found, tracked.job)
+		}
+	}
+	return found
+}
+
+// controlJobs applies a cancel, pause or resume command to every job matching its target.
+func controlJobs(command types.Command) error {
+	if command.Target == "" {
+		return errors.New("no job ID or hash given")
+	}
+	found := findJobs(command.Target)
+	if len(found) == 0 {
+		return errors.New("no unfinished job found for " + command.Target)
+	}
+	var errs []error
+	for _, job := range found {
+		if command.Command == types.CommandResume {
+			errs = append(errs, resumeJob(job))
+			continue
+		}
+		action := &jobAction{command: command.Command, deletePartial: command.DeletePartial}
+		if stopJob(job, action) {
+			applyJobAction(job, action)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopJob asks the job to pause or cancel. A job that is running or waiting for a retry is stopped through
+// its cancel function and applies the action itself, as does a job about to start. It returns true when
+// the job isn't doing anything, in which case the caller must apply the action.
+func stopJob(job *types.Job, action *jobAction) bool {
+	jobsLock.Lock()
+	tracked, found := trackedJobs[job.ID]
+	if !found {
+		jobsLock.Unlock()
+		return false
+	}
+	if job.State == types.JobPaused {
+		jobsLock.Unlock()
+		return action.command == types.CommandCancel
+	}
+	tracked.action = action
+	if tracked.cancel != nil {
+		tracked.cancel()
+		jobsLock.Unlock()
+		return false
+	}
+	jobsLock.Unlock()
+
+	// The job is queued, unless it was dequeued in the meantime and picks up the action when it starts
+	if removed := fullQueue.RemoveFunc(func(queued *types.Job) bool { return queued == job }); len(removed) > 0 {
+		finishJob(job)
+		return true
+	}
+	return false
+}
+
+// applyJobAction pauses or cancels a job that is no longer queued nor running.
+func applyJobAction(job *types.Job, action *jobAction) {
+	if action.command == actionHold {
+		updateJobState(job, types.JobQueued, func(job *types.Job) { job.NextAttemptAt = time.Time{} })
+		slog.Info("Held back \"" + job.Message.Name + "\" until the next download window")
+		defer publishState()
+		if err := fullQueue.Enqueue(context.Background(), job); err != nil && !errors.Is(err, util.ErrQueueClosed) {
+			slog.Error("Could not requeue \"" + job.Message.Name + "\": " + err.Error())
+		}
+		return
+	}
+	if action.command == types.CommandPause {
+		setJobState(job, types.JobPaused)
+		slog.Info("Paused \"" + job.Message.Name + "\"")
+		publishEvent(types.EventPaused, job, nil)
+		return
+	}
+	setJobState(job, types.JobCancelled)
+	if action.deletePartial {
+		deletePartialData(job)
+	}
+	slog.Info("Cancelled \"" + job.Message.Name + "\"")
+	publishEvent(types.EventCancelled, job, nil)
+	recordHistory(job)
+	forgetJob(job)
+}
+
+// resumeJob queues a paused job again, its transfer continues where it stopped.
+func resumeJob(job *types.Job) error {
+	jobsLock.Lock()
+	paused := job.State == types.JobPaused
+	jobsLock.Unlock()
+	if !paused {
+		return fmt.Errorf("\"%s\" is not paused", job.Message.Name)
+	}
+	updateJobState(job, types.JobQueued, func(job *types.Job) { job.NextAttemptAt = time.Time{} })
+	slog.Info("Resuming \"" + job.Message.Name + "\"")
+	defer publishState()
+	return fullQueue.Enqueue(context.Background(), job)
+}
+
+// pauseAll pauses every unfinished job and holds back the jobs that come in until resumeAll.
+func pauseAll() {
+	queueHeld.Store(true)
+	jobsLock.Lock()
+	var jobs []*types.Job
+	for _, tracked := range trackedJobs {
+		jobs = append(jobs, tracked.job)
+	}
+	jobsLock.Unlock()
+	for _, job := range jobs {
+		action := &jobAction{command: types.CommandPause}
+		if stopJob(job, action) {
+			applyJobAction(job, action)
+		}
+	}
+	slog.Info("Paused every job")
+	publishState()
+}
+
+// resumeAll resumes every paused job and lets new jobs start again.
+func resumeAll() error {
+	queueHeld.Store(false)
+	jobsLock.Lock()
+	var paused []*types.Job
+	for _, tracked := range trackedJobs {
+		if tracked.job.State == types.JobPaused {
+			paused = append(paused, tracked.job)
+		}
+	}
+	jobsLock.Unlock()
+	sort.Slice(paused, func(i, j int) bool { return paused[i].CreatedAt.Before(paused[j].CreatedAt) })
+	var errs []error
+	for _, job := range paused {
+		errs = append(errs, resumeJob(job))
+	}
+	fullQueue.Wake()
+	slog.Info("Resumed every job")
+	publishState()
+	return errors.Join(errs...)
+}
+
+// moveToTop makes the jobs matching target the next ones to start.
+func moveToTop(target string) error {
+	found := findJobs(target)
+	if len(found) == 0 {
+		return errors.New("no unfinished job found for " + target)
+	}
+	for _, job := range found {
+		if !fullQueue.MoveToFront(func(queued *types.Job) bool { return queued == job }) {
+			return fmt.Errorf("\"%s\" is not queued", job.Message.Name)
+		}
+		slog.Info("Moved \"" + job.Message.Name + "\" to the top of the queue")
+	}
+	return nil
+}
+
+// retryNow retries the jobs matching target right away. A job waiting for a retry skips the rest of its
+// backoff, a dead-lettered job gets a fresh set of attempts.
+func retryNow(target string) error {
+	if found := findJobs(target); len(found) > 0 {
+		for _, job := range found {
+			if !skipBackoff(job) {
+				return fmt.Errorf("\"%s\" is not waiting for a retry", job.Message.Name)
+			}
+			slog.Info("Retrying \"" + job.Message.Name + "\" now")
+		}
+		return nil
+	}
+	job, err := deadLetters.Remove(target)
+	if errors.Is(err, util.ErrJobNotFound) {
+		return errors.New("no job waiting for a retry or dead-lettered found for " + target)
+	}
+	if err != nil {
+		return err
+	}
+	job.Attempts = 0
+	job.LastError = ""
+	job.ErrorClass = ""
+	job.NextAttemptAt = time.Time{}
+	setJobState(&job, types.JobQueued)
+	trackJob(&job)
+	slog.Info("Retrying dead-lettered \"" + job.Message.Name + "\"")
+	return fullQueue.Enqueue(context.Background(), &job)
+}
+
+// skipBackoff ends the wait of a job waiting for a retry, which makes retryLater queue it right away.
+func skipBackoff(job *types.Job) bool {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	tracked, found := trackedJobs[job.ID]
+	if !found || tracked.cancel == nil || job.State != types.JobQueued || job.NextAttemptAt.IsZero() {
+		return false
+	}
+	tracked.cancel()
+	return true
+}
+
+// deletePartialData removes whatever the transfer of the job downloaded so far.
+func deletePartialData(job *types.Job) {
+	toPath, found, err := jobDestination(job)
+	if err != nil {
+		slog.Error("Not deleting the partial data of \"" + job.Message.Name + "\": " + err.Error())
+		return
+	}
+	if !found {
+		return
+	}
+	localPath, err := downloadPath(toPath, job.Message.Location)
+	if err != nil {
+		slog.Error("Not deleting the partial data of \"" + job.Message.Name + "\": " + err.Error())
+		return
+	}
+	if err := os.RemoveAll(localPath); err != nil {
+		slog.Error("Could not delete the partial data of \"" + job.Message.Name + "\": " + err.Error())
+		return
+	}
+	slog.Info("Deleted the partial data at " + localPath)
+}
+
+// downloadPath returns where the transfer of location ends up in toPath.
+func downloadPath(toPath string, location string) (string, error) {
+	base := path.Base(strings.TrimRight(location, "/"))
+	if base == "." || base == ".." || base == "/" {
+		return "", &util.TransferError{Class: util.ErrorConfig, Message: "invalid location: " + location}
+	}
+	return filepath.Join(toPath, base), nil
+}
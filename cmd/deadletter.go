@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"seedstore/util"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// deadletterCmd represents the deadletter command
+var deadletterCmd = &cobra.Command{
+	Use:   "deadletter",
+	Short: "Inspect and requeue jobs that ran out of attempts",
+	Long: `Jobs whose transfer failed for good, either because the error can't be fixed
+	by retrying (wrong credentials, missing remote path) or because every attempt
+	failed, are kept in a dead-letter list next to the config file.
+`,
+}
+
+var deadletterListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the jobs in the dead-letter list",
+	Args:  cobra.NoArgs,
+	Run:   deadletterList,
+}
+
+var deadletterRequeueCmd = &cobra.Command{
+	Use:   "requeue [id or hash]...",
+	Short: "Publish dead jobs to the MQTT server again so the subscriber retries them",
+	Run:   deadletterRequeue,
+}
+
+func init() {
+	rootCmd.AddCommand(deadletterCmd)
+	deadletterCmd.AddCommand(deadletterListCmd)
+	deadletterCmd.AddCommand(deadletterRequeueCmd)
+
+	deadletterListCmd.Flags().Bool("json", false, "print the jobs as JSON")
+	deadletterRequeueCmd.Flags().Bool("all", false, "requeue every job in the dead-letter list")
+	deadletterRequeueCmd.Flags().StringP("topic", "t", "queue", "the MQTT topic for the jobs that don't record the topic they came on")
+}
+
+func openDeadLetters() *util.DeadLetters {
+	return util.NewDeadLetters(filepath.Join(stateDir(), "deadletter.jsonl"))
+}
+
+func deadletterList(cmd *cobra.Command, args []string) {
+	jobs, err := openDeadLetters().List()
+	if err != nil {
+		slog.Error("Could not read the dead-letter list: " + err.Error())
+		return
+	}
+	asJSON, _ := cmd.Flags().GetBool("json")
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(jobs)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tHASH\tCODE\tATTEMPTS\tCLASS\tERROR")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			job.ID, job.Message.Name, job.Message.Hash, job.Code, job.Attempts, job.ErrorClass, job.LastError)
+	}
+	w.Flush()
+}
+
+func deadletterRequeue(cmd *cobra.Command, args []string) {
+	topic, _ := cmd.Flags().GetString("topic")
+	all, _ := cmd.Flags().GetBool("all")
+	deadLetters := openDeadLetters()
+	if all {
+		jobs, err := deadLetters.List()
+		if err != nil {
+			slog.Error("Could not read the dead-letter list: " + err.Error())
+			return
+		}
+		args = args[:0]
+		for _, job := range jobs {
+			args = append(args, job.ID)
+		}
+	}
+	if len(args) == 0 {
+		slog.Error("Nothing to requeue, pass job IDs or hashes, or --all")
+		return
+	}
+
+	qos, err := messageQoS(cmd)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	client := util.InitMQTTDefault()
+	defer client.Disconnect(250)
+	for _, id := range args {
+		job, err := deadLetters.Remove(id)
+		if err != nil {
+			slog.Error("Could not take " + id + " off the dead-letter list: " + err.Error())
+			continue
+		}
+		// Back to the topic it came on, whose subscription and path variables it was accepted under
+		jobTopic := topic
+		if job.Topic != "" {
+			jobTopic = job.Topic
+		}
+		if err := pub(client, jobTopic, qos, &job.Message); err != nil {
+			slog.Error("Could not publish \"" + job.Message.Name + "\": " + err.Error())
+			// Put it back so it isn't lost
+			if err := deadLetters.Add(job); err != nil {
+				slog.Error(err.Error())
+			}
+			continue
+		}
+		slog.Info("Requeued \"" + job.Message.Name + "\" on " + jobTopic)
+	}
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"seedstore/util"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List, search and export the jobs the subscriber finished",
+	Long: `Every job the subscriber finishes, whether it was downloaded, failed or was
+	cancelled, is recorded in a history next to the config file. The subscriber
+	uses it to skip items it already downloaded, unless they are published with --force.
+`,
+}
+
+var historyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List past jobs",
+	Args:  cobra.NoArgs,
+	Run:   historyList,
+}
+
+var historySearchCmd = &cobra.Command{
+	Use:   "search [text]",
+	Short: "List past jobs whose name, hash, location or category contains the text",
+	Args:  cobra.ExactArgs(1),
+	Run:   historyList,
+}
+
+var historyExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export past jobs as JSON or CSV",
+	Args:  cobra.NoArgs,
+	Run:   historyExport,
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.AddCommand(historyListCmd)
+	historyCmd.AddCommand(historySearchCmd)
+	historyCmd.AddCommand(historyExportCmd)
+
+	historyCmd.PersistentFlags().String("state", "", "only the jobs that ended in this state: done, failed or cancelled")
+	historyCmd.PersistentFlags().String("code", "", "only the jobs with this code")
+	historyCmd.PersistentFlags().Duration("since", 0, "only the jobs that finished within this long, e.g. 24h")
+	historyCmd.PersistentFlags().Int("limit", 0, "only the most recent jobs")
+	historyListCmd.Flags().Bool("json", false, "print the jobs as JSON")
+	historySearchCmd.Flags().Bool("json", false, "print the jobs as JSON")
+	historyExportCmd.Flags().StringP("format", "f", "json", "the export format: json or csv")
+	historyExportCmd.Flags().StringP("output", "o", "", "the file to export to (default: stdout)")
+}
+
+func openHistory() *util.History {
+	return util.NewHistory(filepath.Join(stateDir(), "history.jsonl"))
+}
+
+// historyFilter builds the filter from the flags shared by the history commands.
+func historyFilter(cmd *cobra.Command, args []string) util.HistoryFilter {
+	state, _ := cmd.Flags().GetString("state")
+	code, _ := cmd.Flags().GetString("code")
+	since, _ := cmd.Flags().GetDuration("since")
+	limit, _ := cmd.Flags().GetInt("limit")
+	filter := util.HistoryFilter{State: types.JobState(state), Code: code, Limit: limit}
+	if since > 0 {
+		filter.Since = time.Now().Add(-since)
+	}
+	if len(args) == 1 {
+		filter.Search = args[0]
+	}
+	return filter
+}
+
+func historyList(cmd *cobra.Command, args []string) {
+	jobs, err := openHistory().List(historyFilter(cmd, args))
+	if err != nil {
+		slog.Error("Could not read the history: " + err.Error())
+		return
+	}
+	asJSON, _ := cmd.Flags().GetBool("json")
+	if asJSON {
+		writeHistoryJSON(os.Stdout, jobs)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FINISHED\tSTATE\tNAME\tHASH\tCODE\tATTEMPTS\tERROR")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			job.UpdatedAt.Format(time.DateTime), job.State, job.Message.Name, job.Message.Hash, job.Code, job.Attempts, job.LastError)
+	}
+	w.Flush()
+}
+
+func historyExport(cmd *cobra.Command, args []string) {
+	format, _ := cmd.Flags().GetString("format")
+	if format != "json" && format != "csv" {
+		slog.Error("Unknown export format: " + format)
+		return
+	}
+	jobs, err := openHistory().List(historyFilter(cmd, args))
+	if err != nil {
+		slog.Error("Could not read the history: " + err.Error())
+		return
+	}
+	var out io.Writer = os.Stdout
+	if output, _ := cmd.Flags().GetString("output"); output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			slog.Error("Could not create the export file: " + err.Error())
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	if format == "csv" {
+		err = writeHistoryCSV(out, jobs)
+	} else {
+		err = writeHistoryJSON(out, jobs)
+	}
+	if err != nil {
+		slog.Error("Could not export the history: " + err.Error())
+	}
+}
+
+func writeHistoryJSON(w io.Writer, jobs []types.Job) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(jobs)
+}
+
+func writeHistoryCSV(w io.Writer, jobs []types.Job) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "name", "hash", "location", "category", "code", "state", "attempts", "errorClass", "lastError", "createdAt", "finishedAt"})
+	for _, job := range jobs {
+		writer.Write([]string{
+			job.ID, job.Message.Name, job.Message.Hash, job.Message.Location, job.Message.Category, job.Code,
+			string(job.State), strconv.Itoa(job.Attempts), job.ErrorClass, job.LastError,
+			job.CreatedAt.Format(time.RFC3339), job.UpdatedAt.Format(time.RFC3339),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
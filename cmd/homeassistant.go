@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"seedstore/types"
+	"seedstore/util"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// homeAssistantEnabled tells whether the subscriber announces itself to Home Assistant, which is opt-in.
+func homeAssistantEnabled() bool {
+	return viper.GetBool("mqtt.homeAssistant.enabled")
+}
+
+func discoveryPrefix() string {
+	prefix := viper.GetString("mqtt.homeAssistant.discoveryPrefix")
+	if prefix == "" {
+		prefix = "homeassistant"
+	}
+	return prefix
+}
+
+// homeAssistantNodeID identifies the subscriber in Home Assistant. It falls back to the client ID, as long as
+// that is configured rather than generated, so the entities stay the same across restarts.
+func homeAssistantNodeID() string {
+	if nodeID := viper.GetString("mqtt.homeAssistant.nodeId"); nodeID != "" {
+		return nodeID
+	}
+	if clientID := viper.GetString("mqtt.clientId"); clientID != "" {
+		return clientID
+	}
+	return "seedstore"
+}
+
+// homeAssistantEntities are the sensors fed by the subscriber state and the buttons that send queue commands.
+func homeAssistantEntities(clientID string) []util.HAEntity {
+	state := stateTopic(clientID)
+	press := func(command string) string {
+		payload, _ := json.Marshal(types.Command{Command: command})
+		return string(payload)
+	}
+	return []util.HAEntity{
+		{
+			Component: "sensor", ObjectID: "queue_length", Name: "Queue length", Icon: "mdi:tray-full",
+			StateTopic: state, ValueTemplate: "{{ value_json.queued }}", StateClass: "measurement",
+		},
+		{
+			Component: "sensor", ObjectID: "active_transfer", Name: "Active transfer", Icon: "mdi:download",
+			StateTopic: state, ValueTemplate: "{{ value_json.active | default('idle') }}",
+		},
+		{
+			Component: "sensor", ObjectID: "speed", Name: "Speed",
+			StateTopic: state, ValueTemplate: "{{ value_json.rate }}",
+			UnitOfMeasurement: "B/s", DeviceClass: "data_rate", StateClass: "measurement",
+		},
+		{
+			Component: "sensor", ObjectID: "last_completed", Name: "Last completed", Icon: "mdi:check-circle",
+			StateTopic:    state,
+			ValueTemplate: "{{ value_json.lastCompleted.name if value_json.lastCompleted is defined else 'none' }}",
+		},
+		{
+			Component: "sensor", ObjectID: "failures", Name: "Failures", Icon: "mdi:alert-circle",
+			StateTopic: state, ValueTemplate: "{{ value_json.failures }}", StateClass: "total_increasing",
+		},
+		{
+			Component: "button", ObjectID: "pause_all", Name: "Pause all", Icon: "mdi:pause",
+			CommandTopic: commandTopic(), PayloadPress: press(types.CommandPauseAll),
+		},
+		{
+			Component: "button", ObjectID: "resume_all", Name: "Resume all", Icon: "mdi:play",
+			CommandTopic: commandTopic(), PayloadPress: press(types.CommandResumeAll),
+		},
+	}
+}
+
+// startHomeAssistant announces the subscriber to Home Assistant, and again whenever Home Assistant comes online
+// since it may have lost the retained configs.
+func startHomeAssistant(client mqtt.Client) {
+	if !homeAssistantEnabled() {
+		return
+	}
+	announceHomeAssistant(client)
+	token := client.Subscribe(discoveryPrefix()+"/status", 1, onHomeAssistantStatus)
+	token.Wait()
+	if token.Error() != nil {
+		slog.Error("Could not watch the status of Home Assistant: " + token.Error().Error())
+	}
+}
+
+func onHomeAssistantStatus(client mqtt.Client, msg mqtt.Message) {
+	defer msg.Ack()
+	if string(msg.Payload()) == "online" {
+		// Waiting on a publish in a message handler would block the client
+		go announceHomeAssistant(client)
+	}
+}
+
+func announceHomeAssistant(client mqtt.Client) {
+	options := client.OptionsReader()
+	nodeID := homeAssistantNodeID()
+	name := viper.GetString("mqtt.homeAssistant.name")
+	if name == "" {
+		name = "Seedstore " + nodeID
+	}
+	device := util.HADevice{
+		Identifiers:  []string{"seedstore_" + util.DiscoveryID(nodeID)},
+		Name:         name,
+		Manufacturer: "Seedstore",
+		Model:        "Subscriber",
+	}
+	if err := util.PublishDiscovery(client, discoveryPrefix(), nodeID, device, homeAssistantEntities(options.ClientID())); err != nil {
+		slog.Error("Could not announce the subscriber to Home Assistant: " + err.Error())
+		return
+	}
+	publishState()
+	slog.Info("Announced the subscriber to Home Assistant under " + discoveryPrefix())
+}
@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"seedstore/types"
+	"seedstore/util"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+//go:embed dashboard/index.html
+var dashboard []byte
+
+// maxJobBody bounds the size of a POST /jobs request
+const maxJobBody = 1 << 20
+
+// idempotencyKeys remembers the response to every POST /jobs for a day
+var idempotencyKeys = util.NewIdempotencyCache(24 * time.Hour)
+
+// eventsKeepAlive is how often an idle event stream gets a comment, so proxies don't close it
+const eventsKeepAlive = 15 * time.Second
+
+// startHTTPServer serves the status API and the dashboard if client.http.listen is set. It refuses to
+// run without credentials, since the API shows what is being downloaded and the config.
+func startHTTPServer() *http.Server {
+	listen := viper.GetString("client.http.listen")
+	if listen == "" {
+		return nil
+	}
+	auth := util.HTTPAuth{
+		Username: viper.GetString("client.http.username"),
+		Password: viper.GetString("client.http.password"),
+		Token:    viper.GetString("client.http.token"),
+	}
+	if !auth.Enabled() {
+		slog.Error("Not starting the HTTP server, it needs client.http.token or client.http.username and password")
+		return nil
+	}
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboard)
+	})
+	mux.HandleFunc("GET /api/queue", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, snapshotJobs())
+	})
+	mux.HandleFunc("GET /api/transfers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, transfers())
+	})
+	mux.HandleFunc("GET /api/history", serveHistory)
+	mux.HandleFunc("GET /api/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, util.RedactSettings(viper.AllSettings()))
+	})
+	mux.HandleFunc("GET /metrics", serveMetrics)
+	mux.HandleFunc("GET /api/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(eventsCtx, w, r)
+	})
+
+	root := http.NewServeMux()
+	root.Handle("/", auth.Wrap(mux))
+	// Creating jobs is for tools rather than people, so it only takes the token
+	if auth.Token != "" {
+		root.Handle("POST /jobs", util.HTTPAuth{Token: auth.Token}.Wrap(http.HandlerFunc(serveCreateJob)))
+	} else {
+		slog.Warn("POST /jobs is disabled, it needs client.http.token")
+	}
+
+	server := &http.Server{Addr: listen, Handler: root, ReadHeaderTimeout: 10 * time.Second}
+	// Event streams never end on their own, so end them or shutting down waits for them forever
+	server.RegisterOnShutdown(stopEvents)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server error: " + err.Error())
+		}
+	}()
+	slog.Info("Serving the dashboard on " + listen)
+	return server
+}
+
+// stopHTTPServer lets the requests in flight finish before closing the server.
+func stopHTTPServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// serveCreateJob takes the same JSON as the MQTT messages and runs it through the same pipeline. Every request needs an
+// Idempotency-Key header, a retried request with the same key gets the first response again.
+func serveCreateJob(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "the Idempotency-Key header is required")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJobBody))
+	if err != nil {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	status, response, replayed, err := idempotencyKeys.Do(key, hex.EncodeToString(sum[:]), func() (int, []byte) {
+		return createJob(r.Context(), body)
+	})
+	if errors.Is(err, util.ErrIdempotencyMismatch) {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// createJob accepts the message in body and returns the status and body of the response.
+func createJob(ctx context.Context, body []byte) (int, []byte) {
+	respond := func(status int, v any) (int, []byte) {
+		data, _ := json.Marshal(v)
+		return status, append(data, '\n')
+	}
+	messagesReceived.Inc("http")
+	var msg types.MQTTMessage
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&msg); err != nil {
+		messagesRejected.Inc("invalid_json")
+		return respond(http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()})
+	}
+	slog.Info("HTTP Payload: " + string(body))
+	job, err := acceptMessage(ctx, "", msg, nil)
+	switch {
+	case errors.Is(err, types.ErrInvalidMessage):
+		return respond(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, errDuplicate), errors.Is(err, errClaimed):
+		return respond(http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, util.ErrQueueFull):
+		return respond(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	case err != nil:
+		return respond(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return respond(http.StatusAccepted, map[string]string{"id": job.ID, "code": job.Code})
+}
+
+// serveHistory lists the history, filtered by the state, code, search, since and limit query parameters.
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := util.HistoryFilter{
+		State:  types.JobState(query.Get("state")),
+		Code:   query.Get("code"),
+		Search: query.Get("search"),
+		Limit:  100,
+	}
+	if since := query.Get("since"); since != "" {
+		duration, err := time.ParseDuration(since)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid since: "+err.Error())
+			return
+		}
+		filter.Since = time.Now().Add(-duration)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit: "+limit)
+			return
+		}
+		filter.Limit = n
+	}
+	jobs, err := history.List(filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if jobs == nil {
+		jobs = []types.Job{}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// serveEvents streams the progress of the running transfers as server-sent events until the client goes
+// away or ctx is cancelled.
+func serveEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	updates, unsubscribe := progressUpdates.Subscribe(1)
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(running []types.Transfer) error {
+		data, err := json.Marshal(running)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := send(transfers()); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case running := <-updates:
+			if err := send(running); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
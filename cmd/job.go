@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"log/slog"
+	"seedstore/types"
+
+	"github.com/spf13/cobra"
+)
+
+// jobCmd represents the job command
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Cancel, pause or resume the jobs of a running subscriber",
+	Long: `Control single jobs of a running subscriber, addressed by job ID or torrent hash.
+	Pausing stops the transfer but keeps what was downloaded, so resuming continues
+	where it stopped. Cancelling stops the transfer for good.
+`,
+}
+
+var jobCancelCmd = &cobra.Command{
+	Use:   "cancel [id or hash]",
+	Short: "Stop a job for good",
+	Args:  cobra.ExactArgs(1),
+	Run:   jobControl(types.CommandCancel),
+}
+
+var jobPauseCmd = &cobra.Command{
+	Use:   "pause [id or hash]",
+	Short: "Stop a job, keeping its partial data",
+	Args:  cobra.ExactArgs(1),
+	Run:   jobControl(types.CommandPause),
+}
+
+var jobResumeCmd = &cobra.Command{
+	Use:   "resume [id or hash]",
+	Short: "Queue a paused job again",
+	Args:  cobra.ExactArgs(1),
+	Run:   jobControl(types.CommandResume),
+}
+
+func init() {
+	rootCmd.AddCommand(jobCmd)
+	jobCmd.AddCommand(jobCancelCmd)
+	jobCmd.AddCommand(jobPauseCmd)
+	jobCmd.AddCommand(jobResumeCmd)
+
+	jobCancelCmd.Flags().Bool("delete-partial", false, "delete what was downloaded so far")
+}
+
+func jobControl(name string) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		command := types.Command{Command: name, Target: args[0]}
+		if name == types.CommandCancel {
+			command.DeletePartial, _ = cmd.Flags().GetBool("delete-partial")
+		}
+		if err := sendCommand(command); err != nil {
+			slog.Error("Could not send the command: " + err.Error())
+		}
+	}
+}
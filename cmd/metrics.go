@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"seedstore/types"
+	"seedstore/util"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are served on /metrics by the HTTP server
+var metrics = util.NewMetrics()
+
+var (
+	messagesReceived = metrics.NewCounter("seedstore_messages_received_total",
+		"Messages received, by where they came from.", "source")
+	messagesRejected = metrics.NewCounter("seedstore_messages_rejected_total",
+		"Messages that didn't become a job, by reason.", "reason")
+	queueDepth = metrics.NewGauge("seedstore_queue_depth",
+		"Jobs waiting in the queue.")
+	jobsByState = metrics.NewGauge("seedstore_jobs",
+		"Unfinished jobs, by state.", "state")
+	jobsFinished = metrics.NewCounter("seedstore_jobs_finished_total",
+		"Jobs that finished, by the state they ended in.", "state", "code")
+	jobRetries = metrics.NewCounter("seedstore_job_retries_total",
+		"Transfers that failed and were scheduled for another attempt, by error class.", "class")
+	transferBytes = metrics.NewHistogram("seedstore_transfer_bytes",
+		"Size of the completed transfers.", byteBuckets, "code", "backend")
+	transferDuration = metrics.NewHistogram("seedstore_transfer_duration_seconds",
+		"Duration of the completed transfers.", durationBuckets, "code", "backend")
+	mqttConnectedGauge = metrics.NewGauge("seedstore_mqtt_connected",
+		"Whether the subscriber is connected to the MQTT server.")
+	mqttReconnects = metrics.NewCounter("seedstore_mqtt_reconnects_total",
+		"Times the subscriber connected to the MQTT server again after losing the connection.")
+	lastSuccess = metrics.NewGauge("seedstore_last_success_timestamp_seconds",
+		"Unix time of the last completed download.")
+)
+
+// byteBuckets go from 1MiB to 1TiB, four times bigger every step
+var byteBuckets = []float64{1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30, 1 << 32, 1 << 34, 1 << 36, 1 << 38, 1 << 40}
+
+// durationBuckets go from a second to half a day
+var durationBuckets = []float64{1, 5, 15, 60, 300, 900, 1800, 3600, 7200, 14400, 43200}
+
+// mqttConnected tells whether the subscriber connected before, so that the next connection counts as a reconnect
+var mqttConnected atomic.Bool
+
+func init() {
+	metrics.OnCollect(func() {
+		if fullQueue != nil {
+			queueDepth.Set(float64(fullQueue.Size()))
+		}
+		counts := make(map[types.JobState]int)
+		jobsLock.Lock()
+		for _, tracked := range trackedJobs {
+			counts[tracked.job.State]++
+		}
+		jobsLock.Unlock()
+		jobsByState.Reset()
+		for _, state := range []types.JobState{types.JobQueued, types.JobTransferring, types.JobVerifying, types.JobPostProcessing, types.JobPaused} {
+			jobsByState.Set(float64(counts[state]), string(state))
+		}
+	})
+}
+
+// rejectReason is the reason label of seedstore_messages_rejected_total for an error of acceptMessage.
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, util.ErrBadSignature):
+		return "bad_signature"
+	case errors.Is(err, types.ErrInvalidMessage):
+		return "invalid"
+	case errors.Is(err, errDuplicate):
+		return "duplicate"
+	case errors.Is(err, errClaimed):
+		return "claimed"
+	case errors.Is(err, util.ErrQueueFull):
+		return "queue_full"
+	}
+	return "error"
+}
+
+// observeTransfer records a completed transfer of job into localPath that started at started.
+func observeTransfer(job *types.Job, backend string, localPath string, started time.Time) {
+	code := strings.ToLower(job.Code)
+	if bytes, err := util.DiskUsage(localPath); err == nil {
+		transferBytes.Observe(float64(bytes), code, backend)
+	}
+	transferDuration.Observe(time.Since(started).Seconds(), code, backend)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteText(w)
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"seedstore/types"
+	"seedstore/util"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// queueTopics are the topics the subscriber takes jobs from, they are part of its presence
+var queueTopics []string
+
+// presenceWait is how long publish waits for the retained presence of the subscribers
+const presenceWait = time.Second
+
+// presenceTopic is where the retained presence of a subscriber goes.
+func presenceTopic(clientID string) string {
+	topic := viper.GetString("mqtt.presence.topic")
+	if topic == "" {
+		topic = "seedstore/subscriber/{clientId}/presence"
+	}
+	return strings.ReplaceAll(topic, "{clientId}", clientID)
+}
+
+func heartbeatInterval() time.Duration {
+	interval := viper.GetDuration("mqtt.presence.heartbeatInterval")
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	return interval
+}
+
+func presence(clientID string, status string) types.Presence {
+	return types.Presence{
+		ClientID: clientID,
+		Status:   status,
+		Topics:   queueTopics,
+		Version:  Version,
+	}
+}
+
+// presenceWill is the Last Will of the subscriber, which flips its presence to offline when it goes away without
+// saying so.
+func presenceWill(clientID string) *util.Will {
+	payload, _ := json.Marshal(presence(clientID, types.PresenceOffline))
+	return &util.Will{Topic: presenceTopic(clientID), Payload: payload, Retained: true}
+}
+
+// sendHeartbeats keeps the presence of the subscriber fresh until ctx is cancelled.
+func sendHeartbeats(ctx context.Context) {
+	publishPresence()
+	ticker := time.NewTicker(heartbeatInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			publishPresence()
+		}
+	}
+}
+
+// publishPresence publishes that the subscriber is online, along with a heartbeat.
+func publishPresence() mqtt.Token {
+	heartbeat := &types.Heartbeat{FreeDisk: freeDisk(), Time: time.Now()}
+	if fullQueue != nil {
+		heartbeat.Queued = fullQueue.Size()
+	}
+	return publishPresenceStatus(types.PresenceOnline, heartbeat)
+}
+
+// publishOffline publishes that the subscriber is going away, the Last Will is only sent when it doesn't say so.
+func publishOffline() mqtt.Token {
+	return publishPresenceStatus(types.PresenceOffline, nil)
+}
+
+func publishPresenceStatus(status string, heartbeat *types.Heartbeat) mqtt.Token {
+	statusLock.Lock()
+	client := statusClient
+	statusLock.Unlock()
+	if client == nil {
+		return nil
+	}
+	options := client.OptionsReader()
+	clientID := options.ClientID()
+	current := presence(clientID, status)
+	current.Heartbeat = heartbeat
+	payload, err := json.Marshal(current)
+	if err != nil {
+		slog.Error("Could not encode the presence: " + err.Error())
+		return nil
+	}
+	return publishStatus(presenceTopic(clientID), true, payload)
+}
+
+// freeDisk is how many bytes are free at the destination of each code. A code the subscriptions send elsewhere
+// than the client config counts with the first of them.
+func freeDisk() map[string]int64 {
+	free := make(map[string]int64)
+	measure := func(code string, path string) {
+		code = strings.ToUpper(code)
+		if _, found := free[code]; found {
+			return
+		}
+		// The nearest existing parent of a destination with topic variables stands for it
+		bytes, err := util.FreeSpace(path)
+		if err != nil {
+			slog.Warn("Could not read the free space of " + path + ": " + err.Error())
+			return
+		}
+		free[code] = bytes
+	}
+	for code, path := range viper.GetStringMapString("client.codeDestinations") {
+		measure(code, path)
+	}
+	for _, subscription := range subscriptions {
+		for code, path := range subscription.CodeDestinations {
+			measure(code, path)
+		}
+	}
+	return free
+}
+
+// checkSubscribers looks for a subscriber of topic that is online, and warns or fails, as mode says, when there is
+// none. An empty mode skips the check.
+func checkSubscribers(client mqtt.Client, topic string, mode string) error {
+	if mode == "" {
+		return nil
+	}
+	// A subscriber that missed three heartbeats is stuck, or gone without its Last Will being sent yet
+	online, err := util.OnlineSubscribers(client, presenceTopic("+"), topic, presenceWait, 3*heartbeatInterval())
+	if err != nil {
+		return fmt.Errorf("could not look for subscribers: %w", err)
+	}
+	if len(online) > 0 {
+		return nil
+	}
+	if mode == "fail" {
+		return errors.New("no subscriber of " + topic + " is online")
+	}
+	slog.Warn("No subscriber of " + topic + " is online, the message waits at the server until one comes back")
+	return nil
+}
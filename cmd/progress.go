@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"seedstore/types"
+	"seedstore/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the progress of the running transfers is measured
+const progressInterval = 2 * time.Second
+
+// activeTransfer is a running transfer and where its download ends up
+type activeTransfer struct {
+	transfer  types.Transfer
+	localPath string
+	measured  time.Time
+	// reported is the percentage of the last progress event
+	reported int
+}
+
+var activeTransfers = make(map[string]*activeTransfer)
+var transfersLock sync.Mutex
+
+// progressUpdates gets the progress of every running transfer whenever it is measured
+var progressUpdates util.Broadcaster[[]types.Transfer]
+
+// startTransfer tracks the progress of the transfer of job into localPath until done is called.
+func startTransfer(job *types.Job, backend string, localPath string) (done func()) {
+	now := time.Now()
+	active := &activeTransfer{
+		transfer: types.Transfer{
+			JobID:     job.ID,
+			Name:      job.Message.Name,
+			Code:      job.Code,
+			Backend:   backend,
+			Size:      job.Message.Size,
+			StartedAt: now,
+		},
+		localPath: localPath,
+		measured:  now,
+	}
+	// Whatever an earlier attempt left behind isn't part of the speed
+	active.transfer.Bytes, _ = util.DiskUsage(localPath)
+	transfersLock.Lock()
+	activeTransfers[job.ID] = active
+	transfersLock.Unlock()
+	return func() {
+		transfersLock.Lock()
+		delete(activeTransfers, job.ID)
+		transfersLock.Unlock()
+		progressUpdates.Publish(transfers())
+	}
+}
+
+// transfers returns the progress of every running transfer, the oldest first.
+func transfers() []types.Transfer {
+	transfersLock.Lock()
+	defer transfersLock.Unlock()
+	running := make([]types.Transfer, 0, len(activeTransfers))
+	for _, active := range activeTransfers {
+		running = append(running, active.transfer)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].StartedAt.Before(running[j].StartedAt) })
+	return running
+}
+
+// watchTransfers measures the progress of the running transfers until ctx is cancelled.
+func watchTransfers(ctx context.Context) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		running, progressed := measureTransfers()
+		if !running {
+			continue
+		}
+		progressUpdates.Publish(transfers())
+		for _, transfer := range progressed {
+			publishProgress(transfer)
+		}
+		if len(progressed) == 0 {
+			publishState()
+		}
+	}
+}
+
+// measureTransfers updates the progress of every running transfer and reports whether there are any. It also
+// returns the transfers that progressed by another step since their last progress event.
+func measureTransfers() (running bool, progressed []types.Transfer) {
+	transfersLock.Lock()
+	paths := make(map[string]string, len(activeTransfers))
+	for id, active := range activeTransfers {
+		paths[id] = active.localPath
+	}
+	transfersLock.Unlock()
+	if len(paths) == 0 {
+		return false, nil
+	}
+	// Walking the downloads can take a while, so don't hold up the transfers starting and finishing meanwhile
+	used := make(map[string]int64, len(paths))
+	for id, localPath := range paths {
+		bytes, err := util.DiskUsage(localPath)
+		if err != nil {
+			slog.Warn("Could not measure the progress of " + localPath + ": " + err.Error())
+			continue
+		}
+		used[id] = bytes
+	}
+
+	now := time.Now()
+	step := progressStep()
+	transfersLock.Lock()
+	defer transfersLock.Unlock()
+	for id, bytes := range used {
+		active, found := activeTransfers[id]
+		if !found {
+			continue
+		}
+		transfer := &active.transfer
+		if elapsed := now.Sub(active.measured).Seconds(); elapsed > 0 {
+			transfer.Rate = max(int64(float64(bytes-transfer.Bytes)/elapsed), 0)
+		}
+		transfer.Bytes = bytes
+		if transfer.Size > 0 {
+			transfer.Percent = min(float64(bytes)*100/float64(transfer.Size), 100)
+			if reached, stepped := util.ProgressStep(transfer.Percent, step, active.reported); stepped {
+				active.reported = reached
+				progressed = append(progressed, *transfer)
+			}
+		}
+		active.measured = now
+	}
+	return true, progressed
+}
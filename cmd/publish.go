@@ -1,12 +1,18 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/spf13/cobra"
+	"fmt"
 	"log/slog"
+	"os"
 	"seedstore/types"
 	"seedstore/util"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
 )
 
 // publishCmd represents the publish command
@@ -18,25 +24,143 @@ var publishCmd = &cobra.Command{
 	- name = name of the torrent at hand
 	- hash = the torrent hash for it
 	- location = the location of the torrent at hand
+	- priority = the priority of the torrent, higher is transferred first
+	- size = the size of the torrent in bytes
 `,
 	Args: cobra.NoArgs,
 	Run:  publish,
 }
 
+// finalEvents end the wait for replies
+var finalEvents = map[string]bool{
+	types.EventCompleted: true,
+	types.EventFailed:    true,
+	types.EventCancelled: true,
+	types.EventRejected:  true,
+}
+
 func publish(cmd *cobra.Command, args []string) {
+	qos, err := messageQoS(cmd)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	properties, err := messageProperties(cmd)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	ifNoSubscriber, _ := cmd.Flags().GetString("if-no-subscriber")
+	if ifNoSubscriber != "" && ifNoSubscriber != "warn" && ifNoSubscriber != "fail" {
+		slog.Error("--if-no-subscriber must be warn or fail, not " + ifNoSubscriber)
+		return
+	}
 	client := util.InitMQTTDefault()
+	defer client.Disconnect(250)
 	name, _ := cmd.Flags().GetString("name")
 	hash, _ := cmd.Flags().GetString("hash")
 	location, _ := cmd.Flags().GetString("location")
 	category, _ := cmd.Flags().GetString("category")
 	topic, _ := cmd.Flags().GetString("topic")
+	priority, _ := cmd.Flags().GetInt("priority")
+	size, _ := cmd.Flags().GetInt64("size")
+	force, _ := cmd.Flags().GetBool("force")
 	message := types.MQTTMessage{
 		Name:     name,
 		Hash:     hash,
 		Location: location,
 		Category: category,
+		Priority: priority,
+		Size:     size,
+		Force:    force,
+	}
+	if err := checkSubscribers(client, topic, ifNoSubscriber); err != nil {
+		slog.Error("Not publishing the message: " + err.Error())
+		// Scripts need to tell that nothing was queued
+		client.Disconnect(250)
+		os.Exit(1)
+	}
+	var replies <-chan types.StatusEvent
+	if properties.ResponseTopic != "" {
+		if replies, err = awaitReplies(client, properties); err != nil {
+			slog.Error("Could not subscribe to the response topic: " + err.Error())
+			return
+		}
+	}
+	if err := pubWithProperties(client, topic, qos, &message, properties); err != nil {
+		slog.Error("Could not publish the message: " + err.Error())
+		return
+	}
+	if replies != nil {
+		wait, _ := cmd.Flags().GetDuration("wait")
+		waitForReplies(replies, wait)
+	}
+}
+
+// messageProperties reads the MQTT 5 properties of the message from the flags.
+func messageProperties(cmd *cobra.Command) (util.MessageProperties, error) {
+	responseTopic, _ := cmd.Flags().GetString("response-topic")
+	expiry, _ := cmd.Flags().GetDuration("expiry")
+	userProperties, _ := cmd.Flags().GetStringToString("property")
+	properties := util.MessageProperties{
+		ResponseTopic:  responseTopic,
+		MessageExpiry:  expiry,
+		UserProperties: userProperties,
+	}
+	if responseTopic != "" {
+		properties.CorrelationData = []byte(uuid.NewString())
+	}
+	if expiry < 0 {
+		return properties, fmt.Errorf("--expiry can't be negative")
+	}
+	return properties, nil
+}
+
+// awaitReplies subscribes to the response topic for the replies about the message with the correlation data
+// of properties.
+func awaitReplies(client mqtt.Client, properties util.MessageProperties) (<-chan types.StatusEvent, error) {
+	replies := make(chan types.StatusEvent, 16)
+	token := client.Subscribe(properties.ResponseTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		received, _ := util.Properties(msg)
+		if !bytes.Equal(received.CorrelationData, properties.CorrelationData) {
+			return
+		}
+		var event types.StatusEvent
+		if err := json.Unmarshal(msg.Payload(), &event); err != nil {
+			slog.Error("Reply formatting error: " + err.Error())
+			return
+		}
+		select {
+		case replies <- event:
+		default:
+		}
+	})
+	token.Wait()
+	return replies, token.Error()
+}
+
+// waitForReplies prints the replies until the job is finished, it is rejected, or wait is over.
+func waitForReplies(replies <-chan types.StatusEvent, wait time.Duration) {
+	timeout := time.After(wait)
+	for {
+		select {
+		case event := <-replies:
+			switch {
+			case event.Error != "":
+				fmt.Printf("%s %s: %s\n", event.Event, event.Name, event.Error)
+			case event.Event == types.EventProgress:
+				fmt.Printf("%s %s: %.0f%%\n", event.Event, event.Name, event.Percent)
+			default:
+				fmt.Printf("%s %s (job %s)\n", event.Event, event.Name, event.JobID)
+			}
+			if finalEvents[event.Event] {
+				return
+			}
+		case <-timeout:
+			slog.Warn(fmt.Sprintf("No result within %s, the job goes on without us waiting", wait))
+			return
+		}
 	}
-	pub(client, topic, &message)
 }
 
 func init() {
@@ -49,15 +173,57 @@ func init() {
 	publishCmd.Flags().StringP("location", "l", "", "the location of the torrent at hand")
 	publishCmd.Flags().StringP("category", "c", "", "the category code for the torrent")
 	publishCmd.Flags().StringP("topic", "t", "queue", "the MQTT topic to use for publishing the message")
+	publishCmd.Flags().IntP("priority", "p", 0, "the priority of the torrent, higher is transferred first when the subscriber schedules by priority")
+	publishCmd.Flags().Int64("size", 0, "the size of the torrent in bytes")
+	publishCmd.Flags().Bool("force", false, "download the torrent even if the subscriber already downloaded it")
+	publishCmd.Flags().Int("qos", 1, "the MQTT quality of service, overrides mqtt.qos")
+	publishCmd.Flags().String("response-topic", "", "wait for the result of the job on this topic, needs MQTT 5")
+	publishCmd.Flags().Duration("wait", time.Minute, "how long to wait for the result with --response-topic")
+	publishCmd.Flags().Duration("expiry", 0, "drop the message if the subscriber doesn't get it within this time, needs MQTT 5")
+	publishCmd.Flags().StringToString("property", nil, "a user property to send along, key=value, needs MQTT 5")
+	publishCmd.Flags().String("if-no-subscriber", "", "warn or fail when no subscriber of the topic is online")
 
 }
 
-func pub(client mqtt.Client, topic string, message *types.MQTTMessage) {
+// messageQoS is the quality of service for the queue, from the --qos flag or else the config.
+func messageQoS(cmd *cobra.Command) (byte, error) {
+	if flag := cmd.Flags().Lookup("qos"); flag != nil && flag.Changed {
+		qos, _ := cmd.Flags().GetInt("qos")
+		if qos < 0 || qos > 2 {
+			return 0, fmt.Errorf("--qos must be 0, 1 or 2, not %d", qos)
+		}
+		return byte(qos), nil
+	}
+	return util.MQTTQoS()
+}
+
+func pub(client mqtt.Client, topic string, qos byte, message *types.MQTTMessage) error {
+	return pubWithProperties(client, topic, qos, message, util.MessageProperties{})
+}
+
+// pubWithProperties signs message if there are signing keys, and publishes it along with properties over MQTT 5,
+// which always carry the schema version. Over MQTT 3.1.1 there is nowhere to put them.
+func pubWithProperties(client mqtt.Client, topic string, qos byte, message *types.MQTTMessage, properties util.MessageProperties) error {
+	if err := signMessage(topic, message); err != nil {
+		return fmt.Errorf("could not sign the message: %w", err)
+	}
 	msg, err := json.Marshal(message)
 	if err != nil {
-		slog.Error(err.Error())
+		return err
+	}
+	var token mqtt.Token
+	if version, _ := util.ProtocolVersion(); version == 5 {
+		userProperties := map[string]string{"schemaVersion": types.SchemaVersion}
+		for key, value := range properties.UserProperties {
+			userProperties[key] = value
+		}
+		properties.UserProperties = userProperties
+		token = util.PublishWithProperties(client, topic, qos, false, msg, properties)
+	} else if properties.ResponseTopic != "" || properties.MessageExpiry > 0 || len(properties.UserProperties) > 0 {
+		return util.ErrNotMQTT5
+	} else {
+		token = client.Publish(topic, qos, false, msg)
 	}
-	token := client.Publish(topic, 0, false, msg)
 	token.Wait()
-
+	return token.Error()
 }
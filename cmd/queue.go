@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"seedstore/util"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// queueCmd represents the queue command
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Inspect and manage the queue of a running subscriber",
+	Long: `Talk to a running subscriber on the same machine through its control socket,
+	which is next to the config file unless client.control.socket says otherwise.
+	Jobs are addressed by job ID or torrent hash.
+`,
+}
+
+var queueListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the unfinished jobs, the queued ones in the order they will start",
+	Args:  cobra.NoArgs,
+	Run:   queueList,
+}
+
+var queueShowCmd = &cobra.Command{
+	Use:   "show [id or hash]",
+	Short: "Show everything about a job",
+	Args:  cobra.ExactArgs(1),
+	Run:   queueShow,
+}
+
+var queueRemoveCmd = &cobra.Command{
+	Use:   "remove [id or hash]",
+	Short: "Cancel a job and take it off the queue",
+	Args:  cobra.ExactArgs(1),
+	Run:   queueRequest(types.ControlRemove),
+}
+
+var queueMoveToTopCmd = &cobra.Command{
+	Use:   "move-to-top [id or hash]",
+	Short: "Make a queued job the next one to start",
+	Args:  cobra.ExactArgs(1),
+	Run:   queueRequest(types.ControlMoveToTop),
+}
+
+var queueRetryCmd = &cobra.Command{
+	Use:   "retry [id or hash]",
+	Short: "Retry a job waiting for a retry or in the dead-letter list right away",
+	Args:  cobra.ExactArgs(1),
+	Run:   queueRequest(types.ControlRetry),
+}
+
+var queuePauseAllCmd = &cobra.Command{
+	Use:   "pause-all",
+	Short: "Pause every job and hold back new ones",
+	Args:  cobra.NoArgs,
+	Run:   queueRequest(types.ControlPauseAll),
+}
+
+var queueResumeAllCmd = &cobra.Command{
+	Use:   "resume-all",
+	Short: "Resume every paused job",
+	Args:  cobra.NoArgs,
+	Run:   queueRequest(types.ControlResumeAll),
+}
+
+func init() {
+	rootCmd.AddCommand(queueCmd)
+	queueCmd.AddCommand(queueListCmd)
+	queueCmd.AddCommand(queueShowCmd)
+	queueCmd.AddCommand(queueRemoveCmd)
+	queueCmd.AddCommand(queueMoveToTopCmd)
+	queueCmd.AddCommand(queueRetryCmd)
+	queueCmd.AddCommand(queuePauseAllCmd)
+	queueCmd.AddCommand(queueResumeAllCmd)
+
+	queueListCmd.Flags().Bool("json", false, "print the jobs as JSON")
+}
+
+// controlSocketPath is where the subscriber listens for control requests.
+func controlSocketPath() string {
+	if socket := viper.GetString("client.control.socket"); socket != "" {
+		return socket
+	}
+	return filepath.Join(stateDir(), "seedstore.sock")
+}
+
+// startControlSocket serves the control socket for the queue commands. The subscriber runs without it
+// if the socket can't be created.
+func startControlSocket() *util.ControlServer {
+	var allowedUIDs []int
+	if err := viper.UnmarshalKey("client.control.allowedUids", &allowedUIDs); err != nil {
+		slog.Error("Control socket config is invalid: " + err.Error())
+		return nil
+	}
+	server, err := util.ListenControl(controlSocketPath(), allowedUIDs, handleControl)
+	if err != nil {
+		slog.Error("Could not create the control socket: " + err.Error())
+		return nil
+	}
+	go server.Serve()
+	slog.Info("Listening for queue commands on " + controlSocketPath())
+	return server
+}
+
+func handleControl(request types.ControlRequest) types.ControlResponse {
+	var err error
+	switch request.Command {
+	case types.ControlList:
+		return types.ControlResponse{Jobs: snapshotJobs()}
+	case types.ControlShow:
+		return showJobs(request.Target)
+	case types.ControlRemove:
+		err = controlJobs(types.Command{Command: types.CommandCancel, Target: request.Target})
+	case types.ControlMoveToTop:
+		err = moveToTop(request.Target)
+	case types.ControlRetry:
+		err = retryNow(request.Target)
+	case types.ControlPauseAll:
+		pauseAll()
+	case types.ControlResumeAll:
+		err = resumeAll()
+	default:
+		err = fmt.Errorf("unknown command %q", request.Command)
+	}
+	if err != nil {
+		return types.ControlResponse{Error: err.Error()}
+	}
+	return types.ControlResponse{}
+}
+
+// showJobs returns the unfinished or dead-lettered jobs with the given ID or hash.
+func showJobs(target string) types.ControlResponse {
+	var jobs []types.Job
+	jobsLock.Lock()
+	for _, tracked := range trackedJobs {
+		job := tracked.job
+		if job.ID == target || (job.Message.Hash != "" && strings.EqualFold(job.Message.Hash, target)) {
+			jobs = append(jobs, *job)
+		}
+	}
+	jobsLock.Unlock()
+	dead, err := deadLetters.List()
+	if err != nil {
+		return types.ControlResponse{Error: "could not read the dead-letter list: " + err.Error()}
+	}
+	for _, job := range dead {
+		if job.ID == target || (job.Message.Hash != "" && strings.EqualFold(job.Message.Hash, target)) {
+			jobs = append(jobs, job)
+		}
+	}
+	if len(jobs) == 0 {
+		return types.ControlResponse{Error: "no job found for " + target}
+	}
+	return types.ControlResponse{Jobs: jobs}
+}
+
+func callControl(request types.ControlRequest) (types.ControlResponse, bool) {
+	response, err := util.CallControl(controlSocketPath(), request)
+	if err != nil {
+		slog.Error("The subscriber could not handle the request: " + err.Error())
+		return response, false
+	}
+	return response, true
+}
+
+func queueList(cmd *cobra.Command, args []string) {
+	response, ok := callControl(types.ControlRequest{Command: types.ControlList})
+	if !ok {
+		return
+	}
+	asJSON, _ := cmd.Flags().GetBool("json")
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(response.Jobs)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tHASH\tCODE\tSTATE\tATTEMPTS\tNEXT ATTEMPT")
+	for _, job := range response.Jobs {
+		next := ""
+		if !job.NextAttemptAt.IsZero() {
+			next = job.NextAttemptAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			job.ID, job.Message.Name, job.Message.Hash, job.Code, job.State, job.Attempts, next)
+	}
+	w.Flush()
+}
+
+func queueShow(cmd *cobra.Command, args []string) {
+	response, ok := callControl(types.ControlRequest{Command: types.ControlShow, Target: args[0]})
+	if !ok {
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(response.Jobs)
+}
+
+func queueRequest(command string) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		request := types.ControlRequest{Command: command}
+		if len(args) == 1 {
+			request.Target = args[0]
+		}
+		if _, ok := callControl(request); ok {
+			fmt.Println("Done")
+		}
+	}
+}
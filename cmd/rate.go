@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"log/slog"
+	"seedstore/types"
+
+	"github.com/spf13/cobra"
+)
+
+// rateCmd represents the rate command
+var rateCmd = &cobra.Command{
+	Use:   "rate [limit]",
+	Short: "Change the bandwidth limit of a running subscriber",
+	Long: `Change the global bandwidth limit shared by every transfer of a running subscriber,
+	e.g. "5M" or "500K". Without a limit, the subscriber goes back to the limit in its config.
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  rate,
+}
+
+func init() {
+	rootCmd.AddCommand(rateCmd)
+}
+
+func rate(cmd *cobra.Command, args []string) {
+	command := types.Command{Command: types.CommandSetRate}
+	if len(args) == 1 {
+		command.Value = args[0]
+	}
+	if err := sendCommand(command); err != nil {
+		slog.Error("Could not send the command: " + err.Error())
+	}
+}
@@ -13,6 +13,9 @@ import (
 var cfgFile string
 var cfgDir string
 
+// Version is the version of the binary, shown by --version and sent along with the presence heartbeats
+var Version = "dev"
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "Seedstore",
@@ -25,6 +28,7 @@ easily download from a remote location, initiating the connection from the clien
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	rootCmd.Version = Version
 	err := rootCmd.Execute()
 	if err != nil {
 		os.Exit(1)
@@ -67,3 +71,17 @@ func initConfig() {
 	}
 
 }
+
+// stateDir returns the directory seedstore keeps its own files in, such as the job journal.
+// It lives next to the config so that a single mounted volume covers both.
+func stateDir() string {
+	if cfgDir != "" {
+		return cfgDir
+	}
+	if viper.ConfigFileUsed() != "" {
+		return filepath.Dir(viper.ConfigFileUsed())
+	}
+	home, err := os.UserHomeDir()
+	cobra.CheckErr(err)
+	return filepath.Join(home, ".seedstore")
+}
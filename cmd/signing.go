@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"seedstore/types"
+	"seedstore/util"
+
+	"github.com/spf13/viper"
+)
+
+// signer checks the signatures of the queue messages, it stays nil unless the subscriber only takes signed ones
+var signer *util.Signer
+
+// newSigner reads mqtt.signing, it returns nil when there are no signing keys and messages aren't signed.
+func newSigner() (*util.Signer, error) {
+	var rules types.SigningRules
+	if err := viper.UnmarshalKey("mqtt.signing", &rules); err != nil {
+		return nil, err
+	}
+	if len(rules.Keys) == 0 {
+		return nil, nil
+	}
+	return util.NewSigner(rules)
+}
+
+// signMessage signs message for topic when the config has signing keys.
+func signMessage(topic string, message *types.MQTTMessage) error {
+	signing, err := newSigner()
+	if signing == nil {
+		return err
+	}
+	return signing.Sign(topic, message)
+}
+
+// signCommand signs command when the config has signing keys.
+func signCommand(command *types.Command) error {
+	signing, err := newSigner()
+	if signing == nil {
+		return err
+	}
+	return signing.SignCommand(commandTopic(), command)
+}
+
+// verifyCommand checks the signature of a command, when the subscriber wants one. Pausing and resuming everything
+// only go through unsigned when mqtt.signing.unsignedPauseAll allows it, as the Home Assistant buttons can't sign them.
+func verifyCommand(command types.Command) error {
+	if signer == nil {
+		return nil
+	}
+	pauseAll := command.Command == types.CommandPauseAll || command.Command == types.CommandResumeAll
+	if pauseAll && viper.GetBool("mqtt.signing.unsignedPauseAll") {
+		return nil
+	}
+	return signer.VerifyCommand(commandTopic(), command)
+}
+
+// verifySignature checks the signature of a message received on topic, when the subscriber wants one.
+func verifySignature(topic string, msg types.MQTTMessage) error {
+	if signer == nil {
+		return nil
+	}
+	if err := signer.Verify(topic, msg); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrInvalidMessage, err)
+	}
+	return nil
+}
+
+// forgetSignature lets a message that couldn't be taken through again when the broker delivers it once more.
+func forgetSignature(signature *types.Signature) {
+	if signer != nil {
+		signer.Forget(signature)
+	}
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"seedstore/types"
+	"seedstore/util"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// statusClient publishes the status events, it is nil until the subscriber is connected
+var statusClient mqtt.Client
+
+// lastCompleted and failures are part of the subscriber state
+var lastCompleted *types.Completed
+var failures int
+var statusLock sync.Mutex
+
+func setStatusClient(client mqtt.Client) {
+	statusLock.Lock()
+	statusClient = client
+	statusLock.Unlock()
+	publishState()
+}
+
+// statusEnabled tells whether the subscriber reports back over MQTT, which it does unless mqtt.status.enabled is false.
+func statusEnabled() bool {
+	return !viper.IsSet("mqtt.status.enabled") || viper.GetBool("mqtt.status.enabled")
+}
+
+// statusTopic is where the events of job go. Jobs without a hash use their ID instead.
+func statusTopic(job types.Job) string {
+	topic := viper.GetString("mqtt.status.topic")
+	if topic == "" {
+		topic = "seedstore/status/{hash}"
+	}
+	return util.StatusTopic(topic, job)
+}
+
+// stateTopic is where the retained summary of the subscriber goes.
+func stateTopic(clientID string) string {
+	topic := viper.GetString("mqtt.status.stateTopic")
+	if topic == "" {
+		topic = "seedstore/subscriber/{clientId}/state"
+	}
+	return strings.ReplaceAll(topic, "{clientId}", clientID)
+}
+
+// progressStep is how many percent a transfer must progress between two progress events.
+func progressStep() int {
+	step := viper.GetInt("mqtt.status.progressStep")
+	if step <= 0 {
+		step = 10
+	}
+	return step
+}
+
+// publishEvent publishes a status event for job, fill adds the details of the event. The subscriber state is
+// published along with it. The events of a new job come after its accepted event.
+func publishEvent(event string, job *types.Job, fill func(e *types.StatusEvent)) {
+	if event != types.EventAccepted {
+		waitAnnounced(job)
+	}
+	jobsLock.Lock()
+	snapshot := *job
+	jobsLock.Unlock()
+	statusEvent := types.StatusEvent{
+		Event:    event,
+		JobID:    snapshot.ID,
+		Hash:     snapshot.Message.Hash,
+		Name:     snapshot.Message.Name,
+		Code:     snapshot.Code,
+		State:    snapshot.State,
+		Attempts: snapshot.Attempts,
+		Time:     time.Now(),
+	}
+	if fill != nil {
+		fill(&statusEvent)
+	}
+
+	statusLock.Lock()
+	switch event {
+	case types.EventCompleted:
+		lastCompleted = &types.Completed{JobID: snapshot.ID, Name: snapshot.Message.Name, Hash: snapshot.Message.Hash, At: statusEvent.Time}
+	case types.EventFailed:
+		failures++
+	}
+	statusLock.Unlock()
+
+	payload, err := json.Marshal(statusEvent)
+	if err != nil {
+		slog.Error("Could not encode the status event: " + err.Error())
+		return
+	}
+	if statusEnabled() {
+		publishStatus(statusTopic(snapshot), false, payload)
+	}
+	if snapshot.ReplyTo != nil {
+		reply(snapshot.ReplyTo, payload)
+	}
+	publishState()
+}
+
+// replyRejected tells the publisher of msg that it didn't become a job, if it asked to hear about it.
+func replyRejected(replyTo *types.ReplyTo, msg types.MQTTMessage, reason error) {
+	if replyTo == nil {
+		return
+	}
+	payload, err := json.Marshal(types.StatusEvent{
+		Event: types.EventRejected,
+		Hash:  msg.Hash,
+		Name:  msg.Name,
+		Error: reason.Error(),
+		Time:  time.Now(),
+	})
+	if err != nil {
+		slog.Error("Could not encode the reply: " + err.Error())
+		return
+	}
+	reply(replyTo, payload)
+}
+
+// reply publishes payload to the response topic of a message, along with its correlation data.
+func reply(replyTo *types.ReplyTo, payload []byte) {
+	statusLock.Lock()
+	client := statusClient
+	statusLock.Unlock()
+	if client == nil || !client.IsConnectionOpen() {
+		return
+	}
+	util.PublishWithProperties(client, replyTo.Topic, 1, false, payload, util.MessageProperties{
+		CorrelationData: replyTo.CorrelationData,
+	})
+}
+
+// publishProgress publishes a progress event for a running transfer.
+func publishProgress(transfer types.Transfer) {
+	jobsLock.Lock()
+	tracked, found := trackedJobs[transfer.JobID]
+	jobsLock.Unlock()
+	if !found {
+		return
+	}
+	publishEvent(types.EventProgress, tracked.job, func(e *types.StatusEvent) {
+		e.Percent = transfer.Percent
+		e.Bytes = transfer.Bytes
+		e.Rate = transfer.Rate
+	})
+}
+
+// subscriberState sums up what the subscriber is doing.
+func subscriberState(clientID string) types.SubscriberState {
+	state := types.SubscriberState{
+		ClientID:  clientID,
+		Paused:    queueHeld.Load(),
+		Jobs:      make(map[types.JobState]int),
+		Transfers: transfers(),
+		UpdatedAt: time.Now(),
+	}
+	if fullQueue != nil {
+		state.Queued = fullQueue.Size()
+	}
+	jobsLock.Lock()
+	for _, tracked := range trackedJobs {
+		state.Jobs[tracked.job.State]++
+	}
+	jobsLock.Unlock()
+	for _, transfer := range state.Transfers {
+		state.Rate += transfer.Rate
+	}
+	if len(state.Transfers) > 0 {
+		state.Active = state.Transfers[0].Name
+	}
+	statusLock.Lock()
+	state.LastCompleted = lastCompleted
+	state.Failures = failures
+	statusLock.Unlock()
+	return state
+}
+
+// publishState publishes the summary of the subscriber, retained so that it is there for whoever subscribes later.
+// Home Assistant reads its sensors from it too.
+func publishState() mqtt.Token {
+	if !statusEnabled() && !homeAssistantEnabled() {
+		return nil
+	}
+	statusLock.Lock()
+	client := statusClient
+	statusLock.Unlock()
+	if client == nil {
+		return nil
+	}
+	options := client.OptionsReader()
+	clientID := options.ClientID()
+	payload, err := json.Marshal(subscriberState(clientID))
+	if err != nil {
+		slog.Error("Could not encode the subscriber state: " + err.Error())
+		return nil
+	}
+	return publishStatus(stateTopic(clientID), true, payload)
+}
+
+// publishStatus publishes without waiting, status updates are not worth holding up the transfers for.
+func publishStatus(topic string, retained bool, payload []byte) mqtt.Token {
+	statusLock.Lock()
+	client := statusClient
+	statusLock.Unlock()
+	if client == nil || !client.IsConnectionOpen() {
+		return nil
+	}
+	return client.Publish(topic, 1, retained, payload)
+}
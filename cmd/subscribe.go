@@ -1,20 +1,24 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"seedstore/types"
 	"seedstore/util"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -28,120 +32,1012 @@ var subscribeCmd = &cobra.Command{
 `,
 	Run: subscribe,
 }
-var wg sync.WaitGroup
-var fullQueue util.ConcurrentQueue[types.MQTTMessage]
-var ticker = time.NewTicker(200 * time.Millisecond)
+var fullQueue *util.ConcurrentQueue[*types.Job]
+var pool *util.WorkerPool
+var journal *util.Journal
+var deadLetters *util.DeadLetters
+var history *util.History
+
+// errDuplicate is returned by acceptMessage for items that are or were already downloaded
+var errDuplicate = errors.New("duplicate")
+
+// errNotStored is returned by acceptMessage when the job couldn't be written to the journal
+var errNotStored = errors.New("could not store the job")
+
+// receiveCtx is cancelled on shutdown, so a message waiting for room in a full queue stops waiting
+var receiveCtx = context.Background()
+
+// intakeSize is how many received messages can wait for acceptMessage before the client has to wait for room
+const intakeSize = 256
+
+// intake carries the received messages to the goroutines that accept them. The client delivers commands, claims and
+// status messages on the same goroutine as the jobs, so a job waiting for room in the queue must not hold it up.
+var intake = make(chan func(), intakeSize)
+
+// acceptLocks are held by item while a message is checked for duplicates, claimed and turned into a job. Duplicates
+// have the same claim ID, so they wait for each other, while other items aren't held up by a claim settling.
+var acceptLocks util.KeyedMutex
+var schedule *util.Schedule
 
 func init() {
 	rootCmd.AddCommand(subscribeCmd)
 	subscribeCmd.Flags().StringP("topic", "t", "queue", "the MQTT topic to use for subscribing the message, should be same as publish")
+	subscribeCmd.Flags().Int("qos", 1, "the MQTT quality of service, overrides mqtt.qos")
+	subscribeCmd.Flags().Bool("embedded-broker", false, "run the MQTT broker configured under broker in this process")
 }
 
 func subscribe(cmd *cobra.Command, args []string) {
-	client := util.InitMQTTWithHandlers(onMessageReceived, nil, nil)
 	topic, err := cmd.Flags().GetString("topic")
 	if err != nil {
 		slog.Error("Topic flag is invalid:" + err.Error())
 		return
 	}
+	qos, err := messageQoS(cmd)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	// The broker keeps what is published while the subscriber is down under its client ID
+	if viper.GetString("mqtt.clientId") == "" {
+		slog.Error("mqtt.clientId is required to subscribe, and must stay the same across restarts")
+		return
+	}
+	overflow, err := util.ParseOverflowPolicy(viper.GetString("client.queue.overflow"))
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	order, err := util.JobOrder(viper.GetString("client.scheduling.policy"), getIntMap("client.scheduling.codePriorities"))
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	var fairKey func(*types.Job) string
+	if viper.GetBool("client.scheduling.fair") {
+		fairKey = util.JobFairKey
+	}
+	var scheduleRules types.ScheduleRules
+	if err := viper.UnmarshalKey("client.schedule", &scheduleRules); err != nil {
+		slog.Error("Schedule config is invalid: " + err.Error())
+		return
+	}
+	schedule, err = util.ParseSchedule(scheduleRules)
+	if err != nil {
+		slog.Error("Schedule config is invalid: " + err.Error())
+		return
+	}
+	signer, err = newSigner()
+	if err != nil {
+		slog.Error("Signing config is invalid: " + err.Error())
+		return
+	}
+	if signer != nil {
+		if err := signer.RememberIn(filepath.Join(stateDir(), "nonces.json")); err != nil {
+			slog.Error("Could not read the nonces of the signed messages: " + err.Error())
+			return
+		}
+		slog.Info("Only taking signed messages")
+	}
+	subscriptions, err = util.Subscriptions()
+	if err != nil {
+		slog.Error("Subscriptions config is invalid: " + err.Error())
+		return
+	}
+	// The topic flag replaces the subscriptions from the config, which replace the default topic
+	topics := []string{topic}
+	if !cmd.Flags().Changed("topic") && len(subscriptions) > 0 {
+		topics = topics[:0]
+		for _, subscription := range subscriptions {
+			topics = append(topics, subscription.Topic)
+		}
+	}
+	journal, err = util.OpenJournal(filepath.Join(stateDir(), "jobs.journal"))
+	if err != nil {
+		slog.Error("Could not open the job journal: " + err.Error())
+		return
+	}
+	defer journal.Close()
+	deadLetters = openDeadLetters()
+	history = openHistory()
+	fullQueue = util.NewConcurrentQueue(util.QueueOptions[*types.Job]{
+		Capacity: viper.GetInt("client.queue.capacity"),
+		Overflow: overflow,
+		OnDrop: func(job *types.Job) {
+			slog.Warn("Queue is full, dropping: " + job.Message.Name)
+			forgetJob(job)
+		},
+		Less:    order,
+		FairKey: fairKey,
+	})
 	// This is to keep the subscribe command running indefinitely until there is a signal to kill
-	// AKA CTRL-C
-	keepAlive := make(chan os.Signal)
-	signal.Notify(keepAlive, os.Interrupt, syscall.SIGTERM)
+	// AKA CTRL-C. Cancelling ctx stops taking on new work, cancelling transferCtx stops the running transfers.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transferCtx, cancelTransfers := context.WithCancel(context.Background())
+	defer cancelTransfers()
 
-	token := client.Subscribe(topic, 1, nil)
+	pool = util.NewWorkerPool(util.PoolLimits{
+		MaxConcurrent: viper.GetInt("client.maxConcurrentTransfers"),
+		PerCode:       getIntMap("client.codeLimits"),
+		PerServer:     getIntMap("client.serverLimits"),
+	})
+	bandwidth = util.NewBandwidth(0)
+	applyRate()
+	go eventProcessor(ctx, transferCtx)
+	go watchSchedule(ctx)
+	restoreJobs(ctx)
+	if controlServer := startControlSocket(); controlServer != nil {
+		defer controlServer.Close()
+	}
+	go watchTransfers(transferCtx)
+	if httpServer := startHTTPServer(); httpServer != nil {
+		defer stopHTTPServer(httpServer)
+	}
+
+	if embedded, _ := cmd.Flags().GetBool("embedded-broker"); embedded {
+		server, err := startEmbeddedBroker()
+		if err != nil {
+			slog.Error("Could not start the broker: " + err.Error())
+			return
+		}
+		// Stopped after the subscriber disconnects, so its presence goes offline first
+		defer server.Close()
+	}
+	queueTopics = topics
+	receiveCtx = ctx
+	startIntake(ctx)
+	will := presenceWill(viper.GetString("mqtt.clientId"))
+	client := util.InitMQTTSession(filepath.Join(stateDir(), "mqtt"), will, onMessageReceived, onConnectionLost, onConnect)
+	setStatusClient(client)
+	go sendHeartbeats(ctx)
+	if err := startClaims(ctx, client); err != nil {
+		slog.Error(err.Error())
+		client.Disconnect(250)
+		return
+	}
+	for _, topic := range topics {
+		subscription := topic
+		if group := viper.GetString("mqtt.shareGroup"); group != "" {
+			// The broker hands each message to one subscriber of the group
+			subscription = "$share/" + group + "/" + topic
+		}
+		token := client.Subscribe(subscription, qos, nil)
+		token.Wait()
+		slog.Info("Subscribed to topic: " + subscription)
+	}
+	token := client.Subscribe(commandTopic(), 1, onCommandReceived)
 	token.Wait()
-	slog.Info("Subscribed to topic: " + topic)
-	go eventProcessor()
-	<-keepAlive
-	slog.Info("Ending the subscription...")
+	slog.Info("Listening for commands on topic: " + commandTopic())
+	startHomeAssistant(client)
+	<-signals
+	shutdown(client, signals, cancel, cancelTransfers)
+}
+
+// shutdown stops taking new messages and starting new transfers, then gives the running transfers the configured
+// grace period to finish before stopping them. Jobs cut short stay in the journal and are picked up on the next start.
+// Another signal during the grace period kills every transfer and exits right away.
+//
+// The subscription stays in the session at the broker, so what is published while the subscriber is down waits
+// there. Messages still arriving during the grace period are journaled and queued on the next start.
+func shutdown(client mqtt.Client, signals chan os.Signal, cancel context.CancelFunc, cancelTransfers context.CancelFunc) {
+	slog.Info("Ending the subscription, no longer starting transfers...")
+	cancel()
+	fullQueue.Close()
+	go func() {
+		<-signals
+		slog.Warn("Received a second signal, killing every transfer and exiting now")
+		util.KillRunningCommands()
+		os.Exit(1)
+	}()
+
+	drained := make(chan struct{})
+	go func() {
+		pool.Wait()
+		close(drained)
+	}()
+	grace := viper.GetDuration("client.shutdownGracePeriod")
+	if grace <= 0 {
+		grace = 30 * time.Second
+	}
+	if active := pool.Active(); active > 0 {
+		slog.Info(fmt.Sprintf("Waiting up to %s for %d running transfer(s) to finish, signal again to stop now", grace, active))
+	}
+	select {
+	case <-drained:
+	case <-time.After(grace):
+		slog.Warn("Grace period is over, stopping the remaining transfers")
+		cancelTransfers()
+		<-drained
+	}
+	if token := publishState(); token != nil {
+		token.WaitTimeout(time.Second)
+	}
+	if token := publishOffline(); token != nil {
+		token.WaitTimeout(time.Second)
+	}
 	client.Disconnect(250)
 }
 
+// restoreJobs re-enqueues the jobs left in the journal by a previous run, in their original order.
+// Jobs that were waiting for a retry keep waiting for whatever is left of their backoff, and paused
+// jobs stay paused until they are resumed.
+func restoreJobs(ctx context.Context) {
+	for _, job := range journal.Jobs() {
+		if job.State == types.JobPaused {
+			trackJob(&job)
+			slog.Info("Keeping paused transfer: " + job.Message.Name)
+			continue
+		}
+		if job.State != types.JobQueued {
+			slog.Info("Resuming interrupted transfer: " + job.Message.Name)
+		} else {
+			slog.Info("Restoring queued transfer: " + job.Message.Name)
+		}
+		// Set before the job is tracked, from then on it is read by others
+		job.State = types.JobQueued
+		trackJob(&job)
+		if wait := time.Until(job.NextAttemptAt); wait > 0 {
+			go retryLater(ctx, &job, wait)
+			continue
+		}
+		if err := fullQueue.Enqueue(ctx, &job); err != nil {
+			slog.Error("Could not restore \"" + job.Message.Name + "\": " + err.Error())
+		}
+	}
+}
+
+// getIntMap reads a map of integers from the config, e.g. the per-code limits.
+func getIntMap(key string) map[string]int {
+	limits := make(map[string]int)
+	for k, v := range viper.GetStringMap(key) {
+		limits[k] = cast.ToInt(v)
+	}
+	return limits
+}
+
 // onMessageReceived is a callback function that is called when a message is received on the MQTT topic that the client is subscribed to.
-// It unmarshals the JSON payload of the message into a types.MQTTMessage struct, logs the payload, and enqueues the message in the fullQueue.
+// It unmarshals the JSON payload of the message into a types.MQTTMessage struct, logs the payload, and hands the message to acceptMessage.
 func onMessageReceived(client mqtt.Client, msg mqtt.Message) {
+	// Messages kept by the broker for the other topics arrive here until they are subscribed again
+	switch {
+	case msg.Topic() == commandTopic():
+		onCommandReceived(client, msg)
+		return
+	case homeAssistantEnabled() && msg.Topic() == discoveryPrefix()+"/status":
+		onHomeAssistantStatus(client, msg)
+		return
+	case claimsEnabled() && strings.HasPrefix(msg.Topic(), claimsTopic()+"/"):
+		// Claims are retained, they come again once they are followed
+		msg.Ack()
+		return
+	}
 	// It is assumed that the message is json, so we should unmarshall it.
 	var jsonMsg types.MQTTMessage
 
-	err := json.Unmarshal(msg.Payload(), &jsonMsg)
+	messagesReceived.Inc("mqtt")
+	replyTo, err := messageReplyTo(msg)
+	if err != nil {
+		messagesRejected.Inc(rejectReason(err))
+		slog.Error("Could not accept the message: " + err.Error())
+		rejectMessage(client, msg, err)
+		replyRejected(replyTo, jsonMsg, err)
+		msg.Ack()
+		return
+	}
+	err = json.Unmarshal(msg.Payload(), &jsonMsg)
 	if err != nil {
+		messagesRejected.Inc("invalid_json")
 		slog.Error("Json formatting error: " + err.Error())
+		rejectMessage(client, msg, err)
+		replyRejected(replyTo, jsonMsg, err)
+		msg.Ack()
 		return
 	}
 	logJson := fmt.Sprintf("MQTT Payload: %s", string(msg.Payload()))
 	slog.Info(logJson)
-	fullQueue.Enqueue(jsonMsg)
+	if err := verifySignature(msg.Topic(), jsonMsg); err != nil {
+		messagesRejected.Inc(rejectReason(err))
+		slog.Error("Could not accept the message: " + err.Error())
+		rejectMessage(client, msg, err)
+		replyRejected(replyTo, jsonMsg, err)
+		msg.Ack()
+		return
+	}
+	select {
+	case intake <- func() { acceptReceived(client, msg, jsonMsg, replyTo) }:
+	case <-receiveCtx.Done():
+		// Not acked, the broker sends it again on the next start
+	}
+}
+
+// startIntake starts the goroutines that take the received messages from the intake until ctx is cancelled.
+// One goroutine keeps the messages in the order they came, with claims a few run at once since each claim
+// waits for the claims of the other subscribers to settle.
+func startIntake(ctx context.Context) {
+	workers := 1
+	if claimsEnabled() {
+		workers = 16
+	}
+	for range workers {
+		go func() {
+			for {
+				select {
+				case accept := <-intake:
+					accept()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// acceptReceived hands a message received over MQTT to acceptMessage, and acks it unless it has to come again.
+func acceptReceived(client mqtt.Client, msg mqtt.Message, jsonMsg types.MQTTMessage, replyTo *types.ReplyTo) {
+	// The signature was checked on the way in, the job doesn't need it
+	signature := jsonMsg.Signature
+	jsonMsg.Signature = nil
+	_, err := acceptMessage(receiveCtx, msg.Topic(), jsonMsg, replyTo)
+	switch {
+	case errors.Is(err, context.Canceled):
+		// Shut down while waiting for room in the queue, not acked so the broker sends it again on the next start
+		forgetSignature(signature)
+		slog.Info("Shutting down, \"" + jsonMsg.Name + "\" will be delivered again on the next start")
+		return
+	case errors.Is(err, errNotStored):
+		// Not acked, so the broker sends it again, along with the messages after it whose acks it holds back
+		forgetSignature(signature)
+		slog.Error("Could not store \"" + jsonMsg.Name + "\", it will be delivered again once the subscriber reconnects: " + err.Error())
+		return
+	}
+	reportAccepted(client, msg, jsonMsg, replyTo, err)
+	msg.Ack()
+}
+
+// reportAccepted logs what became of a message received over MQTT, and tells the publisher when it was turned down.
+func reportAccepted(client mqtt.Client, msg mqtt.Message, jsonMsg types.MQTTMessage, replyTo *types.ReplyTo, err error) {
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, types.ErrInvalidMessage):
+		slog.Error("Could not accept \"" + jsonMsg.Name + "\": " + err.Error())
+		rejectMessage(client, msg, err)
+	case errors.Is(err, errDuplicate):
+		slog.Info("Skipping " + err.Error())
+	case errors.Is(err, errClaimed):
+		// The subscriber that took it replies
+		slog.Info("Standing by: " + err.Error())
+		return
+	default:
+		slog.Error("Could not accept \"" + jsonMsg.Name + "\": " + err.Error())
+	}
+	replyRejected(replyTo, jsonMsg, err)
+}
+
+// messageReplyTo reads the MQTT 5 properties of msg: where the publisher wants to hear about the job, if anywhere,
+// and the schema version of the message, which must be one this subscriber knows. The reply topic comes back
+// even when the version is wrong, so the publisher hears why.
+func messageReplyTo(msg mqtt.Message) (*types.ReplyTo, error) {
+	properties, ok := util.Properties(msg)
+	if !ok {
+		return nil, nil
+	}
+	var replyTo *types.ReplyTo
+	if properties.ResponseTopic != "" {
+		replyTo = &types.ReplyTo{Topic: properties.ResponseTopic, CorrelationData: properties.CorrelationData}
+	}
+	if version, found := properties.UserProperties["schemaVersion"]; found && version != types.SchemaVersion {
+		return replyTo, fmt.Errorf("%w: schema version %s is not supported", types.ErrInvalidMessage, version)
+	}
+	return replyTo, nil
+}
+
+// errorTopic is where the messages that can't become a job go.
+func errorTopic() string {
+	topic := viper.GetString("mqtt.errorTopic")
+	if topic == "" {
+		topic = "seedstore/errors"
+	}
+	return topic
+}
+
+// rejectMessage publishes a message that isn't valid to the error topic, along with the reason.
+func rejectMessage(client mqtt.Client, msg mqtt.Message, reason error) {
+	payload, err := json.Marshal(types.RejectedMessage{
+		Topic:   msg.Topic(),
+		Payload: string(msg.Payload()),
+		Error:   reason.Error(),
+		Time:    time.Now(),
+	})
+	if err != nil {
+		slog.Error("Could not encode the rejected message: " + err.Error())
+		return
+	}
+	// Waiting on a publish in a message handler would block the client
+	client.Publish(errorTopic(), 1, false, payload)
+}
+
+// acceptMessage is the way in for every message, whichever way it came. It validates the message, skips duplicates and turns it into a job
+// that is written to the journal and enqueued in the fullQueue. When the queue is bounded and full, this blocks or rejects the job
+// depending on the configured overflow policy. A job still waiting for room when ctx is done is dropped along with ctx's error.
+func acceptMessage(ctx context.Context, topic string, msg types.MQTTMessage, replyTo *types.ReplyTo) (job *types.Job, err error) {
+	defer func() {
+		// Cancelled messages aren't rejected, they come again
+		if err != nil && !errors.Is(err, context.Canceled) {
+			messagesRejected.Inc(rejectReason(err))
+		}
+	}()
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	// Keep two copies of the same message from both getting past the duplicate check, or both claiming the item
+	unlock := acceptLocks.Lock(util.ClaimID(msg))
+	if err := checkDuplicate(msg); err != nil {
+		unlock()
+		return nil, err
+	}
+	job = processEvent(msg, topic)
+	job.ReplyTo = replyTo
+	if _, _, err := jobDestination(job); err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := claimMessage(ctx, topic, msg, replyTo); err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := journal.Put(*job); err != nil {
+		unlock()
+		releaseClaim(msg)
+		return nil, fmt.Errorf("%w: %w", errNotStored, err)
+	}
+	announce := trackNewJob(job)
+	defer announce()
+	unlock()
+
+	err = fullQueue.Enqueue(ctx, job)
+	if errors.Is(err, util.ErrQueueClosed) {
+		slog.Info("Shutting down, \"" + msg.Name + "\" will be picked up on the next start")
+		return job, nil
+	}
+	if err != nil {
+		forgetJob(job)
+		return nil, err
+	}
+	// Only once it is queued, a job the queue turns down was never accepted
+	publishEvent(types.EventAccepted, job, nil)
+	announce()
+	return job, nil
+}
+
+// checkDuplicate fails with errDuplicate if the message is about an item that is already being downloaded, or that was
+// downloaded before and isn't forced to download again.
+func checkDuplicate(msg types.MQTTMessage) error {
+	if jobs := findJobsFor(msg); len(jobs) > 0 {
+		return fmt.Errorf("%w: \"%s\" is already job %s", errDuplicate, msg.Name, jobs[0].ID)
+	}
+	if msg.Force {
+		return nil
+	}
+	job, found, err := history.Completed(msg)
+	if err != nil {
+		slog.Error("Could not read the history: " + err.Error())
+		return nil
+	}
+	if found {
+		return fmt.Errorf("%w: \"%s\" was downloaded on %s, send it with force to download it again",
+			errDuplicate, msg.Name, job.UpdatedAt.Format(time.DateTime))
+	}
+	return nil
+}
+
+// recordHistory adds the finished job to the history.
+func recordHistory(job *types.Job) {
+	jobsLock.Lock()
+	snapshot := *job
+	jobsLock.Unlock()
+	jobsFinished.Inc(string(snapshot.State), strings.ToLower(snapshot.Code))
+	if err := history.Add(snapshot); err != nil {
+		slog.Error("Could not add \"" + job.Message.Name + "\" to the history: " + err.Error())
+	}
+}
+
+// eventProcessor is a goroutine that processes jobs from the fullQueue. It blocks until a job can be
+// started, that is one whose code and server still have room in the worker pool, and hands it to the pool.
+// Jobs that can't start yet stay queued, in order, so a busy code or server doesn't hold up the rest.
+// This function is responsible for the main event processing loop of the application and returns once
+// ctx is cancelled or the queue is closed. Transfers run with transferCtx, so they outlive ctx.
+func eventProcessor(ctx context.Context, transferCtx context.Context) {
+	go func() {
+		// A finished transfer may make a queued job eligible again
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-pool.Freed():
+				fullQueue.Wake()
+			}
+		}
+	}()
+	for {
+		job, err := fullQueue.DequeueFunc(ctx, func(job *types.Job) bool {
+			return !queueHeld.Load() && schedule.Allows(time.Now(), job.Message.Size) && pool.HasCapacity(job.Code, jobServer(job).Host)
+		})
+		if err != nil {
+			return
+		}
+		// This is the only goroutine starting transfers, so the capacity can't have shrunk since
+		started := pool.TryGo(transferCtx, job.Code, jobServer(job).Host, func(ctx context.Context) {
+			runJob(ctx, job)
+		})
+		if !started {
+			slog.Error("No capacity left to start \"" + job.Message.Name + "\"")
+		}
+	}
+}
+
+// watchSchedule logs whenever the download schedule pauses or resumes the queue, and wakes the queue up
+// so that jobs held back by the schedule are reconsidered once a window opens. It also switches to the
+// bandwidth limit of each window, and stops the transfers that may not run outside of the windows.
+func watchSchedule(ctx context.Context) {
+	if len(schedule.Windows) == 0 {
+		return
+	}
+	open := schedule.IsOpen(time.Now())
+	logScheduleState(open)
+	for {
+		next := schedule.NextChange(time.Now())
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if now := schedule.IsOpen(time.Now()); now != open {
+			open = now
+			logScheduleState(open)
+		}
+		holdBackTransfers()
+		applyRate()
+		fullQueue.Wake()
+	}
 }
 
-// eventProcessor is a goroutine that runs on a timer and processes events from the fullQueue.
-// It dequeues an event from the fullQueue and calls processEvent to handle the event.
-// This function is responsible for the main event processing loop of the application.
-func eventProcessor() {
-	for range ticker.C {
-		if !fullQueue.IsEmpty() {
-			item := fullQueue.Dequeue()
-			processEvent(item)
+// holdBackTransfers stops the transfers the download schedule no longer allows, once their window closed, and
+// queues them again. They continue where they stopped when the next window opens.
+func holdBackTransfers() {
+	now := time.Now()
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	for _, tracked := range trackedJobs {
+		job := tracked.job
+		if job.State != types.JobTransferring || tracked.cancel == nil || tracked.action != nil || !schedule.Stops(now, job.Message.Size) {
+			continue
 		}
+		// runJob applies the action once the transfer stopped
+		tracked.action = &jobAction{command: actionHold}
+		tracked.cancel()
+	}
+}
+
+func logScheduleState(open bool) {
+	next := schedule.NextChange(time.Now()).Format("Mon 15:04")
+	if open {
+		slog.Info("Inside a download window, transfers are running until " + next)
+		return
+	}
+	if schedule.OutsideMaxSize > 0 {
+		slog.Info(fmt.Sprintf("Paused by the download schedule until %s, only jobs under %d bytes will start", next, schedule.OutsideMaxSize))
+		return
+	}
+	slog.Info("Paused by the download schedule until " + next)
+}
+
+// onConnect keeps track of the connection to the MQTT server. After a reconnect the subscriber is online again,
+// the broker may have sent its Last Will in between.
+func onConnect(client mqtt.Client) {
+	if mqttConnected.Swap(true) {
+		mqttReconnects.Inc()
+		publishPresence()
 	}
+	mqttConnectedGauge.Set(1)
+	slog.Info("[MQTT] Connected")
+}
 
+// onConnectionLost keeps track of the connection to the MQTT server.
+func onConnectionLost(client mqtt.Client, err error) {
+	mqttConnectedGauge.Set(0)
+	slog.Error("[MQTT] Connect lost: " + err.Error())
 }
 
-// processEvent is a function that processes an event from the fullQueue. It generates a code from the rules in the config, and initiates a transfer of the paylaod to the configured destination.
-// The function first logs a message indicating the name of the event being processed. It then calls util.GenerateCodeFromRules to generate a code from the rules defined in your config. If there is an error generating the code, it logs an error message.
-// The function then adds a new goroutine to the waitgroup (wg) and calls initiateTransfer to initiate the transfer of the payload to the configured destination. The function then waits for the transfer to complete before returning.
-func processEvent(item types.MQTTMessage) {
+// processEvent is a function that turns an incoming event into a job before it is queued. It generates a code from the rules in the config,
+// so the transfer can be scheduled against the per-code limits. If there is an error generating the code, it logs an error message.
+func processEvent(item types.MQTTMessage, topic string) *types.Job {
 	msg := fmt.Sprintf("Processing Name - \"%s\"", item.Name)
 	slog.Info(msg)
-	code, err := util.GenerateCodeFromRules(item)
+	code, err := messageCode(item, topic)
 	if err != nil {
 		slog.Error("Code processing error: " + err.Error())
 	}
-	wg.Add(1)
-	go initiateTransfer(item.Name, code, item.Location)
-	wg.Wait()
+	now := time.Now()
+	return &types.Job{
+		ID:        uuid.NewString(),
+		Message:   item,
+		Code:      code,
+		Topic:     topic,
+		State:     types.JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
 }
 
-func initiateTransfer(name string, code string, location string) {
-	defer wg.Done()
+// runJob takes the job through the transfer pipeline and records the outcome in the journal. A job cut short
+// because ctx was cancelled is put back in the journal as queued, so it is resumed on the next start. A job
+// paused or cancelled while it runs is stopped and moved to that state instead.
+func runJob(ctx context.Context, job *types.Job) {
+	// Started only once it is announced, so the accepted event reports it queued
+	waitAnnounced(job)
+	if !holdClaim(ctx, job) {
+		return
+	}
+	jobCtx, cancelJob := context.WithCancel(ctx)
+	defer cancelJob()
+	if action := startJob(job, cancelJob); action != nil {
+		applyJobAction(job, action)
+		return
+	}
+	updateJobState(job, types.JobTransferring, func(job *types.Job) {
+		job.Attempts++
+		job.NextAttemptAt = time.Time{}
+	})
+	publishEvent(types.EventStarted, job, nil)
+	err := processJob(jobCtx, job)
+	// A job that made it to the end despite being stopped is done all the same
+	if action := finishJob(job); action != nil && err != nil {
+		// Being stopped doesn't count as an attempt
+		updateJob(job, func(job *types.Job) { job.Attempts-- })
+		applyJobAction(job, action)
+		return
+	}
+	if ctx.Err() != nil {
+		// Being interrupted doesn't count as an attempt
+		updateJobState(job, types.JobQueued, func(job *types.Job) { job.Attempts-- })
+		slog.Info("Interrupted \"" + job.Message.Name + "\", it will resume on the next start")
+		return
+	}
+	if err != nil {
+		failJob(ctx, job, err)
+		return
+	}
+	setJobState(job, types.JobDone)
+	lastSuccess.Set(float64(time.Now().Unix()))
+	slog.Info("Finished \"" + job.Message.Name + "\"")
+	publishEvent(types.EventCompleted, job, nil)
+	recordHistory(job)
+	forgetJob(job)
+}
 
-	codeDestinations := viper.GetStringMapString("client.codeDestinations")
-	toPath, found := codeDestinations[strings.ToLower(code)]
+// processJob transfers the job, verifies the download and runs the post-processing command, moving the job
+// through the matching states.
+func processJob(ctx context.Context, job *types.Job) error {
+	toPath, found, err := jobDestination(job)
+	if err != nil {
+		return &util.TransferError{Class: util.ErrorConfig, Message: err.Error()}
+	}
 	if !found {
-		log.Fatal("No code destination found")
+		return &util.TransferError{Class: util.ErrorConfig, Message: "no code destination found for code: " + job.Code}
+	}
+	localPath, err := downloadPath(toPath, job.Message.Location)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	done := startTransfer(job, "lftp", localPath)
+	err = initiateTransfer(ctx, job.Message.Name, jobServer(job), toPath, job.Message.Location)
+	done()
+	if err != nil {
+		return err
+	}
+	observeTransfer(job, "lftp", localPath, started)
+	setJobState(job, types.JobVerifying)
+	if err := verifyDownload(localPath); err != nil {
+		return err
+	}
+	setJobState(job, types.JobPostProcessing)
+	return postProcess(ctx, job, localPath)
+}
+
+// failJob schedules another attempt for the job if the failure is worth retrying and attempts are left,
+// otherwise the job is failed and moved to the dead-letter list.
+func failJob(ctx context.Context, job *types.Job, err error) {
+	class := util.ErrorUnknown
+	var transferErr *util.TransferError
+	if errors.As(err, &transferErr) {
+		class = transferErr.Class
+	}
+	recordError := func(job *types.Job) {
+		job.LastError = err.Error()
+		job.ErrorClass = string(class)
+	}
+
+	maxAttempts := viper.GetInt("client.retry.maxAttempts")
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	if class.Retryable() && job.Attempts < maxAttempts {
+		delay := retryBackoff().Delay(job.Attempts)
+		updateJobState(job, types.JobQueued, func(job *types.Job) {
+			recordError(job)
+			job.NextAttemptAt = time.Now().Add(delay)
+		})
+		jobRetries.Inc(string(class))
+		slog.Warn(fmt.Sprintf("Transfer of \"%s\" failed (attempt %d of %d), retrying in %s: %s",
+			job.Message.Name, job.Attempts, maxAttempts, delay.Round(time.Second), job.LastError))
+		publishEvent(types.EventRetrying, job, withError(job))
+		go retryLater(ctx, job, delay)
+		return
+	}
+
+	updateJobState(job, types.JobFailed, recordError)
+	slog.Error(fmt.Sprintf("Transfer of \"%s\" failed after %d attempt(s), moving it to the dead-letter list: %s",
+		job.Message.Name, job.Attempts, job.LastError))
+	publishEvent(types.EventFailed, job, withError(job))
+	recordHistory(job)
+	if err := deadLetters.Add(*job); err != nil {
+		slog.Error("Could not add \"" + job.Message.Name + "\" to the dead-letter list: " + err.Error())
+		return
+	}
+	forgetJob(job)
+}
+
+// withError adds the last error of job to its status event.
+func withError(job *types.Job) func(e *types.StatusEvent) {
+	return func(e *types.StatusEvent) {
+		e.Error = job.LastError
+		e.ErrorClass = job.ErrorClass
+	}
+}
+
+// retryBackoff reads the retry delays from the config.
+func retryBackoff() util.Backoff {
+	backoff := util.Backoff{
+		Base: viper.GetDuration("client.retry.baseDelay"),
+		Max:  viper.GetDuration("client.retry.maxDelay"),
+	}
+	if backoff.Base <= 0 {
+		backoff.Base = 30 * time.Second
+	}
+	if backoff.Max <= 0 {
+		backoff.Max = 30 * time.Minute
 	}
-	username := viper.GetString("client.serverInfo.username")
-	password := viper.GetString("client.serverInfo.password")
-	host := viper.GetString("client.serverInfo.host")
+	return backoff
+}
+
+// retryLater puts the job back in the queue once delay has passed. If ctx is cancelled first, the job stays
+// in the journal and its remaining backoff is honoured on the next start. Pausing or cancelling the job ends
+// the wait right away.
+func retryLater(ctx context.Context, job *types.Job, delay time.Duration) {
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	defer cancelWait()
+	if action := startJob(job, cancelWait); action != nil {
+		applyJobAction(job, action)
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-waitCtx.Done():
+	case <-timer.C:
+	}
+	if action := finishJob(job); action != nil {
+		applyJobAction(job, action)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	err := fullQueue.Enqueue(ctx, job)
+	if errors.Is(err, util.ErrQueueClosed) {
+		// Shutting down, the job is retried on the next start
+		return
+	}
+	if err != nil {
+		slog.Error("Could not requeue \"" + job.Message.Name + "\": " + err.Error())
+	}
+}
+
+// verifyDownload checks that the transfer left the file or directory at localPath.
+func verifyDownload(localPath string) error {
+	if _, err := os.Stat(localPath); err != nil {
+		return &util.TransferError{Class: util.ErrorVerify, Message: "download missing after transfer: " + err.Error()}
+	}
+	return nil
+}
+
+// postProcess runs the optional post-processing command from the config, with the details of the job in its environment.
+func postProcess(ctx context.Context, job *types.Job, localPath string) error {
+	command := viper.GetString("client.postProcess")
+	if command == "" {
+		return nil
+	}
+	env := []string{
+		"SEEDSTORE_ID=" + job.ID,
+		"SEEDSTORE_NAME=" + job.Message.Name,
+		"SEEDSTORE_HASH=" + job.Message.Hash,
+		"SEEDSTORE_CATEGORY=" + job.Message.Category,
+		"SEEDSTORE_CODE=" + job.Code,
+		"SEEDSTORE_TOPIC=" + job.Topic,
+		"SEEDSTORE_PATH=" + localPath,
+	}
+	statusCode, errOutput, err := util.RunCommandWithEnv(ctx, command, "", env)
+	if err != nil {
+		return err
+	}
+	if statusCode != 0 {
+		transferErr := util.NewTransferError(statusCode, errOutput)
+		transferErr.Class = util.ErrorPostProcess
+		return transferErr
+	}
+	return nil
+}
+
+// setJobState moves the job to the given state and persists it.
+func setJobState(job *types.Job, state types.JobState) {
+	updateJobState(job, state, nil)
+}
+
+// updateJobState is setJobState that also applies update to the job along with the new state, under the jobs lock
+// as the status API and the events read the job at any time.
+func updateJobState(job *types.Job, state types.JobState, update func(job *types.Job)) {
+	jobsLock.Lock()
+	err := job.Transition(state)
+	if err == nil && update != nil {
+		update(job)
+	}
+	snapshot := *job
+	jobsLock.Unlock()
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	if err := journal.Put(snapshot); err != nil {
+		slog.Error("Could not persist \"" + job.Message.Name + "\": " + err.Error())
+	}
+}
+
+// updateJob changes the job under the jobs lock, without persisting it.
+func updateJob(job *types.Job, update func(job *types.Job)) {
+	jobsLock.Lock()
+	update(job)
+	jobsLock.Unlock()
+}
+
+// forgetJob drops the job from the journal once there is nothing left to do for it.
+func forgetJob(job *types.Job) {
+	untrackJob(job)
+	releaseClaim(job.Message)
+	if err := journal.Remove(job.ID); err != nil {
+		slog.Error("Could not remove \"" + job.Message.Name + "\" from the journal: " + err.Error())
+	}
+}
+
+// initiateTransfer downloads location with lftp into toPath, first as a directory and then as a single file.
+// Both continue partial downloads left by a paused or interrupted transfer.
+// Every lftp process is limited to its share of the global bandwidth, and launched again with the new share when
+// it changes. Failures are returned as a *util.TransferError classifying what went wrong.
+func initiateTransfer(ctx context.Context, name string, server types.ServerInfo, toPath string, location string) error {
+	done := bandwidth.Start()
+	defer done()
+	username := server.Username
+	password := server.Password
+	host := server.Host
 	lftpThreads := viper.GetInt("client.lftp.threads")
 	lftpSegments := viper.GetInt("client.lftp.segments")
-	lftpArgsAsDir := fmt.Sprintf("-u \"%s,%s\" sftp://%s/  -e \"set sftp:auto-confirm yes; lcd %s; mirror -c --parallel=%d --use-pget-n=%d '%s' ;quit\"",
-		username, password, host, toPath, lftpThreads, lftpSegments, location)
-	lftpArgsAsFile := fmt.Sprintf("-u \"%s,%s\" sftp://%s/  -e \"set sftp:auto-confirm yes; lcd %s; pget -n %d '%s' ;quit\"",
-		username, password, host, toPath, lftpThreads, location)
+	settings := func(share int64) string {
+		if share > 0 {
+			return fmt.Sprintf("set sftp:auto-confirm yes; set net:limit-rate %d;", share)
+		}
+		return "set sftp:auto-confirm yes;"
+	}
+	// Every value is quoted, for lftp and then for bash, as the paths come from the messages
+	lftpArgs := func(script string) string {
+		return fmt.Sprintf("-u %s %s -e %s", util.ShellQuote(username+","+password), util.ShellQuote("sftp://"+host+"/"), util.ShellQuote(script))
+	}
+	lftpArgsAsDir := func(share int64) string {
+		return lftpArgs(fmt.Sprintf("%s lcd %s; mirror -c --parallel=%d --use-pget-n=%d %s ;quit",
+			settings(share), util.LftpQuote(toPath), lftpThreads, lftpSegments, util.LftpQuote(location)))
+	}
 	binPath, err := util.CheckIfCommandExists("lftp")
 	if err != nil {
 		slog.Error("Command lftp does not exist")
-		return
+		return &util.TransferError{Class: util.ErrorConfig, Message: err.Error()}
+	}
+	statusCode, errOutput, err := runLimited(ctx, name, binPath, lftpArgsAsDir)
+	if err != nil {
+		slog.Error("The directory failed to clone and there was an error: " + err.Error())
+		return err
+	}
+	if statusCode == 0 {
+		slog.Info("Successfully cloned the directory: " + name)
+		return nil
+	}
+	// Only a missing directory is worth another try as a file
+	if transferErr := util.NewTransferError(statusCode, errOutput); transferErr.Class == util.ErrorAuth || transferErr.Class == util.ErrorNetwork {
+		return transferErr
+	}
+	slog.Info("Retrying the command to clone as a file...")
+	lftpArgsAsFile := func(share int64) string {
+		return lftpArgs(fmt.Sprintf("%s lcd %s; pget -c -n %d %s ;quit",
+			settings(share), util.LftpQuote(toPath), lftpThreads, util.LftpQuote(location)))
+	}
+	statusCode, errOutput, err = runLimited(ctx, name, binPath, lftpArgsAsFile)
+	if err != nil {
+		return err
 	}
-	statusCode, err := util.RunCommand(binPath, lftpArgsAsDir)
 	if statusCode != 0 {
-		if err != nil {
-			slog.Error("The directory failed to clone and there was an error: " + err.Error())
-		} else {
-			slog.Info("Retrying the command to clone as a file...")
-			statusCode, err = util.RunCommand(binPath, lftpArgsAsFile)
-			if statusCode != 0 {
-				slog.Error("Error trying to clone the file: " + name)
-				if err != nil {
-					slog.Error(err.Error())
+		slog.Error("Error trying to clone the file: " + name)
+		return util.NewTransferError(statusCode, errOutput)
+	}
+	slog.Info("Successfully cloned the file: " + name)
+	return nil
+}
+
+// relimitInterval is how long a transfer runs with its share before it is stopped for a new one, so a row of
+// transfers starting or finishing doesn't restart it every time
+const relimitInterval = time.Minute
+
+// runLimited runs the command with the arguments for the current bandwidth share, and stops and runs it again
+// once the share moved enough for util.Relimit and the run lasted relimitInterval. lftp continues the download
+// from where the previous run stopped.
+func runLimited(ctx context.Context, name string, binPath string, args func(share int64) string) (int, string, error) {
+	for {
+		// Taken before the share, so a change in between isn't missed
+		changed := bandwidth.Changed()
+		share := bandwidth.Share()
+		started := time.Now()
+		runCtx, stop := context.WithCancel(ctx)
+		var relimit atomic.Bool
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			var settled <-chan time.Time
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				case <-changed:
+					changed = bandwidth.Changed()
+				case <-settled:
+					settled = nil
+				}
+				if !util.Relimit(share, bandwidth.Share()) {
+					continue
 				}
-			} else {
-				slog.Info("Successfully cloned the file: " + name)
+				if wait := relimitInterval - time.Since(started); wait > 0 {
+					// Checked again once the run lasted long enough, the share may have moved back by then
+					if settled == nil {
+						settled = time.After(wait)
+					}
+					continue
+				}
+				relimit.Store(true)
+				stop()
+				return
 			}
+		}()
+		statusCode, errOutput, err := util.RunCommand(runCtx, binPath, args(share))
+		stop()
+		<-watched
+		// Only stopped for the new share, not by ctx or by finishing first
+		if !relimit.Load() || !errors.Is(err, context.Canceled) || ctx.Err() != nil {
+			return statusCode, errOutput, err
 		}
-	} else {
-		slog.Info("Successfully cloned the directory: " + name)
+		slog.Info("Bandwidth share changed, restarting the transfer of \"" + name + "\"")
 	}
-
 }
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"seedstore/types"
+	"seedstore/util"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// subscriptions are the topics from the config, each with its own rules, server and destinations
+var subscriptions []types.Subscription
+
+// topicSubscription is the subscription a message that came in on topic follows. Messages that didn't come in
+// over MQTT, or through a topic that isn't in the subscriptions, follow the rest of the config.
+func topicSubscription(topic string) (types.Subscription, bool) {
+	if topic == "" {
+		return types.Subscription{}, false
+	}
+	return util.SubscriptionFor(subscriptions, topic)
+}
+
+// messageCode picks the code of a message that came in on topic, with the rules of its subscription if it has
+// its own.
+func messageCode(msg types.MQTTMessage, topic string) (string, error) {
+	var rules types.ServerRules
+	if err := viper.UnmarshalKey("server", &rules); err != nil {
+		return "", err
+	}
+	if subscription, found := topicSubscription(topic); found {
+		if len(subscription.CodeConditions) > 0 {
+			rules.CodeConditions = subscription.CodeConditions
+		}
+		if subscription.DefaultCode != "" {
+			rules.DefaultCode = subscription.DefaultCode
+		}
+	}
+	return util.CodeFromRules(rules, msg, util.TopicVars(topic)), nil
+}
+
+// jobServer is the server the job downloads from.
+func jobServer(job *types.Job) types.ServerInfo {
+	if subscription, found := topicSubscription(job.Topic); found && subscription.ServerInfo.Host != "" {
+		return subscription.ServerInfo
+	}
+	return types.ServerInfo{
+		Host:     viper.GetString("client.serverInfo.host"),
+		Username: viper.GetString("client.serverInfo.username"),
+		Password: viper.GetString("client.serverInfo.password"),
+	}
+}
+
+// jobDestination is where the job downloads to: the destination of its code, from its subscription or else the
+// client config, with the topic variables filled in. It fails when a topic level used in the path isn't safe there.
+func jobDestination(job *types.Job) (string, bool, error) {
+	code := strings.ToLower(job.Code)
+	toPath, found := "", false
+	if subscription, subscribed := topicSubscription(job.Topic); subscribed {
+		toPath, found = subscription.CodeDestinations[code]
+	}
+	if !found {
+		toPath, found = viper.GetStringMapString("client.codeDestinations")[code]
+	}
+	if !found {
+		return "", false, nil
+	}
+	toPath, err := util.ExpandPath(toPath, util.TopicVars(job.Topic))
+	return toPath, err == nil, err
+}
@@ -2,6 +2,10 @@ package main
 
 import "seedstore/cmd"
 
+// version is set by goreleaser at build time
+var version = "dev"
+
 func main() {
+	cmd.Version = version
 	cmd.Execute()
 }
@@ -0,0 +1,31 @@
+package types
+
+import "time"
+
+// Claim says which subscriber takes an item, for as long as its lease runs. Subscribers that share a queue over
+// a broker without shared subscriptions agree on one of them through the claims.
+type Claim struct {
+	// ID identifies the item, see util.ClaimID
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	// Claimed is when the owner first claimed the item, the earliest claim wins a race
+	Claimed time.Time `json:"claimed"`
+	// Expires is when the lease runs out unless the owner renews it
+	Expires time.Time `json:"expires"`
+	// Done marks an item the owner is done with, until Expires, so a subscriber that gets the item late skips it
+	Done bool `json:"done,omitempty"`
+}
+
+// Live tells whether the lease still runs at now.
+func (c Claim) Live(now time.Time) bool {
+	return now.Before(c.Expires)
+}
+
+// Beats tells whether c wins over other when both claim the same item: the earliest claim wins, and the owner
+// that sorts first breaks a tie. Every subscriber comes to the same winner whatever order the claims arrive in.
+func (c Claim) Beats(other Claim) bool {
+	if !c.Claimed.Equal(other.Claimed) {
+		return c.Claimed.Before(other.Claimed)
+	}
+	return c.Owner < other.Owner
+}
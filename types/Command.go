@@ -0,0 +1,28 @@
+package types
+
+const (
+	// CommandSetRate changes the global bandwidth limit, an empty value goes back to the configured one
+	CommandSetRate = "set-rate"
+	// CommandCancel stops the target job for good
+	CommandCancel = "cancel"
+	// CommandPause stops the target job, keeping its partial data for CommandResume
+	CommandPause = "pause"
+	// CommandResume queues a paused job again
+	CommandResume = "resume"
+	// CommandPauseAll pauses every job and holds back new ones until CommandResumeAll
+	CommandPauseAll = "pause-all"
+	// CommandResumeAll resumes every paused job
+	CommandResumeAll = "resume-all"
+)
+
+// Command is a message sent to a running subscriber on the command topic
+type Command struct {
+	Command string `json:"command"`
+	Value   string `json:"value,omitempty"`
+	// Target is the ID or torrent hash of the job a job command applies to
+	Target string `json:"target,omitempty"`
+	// DeletePartial makes CommandCancel delete what was downloaded so far
+	DeletePartial bool `json:"deletePartial,omitempty"`
+	// Signature is set when the subscriber only takes signed commands
+	Signature *Signature `json:"signature,omitempty"`
+}
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type LFTP struct {
 	Threads  int `mapstructure:"threads"`
 	Segments int `mapstructure:"segments"`
@@ -10,10 +12,67 @@ type ServerInfo struct {
 	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
 }
+type QueueRules struct {
+	Capacity int    `mapstructure:"capacity"`
+	Overflow string `mapstructure:"overflow"`
+}
+
+type RetryRules struct {
+	MaxAttempts int           `mapstructure:"maxAttempts"`
+	BaseDelay   time.Duration `mapstructure:"baseDelay"`
+	MaxDelay    time.Duration `mapstructure:"maxDelay"`
+}
+
+type SchedulingRules struct {
+	Policy         string         `mapstructure:"policy"`
+	CodePriorities map[string]int `mapstructure:"codePriorities"`
+	Fair           bool           `mapstructure:"fair"`
+}
+
+type ScheduleWindow struct {
+	Days      []string `mapstructure:"days"`
+	Start     string   `mapstructure:"start"`
+	End       string   `mapstructure:"end"`
+	RateLimit string   `mapstructure:"rateLimit"`
+}
+
+type ScheduleRules struct {
+	Windows        []ScheduleWindow `mapstructure:"windows"`
+	OutsideMaxSize int64            `mapstructure:"outsideMaxSize"`
+}
+
+type BandwidthRules struct {
+	Limit string `mapstructure:"limit"`
+}
+
+type ControlRules struct {
+	Socket      string `mapstructure:"socket"`
+	AllowedUIDs []int  `mapstructure:"allowedUids"`
+}
+
+type HTTPRules struct {
+	Listen   string `mapstructure:"listen"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Token    string `mapstructure:"token"`
+}
+
 type ClientRules struct {
-	CodeDestinations map[string]string `mapstructure:"codeDestinations"`
-	LFTP             LFTP              `mapstructure:"lftp"`
-	ServerInfo       ServerInfo        `mapstructure:"serverInfo"`
+	CodeDestinations       map[string]string `mapstructure:"codeDestinations"`
+	LFTP                   LFTP              `mapstructure:"lftp"`
+	ServerInfo             ServerInfo        `mapstructure:"serverInfo"`
+	MaxConcurrentTransfers int               `mapstructure:"maxConcurrentTransfers"`
+	CodeLimits             map[string]int    `mapstructure:"codeLimits"`
+	ServerLimits           map[string]int    `mapstructure:"serverLimits"`
+	Queue                  QueueRules        `mapstructure:"queue"`
+	Scheduling             SchedulingRules   `mapstructure:"scheduling"`
+	Retry                  RetryRules        `mapstructure:"retry"`
+	Schedule               ScheduleRules     `mapstructure:"schedule"`
+	Bandwidth              BandwidthRules    `mapstructure:"bandwidth"`
+	ShutdownGracePeriod    time.Duration     `mapstructure:"shutdownGracePeriod"`
+	PostProcess            string            `mapstructure:"postProcess"`
+	Control                ControlRules      `mapstructure:"control"`
+	HTTP                   HTTPRules         `mapstructure:"http"`
 }
 
 type Rule struct {
@@ -34,16 +93,132 @@ type TorrentRules struct {
 	Label  string `mapstructure:"labelling"`
 }
 
+type StatusRules struct {
+	Enabled *bool `mapstructure:"enabled"`
+	// Topic is where job events go, {hash}, {id} and {code} are replaced
+	Topic string `mapstructure:"topic"`
+	// StateTopic is where the retained summary goes, {clientId} is replaced
+	StateTopic   string `mapstructure:"stateTopic"`
+	ProgressStep int    `mapstructure:"progressStep"`
+}
+
+type PresenceRules struct {
+	// Topic is where the retained presence goes, {clientId} is replaced and must be a whole level
+	Topic             string        `mapstructure:"topic"`
+	HeartbeatInterval time.Duration `mapstructure:"heartbeatInterval"`
+}
+
+type ClaimRules struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Topic   string `mapstructure:"topic"`
+	// Lease is how long a claim holds without being renewed
+	Lease time.Duration `mapstructure:"lease"`
+	// Settle is how long a claim waits for competing ones
+	Settle time.Duration `mapstructure:"settle"`
+}
+
 type MQTTRules struct {
 	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
 	Port     int    `mapstructure:"port"`
 	ClientId string `mapstructure:"clientId"`
 	Host     string `mapstructure:"host"`
+	// ProtocolVersion is 3 for MQTT 3.1.1, the default, or 5
+	ProtocolVersion int `mapstructure:"protocolVersion"`
+	// Scheme is tcp, ssl, ws or wss
+	Scheme string `mapstructure:"scheme"`
+	// Path is the websocket path, e.g. /mqtt
+	Path string   `mapstructure:"path"`
+	TLS  TLSRules `mapstructure:"tls"`
+	// CommandTopic is where a running subscriber takes commands, e.g. to change the bandwidth limit
+	CommandTopic string        `mapstructure:"commandTopic"`
+	Status       StatusRules   `mapstructure:"status"`
+	Presence     PresenceRules `mapstructure:"presence"`
+	// ShareGroup makes the queue subscription a shared one, $share/<group>/<topic>
+	ShareGroup    string             `mapstructure:"shareGroup"`
+	Claims        ClaimRules         `mapstructure:"claims"`
+	HomeAssistant HomeAssistantRules `mapstructure:"homeAssistant"`
+	Signing       SigningRules       `mapstructure:"signing"`
+}
+
+type SigningKey struct {
+	ID     string `mapstructure:"id"`
+	Secret string `mapstructure:"secret"`
+}
+
+// SigningRules turn on signed queue messages. Publishers sign with one key, subscribers accept any of them, so keys
+// can be rotated.
+type SigningRules struct {
+	Keys []SigningKey `mapstructure:"keys"`
+	// KeyID is the key publishers sign with, the first one when empty
+	KeyID string `mapstructure:"keyId"`
+	// MaxSkew is how far ahead of the clock of the subscriber the time of a message may be
+	MaxSkew time.Duration `mapstructure:"maxSkew"`
+	// MaxAge is how old a message may be when it arrives, and how long its nonce is remembered to catch replays
+	MaxAge time.Duration `mapstructure:"maxAge"`
+	// UnsignedPauseAll lets pause-all and resume-all through unsigned, for the Home Assistant buttons that can't sign
+	UnsignedPauseAll bool `mapstructure:"unsignedPauseAll"`
+}
+
+type TLSRules struct {
+	// CA is a PEM bundle of the certificates the broker is trusted by, the system roots when empty
+	CA string `mapstructure:"ca"`
+	// Cert and Key are the PEM client certificate and key, for brokers that want one
+	Cert               string `mapstructure:"cert"`
+	Key                string `mapstructure:"key"`
+	ServerName         string `mapstructure:"serverName"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+}
+
+type HomeAssistantRules struct {
+	Enabled bool `mapstructure:"enabled"`
+	// DiscoveryPrefix is where Home Assistant looks for discovery configs, homeassistant unless changed there
+	DiscoveryPrefix string `mapstructure:"discoveryPrefix"`
+	// NodeID tells subscribers apart in Home Assistant, it must stay the same across restarts
+	NodeID string `mapstructure:"nodeId"`
+	// Name is the name of the device in Home Assistant
+	Name string `mapstructure:"name"`
+}
+
+// Subscription is a topic the subscriber takes jobs from, with its own rules, server and destinations. The ones
+// left out are taken from server and client.
+type Subscription struct {
+	// Topic may have wildcards, the levels of the topic a message came in on are the variables topic[0], topic[1]...
+	Topic          string     `mapstructure:"topic"`
+	DefaultCode    string     `mapstructure:"defaultCode"`
+	CodeConditions []Rule     `mapstructure:"codeConditions"`
+	ServerInfo     ServerInfo `mapstructure:"serverInfo"`
+	// CodeDestinations may use the topic variables, e.g. /downloads/{topic[1]}
+	CodeDestinations map[string]string `mapstructure:"codeDestinations"`
+}
+
+type BrokerUser struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+type BrokerTLSRules struct {
+	// Cert and Key are the PEM certificate and key the broker presents, TLS is off without them
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+	// ClientCA is a PEM bundle, when set clients must present a certificate it signed
+	ClientCA string `mapstructure:"clientCa"`
+}
+
+// BrokerRules configure the broker seedstore can run itself, for setups without one.
+type BrokerRules struct {
+	Listen string `mapstructure:"listen"`
+	// Users may connect with their password, anyone may connect when there are none
+	Users []BrokerUser   `mapstructure:"users"`
+	TLS   BrokerTLSRules `mapstructure:"tls"`
+	// PersistRetained keeps the retained messages, such as the subscriber presence and claims, across restarts
+	PersistRetained bool `mapstructure:"persistRetained"`
 }
 
 type Config struct {
-	MQTT   MQTTRules   `mapstructure:"mqtt"`
-	Server ServerRules `mapstructure:"server"`
-	Client ClientRules `mapstructure:"client"`
+	MQTT          MQTTRules      `mapstructure:"mqtt"`
+	Server        ServerRules    `mapstructure:"server"`
+	Client        ClientRules    `mapstructure:"client"`
+	Subscriptions []Subscription `mapstructure:"subscriptions"`
+	Broker        BrokerRules    `mapstructure:"broker"`
 }
@@ -0,0 +1,36 @@
+package types
+
+// ControlProtocolVersion is the version of the control socket protocol, bumped on incompatible changes
+const ControlProtocolVersion = 1
+
+const (
+	// ControlList returns every unfinished job, the queued ones in the order they will start
+	ControlList = "list"
+	// ControlShow returns the jobs with the target ID or hash
+	ControlShow = "show"
+	// ControlRemove cancels the target job
+	ControlRemove = "remove"
+	// ControlMoveToTop makes the target job the next one to start
+	ControlMoveToTop = "move-to-top"
+	// ControlRetry retries the target job right away, whether it is waiting for a retry or dead-lettered
+	ControlRetry = "retry"
+	// ControlPauseAll pauses every job and holds back new ones until ControlResumeAll
+	ControlPauseAll = "pause-all"
+	// ControlResumeAll resumes every paused job
+	ControlResumeAll = "resume-all"
+)
+
+// ControlRequest is a request sent to a running subscriber over its control socket, one JSON object per line
+type ControlRequest struct {
+	Version int    `json:"version"`
+	Command string `json:"command"`
+	// Target is the ID or torrent hash of the job the command applies to
+	Target string `json:"target,omitempty"`
+}
+
+// ControlResponse answers a ControlRequest
+type ControlResponse struct {
+	Version int    `json:"version"`
+	Error   string `json:"error,omitempty"`
+	Jobs    []Job  `json:"jobs,omitempty"`
+}
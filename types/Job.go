@@ -0,0 +1,73 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobQueued         JobState = "queued"
+	JobTransferring   JobState = "transferring"
+	JobVerifying      JobState = "verifying"
+	JobPostProcessing JobState = "post-processing"
+	JobDone           JobState = "done"
+	JobFailed         JobState = "failed"
+	JobPaused         JobState = "paused"
+	JobCancelled      JobState = "cancelled"
+)
+
+// jobTransitions lists the states a job may move to from each state. Any
+// active state may fall back to queued when the job is retried or interrupted,
+// and any unfinished job may be paused or cancelled.
+var jobTransitions = map[JobState][]JobState{
+	JobQueued:         {JobTransferring, JobFailed, JobPaused, JobCancelled},
+	JobTransferring:   {JobVerifying, JobQueued, JobFailed, JobPaused, JobCancelled},
+	JobVerifying:      {JobPostProcessing, JobQueued, JobFailed, JobPaused, JobCancelled},
+	JobPostProcessing: {JobDone, JobQueued, JobFailed, JobPaused, JobCancelled},
+	JobFailed:         {JobQueued},
+	JobPaused:         {JobQueued, JobCancelled},
+}
+
+// Job is a received message going through the transfer pipeline
+type Job struct {
+	ID        string      `json:"id"`
+	Message   MQTTMessage `json:"message"`
+	Code      string      `json:"code"`
+	State     JobState    `json:"state"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"lastError,omitempty"`
+	// ErrorClass is the kind of the last failure, e.g. auth or network
+	ErrorClass    string    `json:"errorClass,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	// ReplyTo is where the publisher wants to hear about the job, over MQTT 5
+	ReplyTo *ReplyTo `json:"replyTo,omitempty"`
+	// Topic is the MQTT topic the message came in on, it picks the subscription the job follows
+	Topic string `json:"topic,omitempty"`
+}
+
+// ReplyTo is the response topic and correlation data of an MQTT 5 message
+type ReplyTo struct {
+	Topic           string `json:"topic"`
+	CorrelationData []byte `json:"correlationData,omitempty"`
+}
+
+// IsFinished reports whether the job reached a terminal state
+func (j *Job) IsFinished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// Transition moves the job to the given state if the state machine allows it
+func (j *Job) Transition(to JobState) error {
+	for _, allowed := range jobTransitions[j.State] {
+		if allowed == to {
+			j.State = to
+			j.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return fmt.Errorf("job %s can't move from %s to %s", j.ID, j.State, to)
+}
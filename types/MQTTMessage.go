@@ -1,8 +1,61 @@
 package types
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+// SchemaVersion is the version of MQTTMessage, sent as the schemaVersion user property over MQTT 5
+const SchemaVersion = "1"
+
+// RejectedMessage is published to the error topic for a message that couldn't become a job
+type RejectedMessage struct {
+	Topic string `json:"topic"`
+	// Payload is the message as it was received
+	Payload string    `json:"payload"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
+}
+
 type MQTTMessage struct {
 	Name     string `json:"name"`
 	Hash     string `json:"hash"`
 	Location string `json:"location"`
 	Category string `json:"category"`
+	// Priority orders the queue when the subscriber schedules by priority, higher runs first
+	Priority int `json:"priority,omitempty"`
+	// Size is the size of the payload in bytes, if the publisher knows it
+	Size int64 `json:"size,omitempty"`
+	// Force downloads the item even if the subscriber already downloaded it
+	Force bool `json:"force,omitempty"`
+	// Signature is only sent when the publisher has signing keys, and dropped once the subscriber checked it
+	Signature *Signature `json:"signature,omitempty"`
+}
+
+// Signature is an HMAC-SHA256 of the message, the topic it is published on, its time and a nonce, with the key
+// named by KeyID
+type Signature struct {
+	KeyID string `json:"keyId"`
+	// Timestamp is when the message was signed, in seconds since the epoch
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	// HMAC is hex encoded
+	HMAC string `json:"hmac"`
+}
+
+// Validate checks that the message describes something that can be downloaded
+func (m MQTTMessage) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidMessage)
+	}
+	if m.Location == "" {
+		return fmt.Errorf("%w: location is required", ErrInvalidMessage)
+	}
+	if m.Size < 0 {
+		return fmt.Errorf("%w: size can't be negative", ErrInvalidMessage)
+	}
+	return nil
 }
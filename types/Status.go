@@ -0,0 +1,90 @@
+package types
+
+import "time"
+
+const (
+	EventAccepted  = "accepted"
+	EventStarted   = "started"
+	EventProgress  = "progress"
+	EventCompleted = "completed"
+	// EventRetrying is a failed attempt that will be retried
+	EventRetrying = "retrying"
+	// EventFailed is a job that failed for good
+	EventFailed    = "failed"
+	EventPaused    = "paused"
+	EventCancelled = "cancelled"
+	// EventRejected is a message that didn't become a job, only sent to the response topic of the message
+	EventRejected = "rejected"
+)
+
+// StatusEvent is published whenever something happens to a job
+type StatusEvent struct {
+	Event    string   `json:"event"`
+	JobID    string   `json:"jobId"`
+	Hash     string   `json:"hash"`
+	Name     string   `json:"name"`
+	Code     string   `json:"code"`
+	State    JobState `json:"state"`
+	Attempts int      `json:"attempts"`
+	// Percent, Bytes and Rate are set on progress events
+	Percent float64 `json:"percent,omitempty"`
+	Bytes   int64   `json:"bytes,omitempty"`
+	Rate    int64   `json:"rate,omitempty"`
+	// Error and ErrorClass are set on retrying and failed events
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"errorClass,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// SubscriberState sums up what a subscriber is doing
+type SubscriberState struct {
+	ClientID string `json:"clientId"`
+	// Paused is true between a pause-all and a resume-all
+	Paused bool `json:"paused"`
+	// Queued is how many jobs wait in the queue
+	Queued int `json:"queued"`
+	// Jobs counts the unfinished jobs by state
+	Jobs      map[JobState]int `json:"jobs"`
+	Transfers []Transfer       `json:"transfers"`
+	// Rate is the combined speed of the running transfers in bytes per second
+	Rate int64 `json:"rate"`
+	// Active is the name of the oldest running transfer, if any
+	Active        string     `json:"active,omitempty"`
+	LastCompleted *Completed `json:"lastCompleted,omitempty"`
+	// Failures is how many jobs failed for good since the subscriber started
+	Failures  int       `json:"failures"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Completed is a job that completed
+type Completed struct {
+	JobID string    `json:"jobId"`
+	Name  string    `json:"name"`
+	Hash  string    `json:"hash"`
+	At    time.Time `json:"at"`
+}
+
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// Presence is the retained status of a subscriber. Every heartbeat refreshes it, and the Last Will of the
+// subscriber sets it to offline.
+type Presence struct {
+	ClientID string `json:"clientId"`
+	Status   string `json:"status"`
+	// Topics are what the subscriber takes jobs from, they may have wildcards
+	Topics  []string `json:"topics"`
+	Version string   `json:"version"`
+	// Heartbeat is left out of the Last Will, which the broker only sends at some later point
+	Heartbeat *Heartbeat `json:"heartbeat,omitempty"`
+}
+
+// Heartbeat is how a subscriber is doing, sent at a regular interval
+type Heartbeat struct {
+	Queued int `json:"queued"`
+	// FreeDisk is how many bytes are free at the destination of each code
+	FreeDisk map[string]int64 `json:"freeDisk"`
+	Time     time.Time        `json:"time"`
+}
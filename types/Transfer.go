@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// Transfer is the progress of a running transfer
+type Transfer struct {
+	JobID string `json:"jobId"`
+	Name  string `json:"name"`
+	Code  string `json:"code"`
+	// Backend is what moves the bytes, e.g. lftp
+	Backend string `json:"backend"`
+	// Bytes is how much is on disk so far, including what earlier attempts left
+	Bytes int64 `json:"bytes"`
+	// Size is the size of the payload, zero when the publisher didn't say
+	Size int64 `json:"size,omitempty"`
+	// Percent is zero while the size is unknown
+	Percent float64 `json:"percent"`
+	// Rate is the recent speed in bytes per second
+	Rate      int64     `json:"rate"`
+	StartedAt time.Time `json:"startedAt"`
+}
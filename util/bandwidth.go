@@ -0,0 +1,99 @@
+package util
+
+import (
+	"sync"
+)
+
+// Bandwidth splits one global rate between the running transfers, so that
+// their sum stays under it. Processes such as lftp can't share a limit, so
+// they register with Start and get their Share of the rate as their own
+// limit, and launch again with the new share when Changed says it moved and
+// Relimit says it moved enough.
+type Bandwidth struct {
+	// rate in bytes per second, zero means unlimited
+	rate   int64
+	active int
+	// changed is closed when the rate or the number of transfers changes
+	changed chan struct{}
+	// Mutual exclusion lock
+	lock sync.Mutex
+}
+
+func NewBandwidth(rate int64) *Bandwidth {
+	return &Bandwidth{rate: rate, changed: make(chan struct{})}
+}
+
+// SetRate changes the global rate.
+func (b *Bandwidth) SetRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = rate
+	b.broadcast()
+}
+
+func (b *Bandwidth) Rate() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rate
+}
+
+// Start registers a running transfer until the returned function is called.
+func (b *Bandwidth) Start() (done func()) {
+	b.lock.Lock()
+	b.active++
+	b.broadcast()
+	b.lock.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.lock.Lock()
+			b.active--
+			b.broadcast()
+			b.lock.Unlock()
+		})
+	}
+}
+
+// Share returns the rate each running transfer may use, zero meaning unlimited.
+func (b *Bandwidth) Share() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	share := b.rate / int64(max(b.active, 1))
+	// lftp treats zero as unlimited, so never hand that out by accident
+	return max(share, 1)
+}
+
+// Relimit reports whether a transfer limited to running is worth launching
+// again with share: when it goes to or from unlimited, or moves by more than
+// a fifth. Smaller moves aren't worth interrupting the transfer for, which
+// lets the sum of the transfers go up to a quarter over the rate.
+func Relimit(running, share int64) bool {
+	if running == share {
+		return false
+	}
+	if running <= 0 || share <= 0 {
+		return true
+	}
+	diff := running - share
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff*5 > running
+}
+
+// Changed returns a channel that is closed the next time the rate or the
+// number of running transfers changes, and with them the Share.
+func (b *Bandwidth) Changed() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.changed
+}
+
+// broadcast must be called with the lock held
+func (b *Bandwidth) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
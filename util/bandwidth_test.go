@@ -0,0 +1,85 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestBandwidthShare(t *testing.T) {
+	bandwidth := NewBandwidth(1000)
+	if share := bandwidth.Share(); share != 1000 {
+		t.Errorf("Expected the whole rate without transfers, got %d", share)
+	}
+	first := bandwidth.Start()
+	second := bandwidth.Start()
+	if share := bandwidth.Share(); share != 500 {
+		t.Errorf("Expected half the rate for two transfers, got %d", share)
+	}
+	second()
+	// Ending a transfer twice must not free up more than it took
+	second()
+	if share := bandwidth.Share(); share != 1000 {
+		t.Errorf("Expected the whole rate once a transfer finished, got %d", share)
+	}
+	first()
+
+	bandwidth.SetRate(0)
+	if share := bandwidth.Share(); share != 0 {
+		t.Errorf("Expected no limit, got %d", share)
+	}
+}
+
+func TestBandwidthChanged(t *testing.T) {
+	bandwidth := NewBandwidth(1000)
+	changed := bandwidth.Changed()
+	select {
+	case <-changed:
+		t.Fatal("Expected no change yet")
+	default:
+	}
+	done := bandwidth.Start()
+	select {
+	case <-changed:
+	default:
+		t.Error("Expected a new transfer to change the share")
+	}
+
+	changed = bandwidth.Changed()
+	bandwidth.SetRate(500)
+	select {
+	case <-changed:
+	default:
+		t.Error("Expected a new rate to change the share")
+	}
+
+	changed = bandwidth.Changed()
+	done()
+	select {
+	case <-changed:
+	default:
+		t.Error("Expected a finished transfer to change the share")
+	}
+}
+
+func TestRelimit(t *testing.T) {
+	cases := []struct {
+		running, share int64
+		relimit        bool
+	}{
+		{1000, 1000, false},
+		{0, 0, false},
+		// A fifth or less isn't worth a restart
+		{1000, 800, false},
+		{1000, 1200, false},
+		{1111, 1000, false},
+		{1000, 500, true},
+		{500, 1000, true},
+		{1000, 799, true},
+		{0, 1000, true},
+		{1000, 0, true},
+	}
+	for _, c := range cases {
+		if relimit := Relimit(c.running, c.share); relimit != c.relimit {
+			t.Errorf("Expected relimit=%t from %d to %d, got %t", c.relimit, c.running, c.share, relimit)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package util
+
+import "sync"
+
+// Broadcaster hands every published value to every subscriber. A subscriber
+// that can't keep up misses the older values rather than holding up the
+// publisher, so it always gets the latest one. The zero value is ready to use.
+type Broadcaster[T any] struct {
+	subscribers map[chan T]struct{}
+	// Mutual exclusion lock
+	lock sync.Mutex
+}
+
+// Subscribe returns a channel receiving the published values until the
+// returned function is called.
+func (b *Broadcaster[T]) Subscribe(buffer int) (<-chan T, func()) {
+	ch := make(chan T, max(buffer, 1))
+	b.lock.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan T]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subscribers, ch)
+			b.lock.Unlock()
+		})
+	}
+}
+
+// Publish sends value to every subscriber without blocking.
+func (b *Broadcaster[T]) Publish(value T) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- value:
+			continue
+		default:
+		}
+		// Make room by dropping the oldest value
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- value:
+		default:
+		}
+	}
+}
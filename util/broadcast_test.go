@@ -0,0 +1,34 @@
+package util
+
+import "testing"
+
+func TestBroadcaster(t *testing.T) {
+	var broadcaster Broadcaster[int]
+	first, unsubscribeFirst := broadcaster.Subscribe(1)
+	second, unsubscribeSecond := broadcaster.Subscribe(2)
+	defer unsubscribeSecond()
+
+	broadcaster.Publish(1)
+	broadcaster.Publish(2)
+	if got := <-first; got != 2 {
+		t.Errorf("Expected a slow subscriber to get the latest value, got %d", got)
+	}
+	if got := <-second; got != 1 {
+		t.Errorf("Expected 1, got %d", got)
+	}
+	if got := <-second; got != 2 {
+		t.Errorf("Expected 2, got %d", got)
+	}
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	broadcaster.Publish(3)
+	select {
+	case got := <-first:
+		t.Errorf("Expected nothing after unsubscribing, got %d", got)
+	default:
+	}
+	if got := <-second; got != 3 {
+		t.Errorf("Expected 3, got %d", got)
+	}
+}
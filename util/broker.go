@@ -0,0 +1,279 @@
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"sync"
+	"time"
+
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// BrokerOptions configures the embedded broker.
+type BrokerOptions struct {
+	// Listen is the TCP address the broker takes connections on
+	Listen string
+	// Users may connect with their password, anyone may connect when there are none
+	Users []types.BrokerUser
+	// TLS makes the listener take TLS connections only
+	TLS *tls.Config
+	// RetainedFile keeps the retained messages across restarts, they only live in memory when it is empty
+	RetainedFile string
+	Logger       *slog.Logger
+}
+
+// BrokerListen is the address the broker takes connections on: listen, or else port 1883 on every interface when
+// there are users to authenticate, and on the loopback interface only when anyone may connect.
+func BrokerListen(listen string, users []types.BrokerUser) string {
+	if listen != "" {
+		return listen
+	}
+	if len(users) == 0 {
+		return "127.0.0.1:1883"
+	}
+	return ":1883"
+}
+
+// NewBroker sets up an MQTT broker with the options, it starts taking connections once served.
+func NewBroker(options BrokerOptions) (*broker.Server, error) {
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	server := broker.New(&broker.Options{Logger: logger})
+	if len(options.Users) == 0 {
+		if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+			return nil, err
+		}
+	} else {
+		passwords := make(map[string]string, len(options.Users))
+		for _, user := range options.Users {
+			if user.Username == "" || user.Password == "" {
+				return nil, errors.New("every broker user needs a username and a password")
+			}
+			passwords[user.Username] = user.Password
+		}
+		if err := server.AddHook(&brokerAuth{passwords: passwords}, nil); err != nil {
+			return nil, err
+		}
+	}
+	if options.RetainedFile != "" {
+		if err := server.AddHook(&retainedStore{path: options.RetainedFile}, nil); err != nil {
+			return nil, fmt.Errorf("could not load the retained messages: %w", err)
+		}
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: options.Listen, TLSConfig: options.TLS})
+	if err := server.AddListener(listener); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// BrokerTLSConfig loads the certificate and key the broker presents. With a CA bundle, clients must present a
+// certificate it signed.
+func BrokerTLSConfig(cert string, key string, clientCA string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the broker certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the client CA bundle: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the client CA bundle %s", clientCA)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// brokerAuth lets the users with the right password in, to every topic.
+type brokerAuth struct {
+	broker.HookBase
+	passwords map[string]string
+}
+
+func (h *brokerAuth) ID() string {
+	return "seedstore-auth"
+}
+
+func (h *brokerAuth) Provides(b byte) bool {
+	return bytes.Contains([]byte{broker.OnConnectAuthenticate, broker.OnACLCheck}, []byte{b})
+}
+
+func (h *brokerAuth) OnConnectAuthenticate(cl *broker.Client, pk packets.Packet) bool {
+	password, found := h.passwords[string(pk.Connect.Username)]
+	// Compare anyway so the time taken doesn't tell which users exist
+	passwordOK := equal(string(pk.Connect.Password), password)
+	return found && passwordOK
+}
+
+func (h *brokerAuth) OnACLCheck(cl *broker.Client, topic string, write bool) bool {
+	return true
+}
+
+// retainedStore keeps the retained messages in a JSON file. Changes are written at most once a second, and when
+// the broker stops.
+type retainedStore struct {
+	broker.HookBase
+	path     string
+	lock     sync.Mutex
+	messages map[string]storage.Message
+	dirty    bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (h *retainedStore) ID() string {
+	return "seedstore-retained"
+}
+
+func (h *retainedStore) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		broker.OnRetainMessage,
+		broker.OnRetainedExpired,
+		broker.StoredRetainedMessages,
+		broker.OnStopped,
+	}, []byte{b})
+}
+
+func (h *retainedStore) Init(config any) error {
+	h.messages = make(map[string]storage.Message)
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	data, err := os.ReadFile(h.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &h.messages); err != nil {
+			return fmt.Errorf("%s is not valid: %w", h.path, err)
+		}
+	}
+	go h.flushEverySecond()
+	return nil
+}
+
+func (h *retainedStore) StoredRetainedMessages() ([]storage.Message, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	messages := make([]storage.Message, 0, len(h.messages))
+	for _, message := range h.messages {
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// OnRetainMessage is called with r at -1 when the retained message of the topic is cleared.
+func (h *retainedStore) OnRetainMessage(cl *broker.Client, pk packets.Packet, r int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.dirty = true
+	if r == -1 {
+		delete(h.messages, pk.TopicName)
+		return
+	}
+	props := pk.Properties.Copy(false)
+	h.messages[pk.TopicName] = storage.Message{
+		ID:          pk.TopicName,
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+}
+
+func (h *retainedStore) OnRetainedExpired(topic string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, found := h.messages[topic]; found {
+		delete(h.messages, topic)
+		h.dirty = true
+	}
+}
+
+func (h *retainedStore) OnStopped() {
+	close(h.stop)
+	<-h.done
+}
+
+func (h *retainedStore) flushEverySecond() {
+	defer close(h.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			h.flush()
+			return
+		case <-ticker.C:
+			h.flush()
+		}
+	}
+}
+
+func (h *retainedStore) flush() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.dirty {
+		return
+	}
+	if err := h.write(); err != nil {
+		h.Log.Error("Could not save the retained messages: " + err.Error())
+		return
+	}
+	h.dirty = false
+}
+
+func (h *retainedStore) write() error {
+	data, err := json.Marshal(h.messages)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return err
+	}
+	tmpPath := h.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmpPath, h.path)
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+func TestNewBroker(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, nil, nil, "Test CA")
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	serverCert, serverKey := newCertificate(t, ca, caKey, "broker.test")
+	writePEM(t, filepath.Join(dir, "broker.pem"), "CERTIFICATE", serverCert.Raw)
+	keyBytes, err := x509.MarshalECPrivateKey(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "broker.key"), "EC PRIVATE KEY", keyBytes)
+	tlsConfig, err := BrokerTLSConfig(filepath.Join(dir, "broker.pem"), filepath.Join(dir, "broker.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	options := BrokerOptions{
+		Listen:       listener.Addr().String(),
+		Users:        []types.BrokerUser{{Username: "box", Password: "secret"}},
+		TLS:          tlsConfig,
+		RetainedFile: filepath.Join(dir, "broker", "retained.json"),
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	start := func() func() {
+		server, err := NewBroker(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		return func() { server.Close() }
+	}
+	connect := func(password string) (mqtt.Client, error) {
+		viper.Reset()
+		viper.Set("mqtt.scheme", "ssl")
+		viper.Set("mqtt.host", "127.0.0.1")
+		viper.Set("mqtt.port", port)
+		viper.Set("mqtt.clientId", "test")
+		viper.Set("mqtt.username", "box")
+		viper.Set("mqtt.password", password)
+		viper.Set("mqtt.tls.ca", filepath.Join(dir, "ca.pem"))
+		viper.Set("mqtt.tls.serverName", "broker.test")
+		opts, err := MQTTOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.SetAutoReconnect(false)
+		client := mqtt.NewClient(opts)
+		token := client.Connect()
+		if !token.WaitTimeout(5 * time.Second) {
+			t.Fatal("Timed out connecting")
+		}
+		return client, token.Error()
+	}
+
+	stop := start()
+	if _, err := connect("wrong"); err == nil {
+		t.Error("Expected a wrong password to be refused")
+	}
+	client, err := connect("secret")
+	if err != nil {
+		t.Fatalf("Expected to connect, got %v", err)
+	}
+	if token := client.Publish("presence/box", 1, true, "online"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	client.Disconnect(250)
+	stop()
+
+	// The retained message outlives the broker
+	stop = start()
+	defer stop()
+	client, err = connect("secret")
+	if err != nil {
+		t.Fatalf("Expected to connect after the restart, got %v", err)
+	}
+	defer client.Disconnect(250)
+	received := make(chan string, 1)
+	client.Subscribe("presence/+", 1, func(client mqtt.Client, msg mqtt.Message) {
+		received <- string(msg.Payload())
+	})
+	select {
+	case payload := <-received:
+		if payload != "online" {
+			t.Errorf("Expected the retained message, got %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the retained message after the restart")
+	}
+
+	options.Users = []types.BrokerUser{{Username: "box"}}
+	if _, err := NewBroker(options); err == nil {
+		t.Error("Expected a user without a password to be refused")
+	}
+}
+
+func TestBrokerListen(t *testing.T) {
+	users := []types.BrokerUser{{Username: "box", Password: "secret"}}
+	if listen := BrokerListen("", nil); listen != "127.0.0.1:1883" {
+		t.Errorf("Expected a broker without users to listen on the loopback interface only, got %s", listen)
+	}
+	if listen := BrokerListen("", users); listen != ":1883" {
+		t.Errorf("Expected a broker with users to listen on every interface, got %s", listen)
+	}
+	if listen := BrokerListen(":1884", nil); listen != ":1884" {
+		t.Errorf("Expected the configured address, got %s", listen)
+	}
+}
@@ -0,0 +1,244 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"path"
+	"seedstore/types"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Claims lets subscribers that all get every message of a queue agree on which of them takes each item. A
+// subscriber claims an item by publishing a retained claim under the claims topic, waits for the claims of the
+// others to come in, and takes the item if its claim won. The owner renews its claims while it holds them, and
+// when it dies the others take over once the lease runs out. Once done, the owner leaves a done mark in place of
+// its claim for a while, so that a subscriber that was away when the item was published doesn't take it again.
+type Claims struct {
+	client   mqtt.Client
+	owner    string
+	topic    string
+	lease    time.Duration
+	settle   time.Duration
+	keepDone time.Duration
+
+	lock sync.Mutex
+	// claims is the winning claim of every item with a claim, held keeps the ones of owner to renew
+	claims map[string]types.Claim
+	held   map[string]bool
+}
+
+// NewClaims keeps the claims of owner under topic, each one in its own subtopic. settle is how long a claim waits
+// for competing ones, which must be longer than it takes the broker to pass a message on. keepDone is how long
+// the done marks stay, they aren't left at all when it is zero.
+func NewClaims(client mqtt.Client, owner string, topic string, lease time.Duration, settle time.Duration, keepDone time.Duration) *Claims {
+	return &Claims{
+		client:   client,
+		owner:    owner,
+		topic:    strings.TrimSuffix(topic, "/"),
+		lease:    lease,
+		settle:   settle,
+		keepDone: keepDone,
+		claims:   make(map[string]types.Claim),
+		held:     make(map[string]bool),
+	}
+}
+
+// ClaimID identifies the item of msg in a topic: its torrent hash, or a digest of its name and location for a
+// message without one or with a hash that isn't safe in a topic.
+func ClaimID(msg types.MQTTMessage) string {
+	hash := strings.ToLower(msg.Hash)
+	if hash != "" && strings.Trim(hash, "0123456789abcdef") == "" {
+		return hash
+	}
+	digest := sha256.Sum256([]byte(HistoryKey(msg)))
+	return hex.EncodeToString(digest[:16])
+}
+
+// Start follows the claims and renews the held ones until ctx is cancelled. The claims already at the broker
+// have arrived by the time it returns.
+func (c *Claims) Start(ctx context.Context) error {
+	token := c.client.Subscribe(c.topic+"/+", 1, c.onClaim)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	time.Sleep(c.settle)
+	go c.renew(ctx)
+	return nil
+}
+
+func (c *Claims) onClaim(client mqtt.Client, msg mqtt.Message) {
+	defer msg.Ack()
+	id := path.Base(msg.Topic())
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(msg.Payload()) == 0 {
+		delete(c.claims, id)
+		delete(c.held, id)
+		return
+	}
+	var claim types.Claim
+	if err := json.Unmarshal(msg.Payload(), &claim); err != nil {
+		slog.Warn("Ignoring a claim that isn't valid on " + msg.Topic() + ": " + err.Error())
+		return
+	}
+	claim.ID = id
+	now := time.Now()
+	if claim.Done && claim.Owner == c.owner && !claim.Live(now) {
+		// Left behind while the owner was away
+		delete(c.claims, id)
+		go c.client.Publish(c.topic+"/"+id, 1, true, []byte{})
+		return
+	}
+	current, found := c.claims[id]
+	if !found || !current.Live(now) || current.Done || claim.Owner == current.Owner || claim.Beats(current) {
+		c.claims[id] = claim
+	}
+	if c.claims[id].Owner != c.owner || c.claims[id].Done {
+		delete(c.held, id)
+	}
+}
+
+// Claim tries to take the item id, which is held right away if it already is. It returns the winning claim,
+// which is a claim of the owner when won is true. An item that is marked done isn't taken, and comes back as the
+// done winner, unless force takes it again anyway.
+func (c *Claims) Claim(id string, force bool) (winner types.Claim, won bool, err error) {
+	now := time.Now()
+	c.lock.Lock()
+	current, found := c.claims[id]
+	if found && current.Done {
+		if current.Live(now) && !force {
+			c.lock.Unlock()
+			return current, false, nil
+		}
+		// A new claim replaces the mark
+		found = false
+	}
+	if found && current.Live(now) {
+		if current.Owner != c.owner {
+			c.lock.Unlock()
+			return current, false, nil
+		}
+		if c.held[id] {
+			c.lock.Unlock()
+			return current, true, nil
+		}
+	}
+	claim := types.Claim{ID: id, Owner: c.owner, Claimed: now, Expires: now.Add(c.lease)}
+	if found && current.Owner == c.owner && current.Live(now) {
+		// Left by an earlier run of the owner, which is still first in line
+		claim.Claimed = current.Claimed
+	}
+	c.claims[id] = claim
+	c.lock.Unlock()
+
+	if err := c.publish(claim); err != nil {
+		c.lock.Lock()
+		if c.claims[id] == claim {
+			delete(c.claims, id)
+		}
+		c.lock.Unlock()
+		return types.Claim{}, false, err
+	}
+	if !found || current.Owner != c.owner {
+		time.Sleep(c.settle)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	winner = c.claims[id]
+	won = winner.Owner == c.owner
+	if won {
+		c.held[id] = true
+	}
+	return winner, won, nil
+}
+
+// Current is the winning claim of the item id, or its done mark, if anyone claimed it.
+func (c *Claims) Current(id string) (types.Claim, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	claim, found := c.claims[id]
+	return claim, found
+}
+
+// Release gives up the item id once the owner is done with it, which tells the others that it is taken care of.
+// The claim is replaced with a done mark, which the owner clears once it is older than keepDone. Items held by
+// another subscriber are left alone.
+func (c *Claims) Release(id string) {
+	c.lock.Lock()
+	claim, found := c.claims[id]
+	if !found || claim.Owner != c.owner || claim.Done {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.held, id)
+	if c.keepDone <= 0 {
+		delete(c.claims, id)
+		c.lock.Unlock()
+		c.client.Publish(c.topic+"/"+id, 1, true, []byte{})
+		return
+	}
+	claim.Done = true
+	claim.Expires = time.Now().Add(c.keepDone)
+	c.claims[id] = claim
+	c.lock.Unlock()
+	if err := c.publish(claim); err != nil {
+		slog.Warn("Could not mark " + id + " as done: " + err.Error())
+	}
+}
+
+// renew extends the leases of the held claims three times per lease, so one lost renewal doesn't let them go. It
+// also clears the done marks of the owner that ran out.
+func (c *Claims) renew(ctx context.Context) {
+	ticker := time.NewTicker(c.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		var renewed []types.Claim
+		c.lock.Lock()
+		for id := range c.held {
+			claim := c.claims[id]
+			claim.Expires = now.Add(c.lease)
+			c.claims[id] = claim
+			renewed = append(renewed, claim)
+		}
+		var cleared []string
+		for id, claim := range c.claims {
+			if claim.Done && claim.Owner == c.owner && !claim.Live(now) {
+				delete(c.claims, id)
+				cleared = append(cleared, id)
+			}
+		}
+		c.lock.Unlock()
+		for _, id := range cleared {
+			c.client.Publish(c.topic+"/"+id, 1, true, []byte{})
+		}
+		for _, claim := range renewed {
+			if err := c.publish(claim); err != nil {
+				slog.Warn("Could not renew the claim on " + claim.ID + ": " + err.Error())
+			}
+		}
+	}
+}
+
+func (c *Claims) publish(claim types.Claim) error {
+	payload, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	token := c.client.Publish(c.topic+"/"+claim.ID, 1, true, payload)
+	token.Wait()
+	return token.Error()
+}
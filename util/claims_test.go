@@ -0,0 +1,135 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"seedstore/types"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestClaimID(t *testing.T) {
+	if id := ClaimID(types.MQTTMessage{Hash: "ABC123"}); id != "abc123" {
+		t.Errorf("Expected the hash in lowercase, got %s", id)
+	}
+	unsafe := ClaimID(types.MQTTMessage{Hash: "a/+#"})
+	byName := ClaimID(types.MQTTMessage{Name: "Ubuntu", Location: "/iso"})
+	if len(unsafe) != 32 || len(byName) != 32 || unsafe == byName {
+		t.Errorf("Expected digests for a hash that isn't hex and for a message without one, got %s and %s", unsafe, byName)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	const lease = 600 * time.Millisecond
+	const settle = 200 * time.Millisecond
+	const keepDone = 2 * lease
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("MQTT %d", version), func(t *testing.T) {
+			port := startBroker(t)
+			viper.Reset()
+			viper.Set("mqtt.host", "127.0.0.1")
+			viper.Set("mqtt.port", port)
+			viper.Set("mqtt.protocolVersion", version)
+
+			owners := []string{"box-a", "box-b", "box-c"}
+			subscribers := make(map[string]*Claims)
+			stops := make(map[string]context.CancelFunc)
+			for _, owner := range owners {
+				viper.Set("mqtt.clientId", owner)
+				client := InitMQTTDefault()
+				defer client.Disconnect(250)
+				ctx, stop := context.WithCancel(context.Background())
+				defer stop()
+				subscribers[owner] = NewClaims(client, owner, "claims", lease, settle, keepDone)
+				stops[owner] = stop
+				if err := subscribers[owner].Start(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Every subscriber gets the same message and claims it at once, only one of them takes it
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			var won []string
+			winners := make(map[string]bool)
+			for _, owner := range owners {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					winner, ok, err := subscribers[owner].Claim("abc", false)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					lock.Lock()
+					defer lock.Unlock()
+					winners[winner.Owner] = true
+					if ok {
+						won = append(won, owner)
+					}
+				}()
+			}
+			wg.Wait()
+			if len(won) != 1 || len(winners) != 1 || !winners[won[0]] {
+				t.Fatalf("Expected one subscriber to win and the others to agree, won by %v, winners %v", won, winners)
+			}
+			holder := won[0]
+			var other string
+			for _, owner := range owners {
+				if owner != holder {
+					other = owner
+				}
+			}
+
+			// The holder renews its lease, so the claim outlives it
+			time.Sleep(2 * lease)
+			if winner, ok, _ := subscribers[other].Claim("abc", false); ok || winner.Owner != holder {
+				t.Errorf("Expected %s to keep its claim, got it taken by %s", holder, winner.Owner)
+			}
+
+			// Once released, everyone knows the item is taken care of
+			subscribers[holder].Release("abc")
+			time.Sleep(settle)
+			for _, owner := range owners {
+				if claim, found := subscribers[owner].Current("abc"); !found || !claim.Done {
+					t.Errorf("Expected %s to see the item done, got %+v", owner, claim)
+				}
+			}
+			// A subscriber that gets the item late doesn't take it again, unless forced to
+			if winner, ok, _ := subscribers[other].Claim("abc", false); ok || !winner.Done {
+				t.Errorf("Expected the item to stay done, got %+v", winner)
+			}
+			// Until the mark runs out, when the holder clears it
+			time.Sleep(keepDone + lease)
+			for _, owner := range owners {
+				if claim, found := subscribers[owner].Current("abc"); found {
+					t.Errorf("Expected %s to see the done mark cleared, got %+v", owner, claim)
+				}
+			}
+			if _, ok, _ := subscribers[holder].Claim("ghi", false); !ok {
+				t.Fatal("Expected an item nobody claimed to be taken")
+			}
+			subscribers[holder].Release("ghi")
+			time.Sleep(settle)
+			if winner, ok, _ := subscribers[other].Claim("ghi", true); !ok || winner.Done {
+				t.Errorf("Expected a forced claim to take an item anyway, got %+v", winner)
+			}
+
+			// A holder that stops renewing, like one that died, is taken over once its lease runs out
+			if _, ok, _ := subscribers[holder].Claim("def", false); !ok {
+				t.Fatal("Expected an item nobody claimed to be taken")
+			}
+			stops[holder]()
+			if _, ok, _ := subscribers[other].Claim("def", false); ok {
+				t.Error("Expected the lease to hold for a while")
+			}
+			time.Sleep(lease + settle)
+			if winner, ok, _ := subscribers[other].Claim("def", false); !ok {
+				t.Errorf("Expected %s to take over, got it held by %s", other, winner.Owner)
+			}
+		})
+	}
+}
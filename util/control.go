@@ -0,0 +1,144 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"strconv"
+	"time"
+)
+
+// controlTimeout bounds how long a client waits on the control socket
+const controlTimeout = 10 * time.Second
+
+// ControlHandler answers a request received on the control socket.
+type ControlHandler func(request types.ControlRequest) types.ControlResponse
+
+// ControlServer serves the control protocol on a Unix socket. Only processes
+// running as root, as the user of the server or as one of the allowed users
+// may talk to it.
+type ControlServer struct {
+	listener net.Listener
+	handler  ControlHandler
+	// allowed holds the user IDs that may connect
+	allowed map[int]bool
+}
+
+// ListenControl creates the control socket at path. A socket left behind by a
+// server that is gone is replaced, one that still answers is not.
+func ListenControl(path string, allowedUIDs []int, handler ControlHandler) (*ControlServer, error) {
+	if len(allowedUIDs) > 0 && !hasPeerCredentials {
+		return nil, errors.New("allowing other users on the control socket is only supported on Linux")
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("another subscriber is listening on " + path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Other users are kept out by their credentials, not by the permissions of the socket
+	mode := os.FileMode(0o600)
+	if len(allowedUIDs) > 0 {
+		mode = 0o666
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	allowed := map[int]bool{0: true, os.Getuid(): true}
+	for _, uid := range allowedUIDs {
+		allowed[uid] = true
+	}
+	return &ControlServer{listener: listener, handler: handler, allowed: allowed}, nil
+}
+
+// Serve answers requests until Close is called.
+func (s *ControlServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("Control socket error: " + err.Error())
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server and removes the socket.
+func (s *ControlServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *ControlServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	uid, err := peerUID(conn)
+	if err != nil || !s.allowed[uid] {
+		reason := "user " + strconv.Itoa(uid)
+		if err != nil {
+			reason = err.Error()
+		}
+		slog.Warn("Refused a control connection: " + reason)
+		encoder.Encode(types.ControlResponse{Version: types.ControlProtocolVersion, Error: "permission denied"})
+		return
+	}
+	decoder := json.NewDecoder(conn)
+	for {
+		var request types.ControlRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		var response types.ControlResponse
+		if request.Version != types.ControlProtocolVersion {
+			response.Error = fmt.Sprintf("unsupported protocol version %d, this subscriber speaks version %d",
+				request.Version, types.ControlProtocolVersion)
+		} else {
+			response = s.handler(request)
+		}
+		response.Version = types.ControlProtocolVersion
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// CallControl sends a request to the control socket at path and returns the
+// response. An error in the response is returned as an error.
+func CallControl(path string, request types.ControlRequest) (types.ControlResponse, error) {
+	var response types.ControlResponse
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return response, fmt.Errorf("is the subscriber running? %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	if request.Version == 0 {
+		request.Version = types.ControlProtocolVersion
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return response, err
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return response, err
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
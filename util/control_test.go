@@ -0,0 +1,72 @@
+package util
+
+import (
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+)
+
+func TestControlServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := ListenControl(path, nil, func(request types.ControlRequest) types.ControlResponse {
+		if request.Command != types.ControlShow {
+			return types.ControlResponse{Error: "unknown command"}
+		}
+		return types.ControlResponse{Jobs: []types.Job{{ID: request.Target}}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	response, err := CallControl(path, types.ControlRequest{Command: types.ControlShow, Target: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Version != types.ControlProtocolVersion || len(response.Jobs) != 1 || response.Jobs[0].ID != "42" {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+	if _, err := CallControl(path, types.ControlRequest{Command: "nope"}); err == nil || err.Error() != "unknown command" {
+		t.Errorf("Expected the error of the handler, got %v", err)
+	}
+	if _, err := CallControl(path, types.ControlRequest{Version: 99, Command: types.ControlShow}); err == nil {
+		t.Error("Expected an unsupported protocol version to be refused")
+	}
+
+	if _, err := ListenControl(path, nil, nil); err == nil {
+		t.Error("Expected a second server on a live socket to fail")
+	}
+}
+
+func TestControlServerPeerCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := ListenControl(path, nil, func(request types.ControlRequest) types.ControlResponse {
+		return types.ControlResponse{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// Nobody is allowed, not even this process
+	server.allowed = map[int]bool{}
+	go server.Serve()
+
+	if _, err := CallControl(path, types.ControlRequest{Command: types.ControlList}); err == nil || err.Error() != "permission denied" {
+		t.Errorf("Expected permission denied, got %v", err)
+	}
+}
+
+func TestControlServerReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := ListenControl(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	server, err = ListenControl(path, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, got %v", err)
+	}
+	server.Close()
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"errors"
+	"seedstore/types"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// DeadLetters is the list of jobs that ran out of attempts. It is shared
+// between the subscriber, which adds to it, and the CLI, which inspects and
+// requeues its jobs, so every operation takes an exclusive file lock.
+type DeadLetters struct {
+	file jobFile
+}
+
+func NewDeadLetters(path string) *DeadLetters {
+	return &DeadLetters{file: jobFile{path: path}}
+}
+
+// Add appends job to the list.
+func (d *DeadLetters) Add(job types.Job) error {
+	return d.file.withLock(func() error {
+		return d.file.append(job)
+	})
+}
+
+// List returns the dead jobs, oldest first.
+func (d *DeadLetters) List() ([]types.Job, error) {
+	var jobs []types.Job
+	err := d.file.withLock(func() error {
+		var err error
+		jobs, err = d.file.read()
+		return err
+	})
+	return jobs, err
+}
+
+// Remove takes the job with the given ID or hash off the list and returns it.
+func (d *DeadLetters) Remove(idOrHash string) (types.Job, error) {
+	var removed types.Job
+	err := d.file.withLock(func() error {
+		jobs, err := d.file.read()
+		if err != nil {
+			return err
+		}
+		kept := jobs[:0]
+		found := false
+		for _, job := range jobs {
+			if !found && (job.ID == idOrHash || (job.Message.Hash != "" && job.Message.Hash == idOrHash)) {
+				removed = job
+				found = true
+				continue
+			}
+			kept = append(kept, job)
+		}
+		if !found {
+			return ErrJobNotFound
+		}
+		return d.file.write(kept)
+	})
+	return removed, err
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"errors"
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+)
+
+func TestDeadLetters(t *testing.T) {
+	deadLetters := NewDeadLetters(filepath.Join(t.TempDir(), "deadletter.jsonl"))
+	jobs, err := deadLetters.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("Expected an empty list, got %d jobs", len(jobs))
+	}
+
+	deadLetters.Add(types.Job{ID: "1", State: types.JobFailed, Message: types.MQTTMessage{Name: "first", Hash: "aaa"}})
+	deadLetters.Add(types.Job{ID: "2", State: types.JobFailed, Message: types.MQTTMessage{Name: "second", Hash: "bbb"}})
+
+	job, err := deadLetters.Remove("bbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "2" {
+		t.Errorf("Expected to remove job 2 by hash, got %s", job.ID)
+	}
+	if _, err := deadLetters.Remove("2"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+
+	jobs, _ = deadLetters.List()
+	if len(jobs) != 1 || jobs[0].ID != "1" {
+		t.Errorf("Expected only job 1 left, got %v", jobs)
+	}
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DiskUsage returns how many bytes the file or directory at path takes up on
+// disk. It counts the allocated blocks rather than the apparent size, because
+// lftp's pget writes its segments into a sparse file that has its full size
+// from the start. A path that doesn't exist yet uses nothing.
+func DiskUsage(path string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		size := info.Size()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			size = min(size, stat.Blocks*512)
+		}
+		total += size
+		return nil
+	})
+	return total, err
+}
+
+// FreeSpace returns how many bytes are available to unprivileged users on the
+// disk that holds path. A path that doesn't exist yet, like a destination
+// before the first download, is on the disk of its nearest existing parent.
+func FreeSpace(path string) (int64, error) {
+	path = filepath.Clean(path)
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), nil
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
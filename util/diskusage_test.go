@@ -0,0 +1,50 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+	if used, err := DiskUsage(filepath.Join(dir, "missing")); err != nil || used != 0 {
+		t.Errorf("Expected a missing path to use nothing, got %d, %v", used, err)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "release", "subs"), 0o755)
+	os.WriteFile(filepath.Join(dir, "release", "video"), make([]byte, 64*1024), 0o644)
+	os.WriteFile(filepath.Join(dir, "release", "subs", "en.srt"), make([]byte, 8*1024), 0o644)
+	used, err := DiskUsage(filepath.Join(dir, "release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 72*1024 {
+		t.Errorf("Expected 73728 bytes, got %d", used)
+	}
+
+	// A sparse file only counts what was written
+	sparse, _ := os.Create(filepath.Join(dir, "sparse"))
+	sparse.Truncate(1 << 30)
+	sparse.WriteAt(make([]byte, 4096), 0)
+	sparse.Close()
+	used, _ = DiskUsage(filepath.Join(dir, "sparse"))
+	if used >= 1<<20 {
+		t.Errorf("Expected a sparse file to count its written blocks, got %d", used)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := FreeSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free <= 0 {
+		t.Errorf("Expected some free space, got %d", free)
+	}
+	// A destination that isn't there yet is measured on its parent
+	if missing, err := FreeSpace(filepath.Join(dir, "movies", "4k")); err != nil || missing <= 0 {
+		t.Errorf("Expected the free space of the parent, got %d, %v", missing, err)
+	}
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -9,9 +10,18 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// killDelay is how long a cancelled command gets to exit after SIGTERM before its process group is killed
+const killDelay = 10 * time.Second
+
+// runningGroups holds the process group of every running command, so they can all be killed at once
+var runningGroups sync.Map
+
 func CheckIfCommandExists(bin string) (path string, err error) {
 	var fMsg string
 	path, err = exec.LookPath(bin)
@@ -26,29 +36,63 @@ func CheckIfCommandExists(bin string) (path string, err error) {
 
 }
 
-func RunCommand(binPath string, args string) (exitCode int, e error) {
+// ShellQuote quotes s as a single word for bash, whatever it holds.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// LftpQuote quotes s as a single argument of an lftp command, whatever it holds.
+func LftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// RunCommand runs the binary through bash, killing it if ctx is cancelled
+// before it exits. Besides the exit code it returns what the command wrote to
+// stderr, so callers can tell failures apart.
+func RunCommand(ctx context.Context, binPath string, args string) (exitCode int, errOutput string, e error) {
+	return RunCommandWithEnv(ctx, binPath, args, nil)
+}
+
+// RunCommandWithEnv is RunCommand with extra "KEY=value" environment variables
+// on top of the current environment.
+func RunCommandWithEnv(ctx context.Context, binPath string, args string, env []string) (exitCode int, errOutput string, e error) {
 	fullCmd := fmt.Sprintf("%s %s", binPath, args)
-	cmd := exec.Command("bash", "-c", fullCmd)
+	cmd := exec.CommandContext(ctx, "bash", "-c", fullCmd)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// Run the command in its own process group, so that cancelling it reaches every process
+	// it spawned and a CTRL-C in the terminal doesn't reach it behind our back
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var killTimer *time.Timer
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		killTimer = time.AfterFunc(killDelay, func() {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
 	// This is mainly for running the command as a different user
 	// if the PGID and PUID are set
 	if os.Getenv("PGID") != "" && os.Getenv("PUID") != "" {
 		pgid, err := strconv.ParseInt(os.Getenv("PGID"), 10, 32)
 		if err != nil {
 			slog.Error("Error parsing PGID")
-			return 126, err
+			return 126, "", err
 		}
 
 		puid, err := strconv.ParseInt(os.Getenv("PUID"), 10, 32)
 		if err != nil {
 			slog.Error("Error parsing PUID")
-			return 126, err
+			return 126, "", err
 		}
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
 		cmd.SysProcAttr.Credential = &syscall.Credential{
 			Uid: uint32(puid),
 			Gid: uint32(pgid),
 		}
-		cmd.Env = os.Environ()
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
 	}
 
 	var stdout, stderr bytes.Buffer
@@ -57,22 +101,43 @@ func RunCommand(binPath string, args string) (exitCode int, e error) {
 	prefixWriterStdErr := NewPrefixWriter(os.Stderr, "[CMD-ERR] ")
 	cmd.Stdout = io.MultiWriter(prefixWriterStdOut, &stdout)
 	cmd.Stderr = io.MultiWriter(prefixWriterStdErr, &stderr)
-	err := cmd.Run()
+	err := cmd.Start()
+	if err == nil {
+		runningGroups.Store(cmd.Process.Pid, struct{}{})
+		err = cmd.Wait()
+		runningGroups.Delete(cmd.Process.Pid)
+	}
+	if killTimer != nil {
+		// The group is gone, make sure its ID isn't killed once it is reused
+		killTimer.Stop()
+	}
+	if err != nil && ctx.Err() != nil {
+		slog.Warn("The command was cancelled: " + ctx.Err().Error())
+		return 130, stderr.String(), ctx.Err()
+	}
 	if err != nil {
 		switch e := err.(type) {
 		case *exec.Error:
 			slog.Error("The command failed executing: " + err.Error())
-			return 126, err
+			return 126, stderr.String(), err
 		case *exec.ExitError:
 			errCodeMsg := fmt.Sprintf("Exit Code: %d", e.ExitCode())
 			slog.Error("The command executed, but an error happened")
 			slog.Error(errCodeMsg)
-			return e.ExitCode(), nil
+			return e.ExitCode(), stderr.String(), nil
 		default:
 			log.Fatal("[FATAL] Unexpected error executing your command,", err)
 		}
 	}
-	return 0, nil
+	return 0, stderr.String(), nil
+}
+
+// KillRunningCommands kills the process group of every command still running.
+func KillRunningCommands() {
+	runningGroups.Range(func(pid, _ any) bool {
+		syscall.Kill(-pid.(int), syscall.SIGKILL)
+		return true
+	})
 }
 
 type PrefixWriter struct {
@@ -87,6 +152,8 @@ func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
 func (e PrefixWriter) Write(p []byte) (int, error) {
 	prefix := []byte(e.prefix)
 	n, err := e.w.Write(append(prefix, p...))
+	// Callers only know about p, so don't count the prefix
+	n = max(n-len(prefix), 0)
 	if err != nil {
 		return n, err
 	}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	exitCode, errOutput, err := RunCommand(context.Background(), "echo", "oops >&2; exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", exitCode)
+	}
+	if errOutput != "oops\n" {
+		t.Errorf("Expected the stderr output, got %q", errOutput)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, word := range []string{"plain", "two words", "it's", "$(touch /tmp/pwned)", "`id`; rm -rf x", `back\slash "quoted"`} {
+		_, output, err := RunCommand(context.Background(), "printf", "%s "+ShellQuote(word)+" >&2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != word {
+			t.Errorf("Expected %q back, got %q", word, output)
+		}
+	}
+	if quoted := LftpQuote(`a "b" \c`); quoted != `"a \"b\" \\c"` {
+		t.Errorf("Expected the quotes and backslashes escaped, got %s", quoted)
+	}
+}
+
+func TestRunCommandOutputIsClassified(t *testing.T) {
+	exitCode, errOutput, err := RunCommand(context.Background(), "echo", "'mirror: Login failed: 530 Login incorrect.' >&2; exit 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferErr := NewTransferError(exitCode, errOutput)
+	if transferErr.Class != ErrorAuth || transferErr.Class.Retryable() {
+		t.Errorf("Expected a login failure to be an auth error that isn't retried, got %s", transferErr.Class)
+	}
+}
+
+func TestRunCommandCancelKillsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	// The background sleep keeps stdout open, so this only returns once the whole group is gone
+	_, _, err := RunCommand(ctx, "sleep", "30 & sleep 30")
+	if err == nil {
+		t.Fatal("Expected the command to be cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the process group to be stopped quickly, took %s", elapsed)
+	}
+}
+
+func TestKillRunningCommands(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		RunCommand(context.Background(), "sleep", "30")
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	KillRunningCommands()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the command to be killed")
+	}
+}
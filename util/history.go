@@ -0,0 +1,136 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"seedstore/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+// History records every job the subscriber finished along with its outcome,
+// so that items it already downloaded aren't downloaded again. Like the
+// dead-letter list it is shared with the CLI, so every operation takes an
+// exclusive file lock. The items downloaded so far are indexed in memory, and
+// the index only reads what was added to the file since.
+type History struct {
+	file jobFile
+
+	lock sync.Mutex
+	// completed is the last job that downloaded each item, by HistoryKey
+	completed map[string]types.Job
+	// indexed is how much of the file is in completed, and indexedFile the file it was read from
+	indexed     int64
+	indexedFile os.FileInfo
+}
+
+// HistoryFilter narrows down the jobs returned by History.List. Zero fields match everything.
+type HistoryFilter struct {
+	State types.JobState
+	Code  string
+	// Search matches the name, hash, location or category, ignoring case
+	Search string
+	// Since only keeps jobs that finished at or after it
+	Since time.Time
+	// Limit only keeps the most recent jobs
+	Limit int
+}
+
+func NewHistory(path string) *History {
+	return &History{file: jobFile{path: path}}
+}
+
+// HistoryKey identifies the item a message is about: its torrent hash, or its
+// name and location for messages without one.
+func HistoryKey(msg types.MQTTMessage) string {
+	if msg.Hash != "" {
+		return "hash:" + strings.ToLower(msg.Hash)
+	}
+	return "name:" + msg.Name + "\x00" + msg.Location
+}
+
+// Add records a finished job.
+func (h *History) Add(job types.Job) error {
+	return h.file.withLock(func() error {
+		return h.file.append(job)
+	})
+}
+
+// List returns the recorded jobs matching filter, oldest first.
+func (h *History) List(filter HistoryFilter) ([]types.Job, error) {
+	var jobs []types.Job
+	err := h.file.withLock(func() error {
+		all, err := h.file.read()
+		if err != nil {
+			return err
+		}
+		for _, job := range all {
+			if filter.matches(job) {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	if filter.Limit > 0 && len(jobs) > filter.Limit {
+		jobs = jobs[len(jobs)-filter.Limit:]
+	}
+	return jobs, err
+}
+
+// Completed returns the last job that downloaded the same item as msg, if any.
+func (h *History) Completed(msg types.MQTTMessage) (types.Job, bool, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	err := h.file.withLock(h.updateIndex)
+	job, found := h.completed[HistoryKey(msg)]
+	return job, found, err
+}
+
+// updateIndex adds the jobs appended to the file since the last time to the index, or indexes the file again
+// from the start when it was replaced or cut short. It must be called with both locks held.
+func (h *History) updateIndex() error {
+	info, err := os.Stat(h.file.path)
+	if errors.Is(err, os.ErrNotExist) {
+		h.completed, h.indexed, h.indexedFile = nil, 0, nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if h.completed == nil || h.indexedFile == nil || !os.SameFile(info, h.indexedFile) || info.Size() < h.indexed {
+		h.completed = make(map[string]types.Job)
+		h.indexed = 0
+	}
+	h.indexedFile = info
+	jobs, indexed, err := h.file.readFrom(h.indexed)
+	h.indexed = indexed
+	for _, job := range jobs {
+		if job.State == types.JobDone {
+			h.completed[HistoryKey(job.Message)] = job
+		}
+	}
+	return err
+}
+
+func (f HistoryFilter) matches(job types.Job) bool {
+	if f.State != "" && job.State != f.State {
+		return false
+	}
+	if f.Code != "" && !strings.EqualFold(job.Code, f.Code) {
+		return false
+	}
+	if !f.Since.IsZero() && job.UpdatedAt.Before(f.Since) {
+		return false
+	}
+	if f.Search == "" {
+		return true
+	}
+	search := strings.ToLower(f.Search)
+	for _, field := range []string{job.Message.Name, job.Message.Hash, job.Message.Location, job.Message.Category} {
+		if strings.Contains(strings.ToLower(field), search) {
+			return true
+		}
+	}
+	return false
+}
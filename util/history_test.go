@@ -0,0 +1,84 @@
+package util
+
+import (
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history := NewHistory(path)
+	now := time.Now()
+	history.Add(types.Job{ID: "1", Code: "tv", State: types.JobFailed, UpdatedAt: now.Add(-2 * time.Hour),
+		Message: types.MQTTMessage{Name: "Show.S01E01", Hash: "AAA", Location: "/tv/Show.S01E01"}})
+	history.Add(types.Job{ID: "2", Code: "tv", State: types.JobDone, UpdatedAt: now.Add(-time.Hour),
+		Message: types.MQTTMessage{Name: "Show.S01E01", Hash: "aaa", Location: "/tv/Show.S01E01"}})
+	history.Add(types.Job{ID: "3", Code: "movies", State: types.JobDone, UpdatedAt: now,
+		Message: types.MQTTMessage{Name: "Movie", Location: "/movies/Movie"}})
+
+	job, found, err := history.Completed(types.MQTTMessage{Name: "renamed", Hash: "Aaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || job.ID != "2" {
+		t.Errorf("Expected job 2 to have completed the hash, got %v %v", found, job.ID)
+	}
+	if _, found, _ := history.Completed(types.MQTTMessage{Name: "Movie", Location: "/movies/Movie"}); !found {
+		t.Error("Expected a message without a hash to match on name and location")
+	}
+	if _, found, _ := history.Completed(types.MQTTMessage{Name: "Movie", Location: "/other/Movie"}); found {
+		t.Error("Expected a different location not to match")
+	}
+
+	// What another process adds is indexed too, and a history replaced behind its back is indexed again
+	other := NewHistory(path)
+	other.Add(types.Job{ID: "4", State: types.JobDone, Message: types.MQTTMessage{Name: "Other", Hash: "ccc"}})
+	if _, found, _ := history.Completed(types.MQTTMessage{Hash: "ccc"}); !found {
+		t.Error("Expected a job added by another process to be found")
+	}
+	jobs, _ := other.List(HistoryFilter{})
+	if err := other.file.write(jobs[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := history.Completed(types.MQTTMessage{Hash: "ccc"}); found {
+		t.Error("Expected a job no longer in the history not to be found")
+	}
+	if _, found, _ := history.Completed(types.MQTTMessage{Hash: "aaa"}); !found {
+		t.Error("Expected the jobs left in the history to be found")
+	}
+
+	tests := []struct {
+		name   string
+		filter HistoryFilter
+		ids    []string
+	}{
+		{"all", HistoryFilter{}, []string{"1", "2", "3"}},
+		{"state", HistoryFilter{State: types.JobDone}, []string{"2", "3"}},
+		{"code", HistoryFilter{Code: "TV"}, []string{"1", "2"}},
+		{"search", HistoryFilter{Search: "s01e01"}, []string{"1", "2"}},
+		{"since", HistoryFilter{Since: now.Add(-90 * time.Minute)}, []string{"2", "3"}},
+		{"limit", HistoryFilter{Limit: 1}, []string{"3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jobs, err := history.List(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, job := range jobs {
+				ids = append(ids, job.ID)
+			}
+			if len(ids) != len(test.ids) {
+				t.Fatalf("Expected %v, got %v", test.ids, ids)
+			}
+			for i := range ids {
+				if ids[i] != test.ids[i] {
+					t.Fatalf("Expected %v, got %v", test.ids, ids)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// HADevice groups the entities of one subscriber in Home Assistant.
+type HADevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+}
+
+// HAEntity is one sensor, button or switch announced through Home Assistant MQTT discovery.
+type HAEntity struct {
+	// Component is the kind of entity, e.g. sensor or button
+	Component string `json:"-"`
+	// ObjectID is unique within the device
+	ObjectID string `json:"-"`
+
+	Name              string    `json:"name"`
+	UniqueID          string    `json:"unique_id"`
+	Icon              string    `json:"icon,omitempty"`
+	StateTopic        string    `json:"state_topic,omitempty"`
+	ValueTemplate     string    `json:"value_template,omitempty"`
+	UnitOfMeasurement string    `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string    `json:"device_class,omitempty"`
+	StateClass        string    `json:"state_class,omitempty"`
+	CommandTopic      string    `json:"command_topic,omitempty"`
+	PayloadPress      string    `json:"payload_press,omitempty"`
+	Device            *HADevice `json:"device,omitempty"`
+}
+
+var discoveryIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// DiscoveryID makes s usable as a node or object ID in a discovery topic.
+func DiscoveryID(s string) string {
+	return strings.Trim(discoveryIDChars.ReplaceAllString(s, "_"), "_")
+}
+
+// DiscoveryMessages returns the retained config message of every entity by discovery topic, e.g.
+// homeassistant/sensor/<nodeID>/<objectID>/config. Every entity gets the device and a unique ID made of the
+// node and object IDs.
+func DiscoveryMessages(prefix string, nodeID string, device HADevice, entities []HAEntity) (map[string][]byte, error) {
+	nodeID = DiscoveryID(nodeID)
+	messages := make(map[string][]byte, len(entities))
+	for _, entity := range entities {
+		if entity.Component == "" || entity.ObjectID == "" {
+			return nil, fmt.Errorf("entity %q needs a component and an object ID", entity.Name)
+		}
+		objectID := DiscoveryID(entity.ObjectID)
+		entity.UniqueID = nodeID + "_" + objectID
+		entity.Device = &device
+		payload, err := json.Marshal(entity)
+		if err != nil {
+			return nil, err
+		}
+		messages[fmt.Sprintf("%s/%s/%s/%s/config", prefix, entity.Component, nodeID, objectID)] = payload
+	}
+	return messages, nil
+}
+
+// PublishDiscovery announces the entities to Home Assistant. The configs are retained, so Home Assistant
+// finds them when it starts after the subscriber.
+func PublishDiscovery(client mqtt.Client, prefix string, nodeID string, device HADevice, entities []HAEntity) error {
+	messages, err := DiscoveryMessages(prefix, nodeID, device, entities)
+	if err != nil {
+		return err
+	}
+	for topic, payload := range messages {
+		token := client.Publish(topic, 1, true, payload)
+		token.Wait()
+		if token.Error() != nil {
+			return token.Error()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiscoveryMessages(t *testing.T) {
+	device := HADevice{Identifiers: []string{"seedstore_box"}, Name: "Seedstore"}
+	messages, err := DiscoveryMessages("homeassistant", "seed box", device, []HAEntity{
+		{Component: "sensor", ObjectID: "queue_length", Name: "Queue length", StateTopic: "state", ValueTemplate: "{{ value_json.queued }}"},
+		{Component: "button", ObjectID: "pause_all", Name: "Pause all", CommandTopic: "command", PayloadPress: `{"command":"pause-all"}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+
+	payload, found := messages["homeassistant/sensor/seed_box/queue_length/config"]
+	if !found {
+		t.Fatalf("Expected the sensor config on its discovery topic, got %v", messages)
+	}
+	var sensor map[string]any
+	if err := json.Unmarshal(payload, &sensor); err != nil {
+		t.Fatal(err)
+	}
+	if sensor["unique_id"] != "seed_box_queue_length" {
+		t.Errorf("Expected the unique ID seed_box_queue_length, got %v", sensor["unique_id"])
+	}
+	if sensor["state_topic"] != "state" || sensor["value_template"] != "{{ value_json.queued }}" {
+		t.Errorf("Expected the state topic and template, got %v", sensor)
+	}
+	if device, ok := sensor["device"].(map[string]any); !ok || device["name"] != "Seedstore" {
+		t.Errorf("Expected the device, got %v", sensor["device"])
+	}
+	if _, found := sensor["command_topic"]; found {
+		t.Errorf("Expected no command topic on a sensor, got %v", sensor)
+	}
+
+	payload = messages["homeassistant/button/seed_box/pause_all/config"]
+	var button map[string]any
+	if err := json.Unmarshal(payload, &button); err != nil {
+		t.Fatal(err)
+	}
+	if button["payload_press"] != `{"command":"pause-all"}` {
+		t.Errorf("Expected the pause-all command as payload, got %v", button["payload_press"])
+	}
+
+	if _, err := DiscoveryMessages("homeassistant", "box", device, []HAEntity{{Name: "No component"}}); err == nil {
+		t.Error("Expected an error for an entity without a component")
+	}
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPAuth(t *testing.T) {
+	auth := HTTPAuth{Username: "admin", Password: "secret", Token: "t0ken"}
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		status  int
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "nope") }, http.StatusUnauthorized},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }, http.StatusOK},
+		{"wrong bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "access_token=t0ken" }, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/queue", nil)
+			test.prepare(r)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("Expected status %d, got %d", test.status, w.Code)
+			}
+		})
+	}
+
+	if (HTTPAuth{Password: "only"}).Enabled() {
+		t.Error("Expected a password without a username not to enable auth")
+	}
+}
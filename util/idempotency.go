@@ -0,0 +1,74 @@
+package util
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrIdempotencyMismatch = errors.New("idempotency key was already used for a different request")
+
+// IdempotencyCache remembers the response to every idempotency key for a
+// while, so that a retried request gets the first response again instead of
+// doing the work twice. Server errors aren't remembered, so they can be retried.
+type IdempotencyCache struct {
+	ttl     time.Duration
+	entries map[string]*idempotencyEntry
+	// Mutual exclusion lock
+	lock sync.Mutex
+}
+
+type idempotencyEntry struct {
+	// fingerprint identifies the request, e.g. a hash of its body
+	fingerprint string
+	// done is closed once the response is known
+	done    chan struct{}
+	status  int
+	body    []byte
+	expires time.Time
+}
+
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{ttl: ttl, entries: make(map[string]*idempotencyEntry)}
+}
+
+// Do returns the response remembered for key, waiting for it if the first
+// request with the key is still running, or calls fn and remembers what it
+// returns. A request that waited on a server error runs fn itself. Reusing a
+// key for a request with another fingerprint fails with ErrIdempotencyMismatch.
+func (c *IdempotencyCache) Do(key string, fingerprint string, fn func() (status int, body []byte)) (status int, body []byte, replayed bool, err error) {
+	c.lock.Lock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if entry, found := c.entries[key]; found {
+		c.lock.Unlock()
+		if entry.fingerprint != fingerprint {
+			return 0, nil, false, ErrIdempotencyMismatch
+		}
+		<-entry.done
+		if entry.status >= 500 {
+			// Not remembered, so the request runs again as if it were the first with the key
+			return c.Do(key, fingerprint, fn)
+		}
+		return entry.status, entry.body, true, nil
+	}
+	entry := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = entry
+	c.lock.Unlock()
+
+	status, body = fn()
+	c.lock.Lock()
+	entry.status = status
+	entry.body = body
+	entry.expires = time.Now().Add(c.ttl)
+	if status >= 500 {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+	c.lock.Unlock()
+	return status, body, false, nil
+}
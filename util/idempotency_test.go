@@ -0,0 +1,83 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	cache := NewIdempotencyCache(time.Hour)
+	var calls atomic.Int32
+	create := func() (int, []byte) {
+		calls.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return 202, []byte("job 1")
+	}
+
+	var wg sync.WaitGroup
+	var replays atomic.Int32
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body, replayed, err := cache.Do("key", "body", create)
+			if err != nil || status != 202 || string(body) != "job 1" {
+				t.Errorf("Unexpected response %d %q %v", status, body, err)
+			}
+			if replayed {
+				replays.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls.Load() != 1 || replays.Load() != 4 {
+		t.Errorf("Expected one call and four replays, got %d calls and %d replays", calls.Load(), replays.Load())
+	}
+
+	if _, _, _, err := cache.Do("key", "other body", create); !errors.Is(err, ErrIdempotencyMismatch) {
+		t.Errorf("Expected ErrIdempotencyMismatch, got %v", err)
+	}
+
+	// Server errors are not remembered
+	cache.Do("failing", "body", func() (int, []byte) { return 500, nil })
+	status, _, replayed, _ := cache.Do("failing", "body", func() (int, []byte) { return 202, nil })
+	if status != 202 || replayed {
+		t.Errorf("Expected a failed request to run again, got %d, replayed %v", status, replayed)
+	}
+}
+
+func TestIdempotencyCacheWaiterAfterServerError(t *testing.T) {
+	cache := NewIdempotencyCache(time.Hour)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go cache.Do("key", "body", func() (int, []byte) {
+		close(started)
+		<-release
+		return 503, []byte("unavailable")
+	})
+	<-started
+	result := make(chan string)
+	go func() {
+		status, body, replayed, err := cache.Do("key", "body", func() (int, []byte) { return 202, []byte("job 1") })
+		result <- fmt.Sprintf("%d %s %t %v", status, body, replayed, err)
+	}()
+	// Waiting on the first request by now
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if got := <-result; got != "202 job 1 false <nil>" {
+		t.Errorf("Expected the waiting request to run itself after the server error, got %s", got)
+	}
+}
+
+func TestIdempotencyCacheExpires(t *testing.T) {
+	cache := NewIdempotencyCache(time.Millisecond)
+	cache.Do("key", "body", func() (int, []byte) { return 202, nil })
+	time.Sleep(5 * time.Millisecond)
+	if _, _, replayed, _ := cache.Do("key", "other body", func() (int, []byte) { return 202, nil }); replayed {
+		t.Error("Expected the key to have expired")
+	}
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"syscall"
+)
+
+// jobFile is a file of jobs, one JSON object per line, that the subscriber and
+// the CLI share. Every operation on it must run inside withLock.
+type jobFile struct {
+	path string
+}
+
+// withLock runs fn while holding an exclusive lock on a sibling lock file.
+func (f jobFile) withLock(fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(f.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+// append adds job at the end of the file.
+func (f jobFile) append(job types.Job) error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	line, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// read returns every job in the file.
+func (f jobFile) read() ([]types.Job, error) {
+	jobs, _, err := f.readFrom(0)
+	return jobs, err
+}
+
+// readFrom returns the jobs from offset on, and the offset right after the
+// last complete line. Lines that aren't valid are skipped.
+func (f jobFile) readFrom(offset int64) ([]types.Job, int64, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	var jobs []types.Job
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A line without its newline isn't finished yet
+			return jobs, offset, nil
+		}
+		if err != nil {
+			return jobs, offset, err
+		}
+		offset += int64(len(line))
+		var job types.Job
+		if err := json.Unmarshal(line, &job); err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+// write replaces the content of the file with jobs, atomically.
+func (f jobFile) write(jobs []types.Job) error {
+	tmpPath := f.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, job := range jobs {
+		line, err := json.Marshal(job)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(tmpPath, f.path)
+}
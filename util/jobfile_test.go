@@ -0,0 +1,37 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+)
+
+func TestJobFileReadFrom(t *testing.T) {
+	file := jobFile{path: filepath.Join(t.TempDir(), "jobs.jsonl")}
+	if jobs, offset, err := file.readFrom(0); err != nil || len(jobs) != 0 || offset != 0 {
+		t.Fatalf("Expected nothing from a missing file, got %v %d %v", jobs, offset, err)
+	}
+	file.append(types.Job{ID: "1"})
+	file.append(types.Job{ID: "2"})
+	jobs, offset, err := file.readFrom(0)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got %v %v", jobs, err)
+	}
+
+	// A line being written isn't read until it is complete
+	f, err := os.OpenFile(file.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"3"`)
+	if jobs, next, _ := file.readFrom(offset); len(jobs) != 0 || next != offset {
+		t.Errorf("Expected the unfinished line to be left for later, got %v at %d", jobs, next)
+	}
+	f.WriteString("}\nnot json\n")
+	f.Close()
+	jobs, _, err = file.readFrom(offset)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != "3" {
+		t.Errorf("Expected only job 3 after the offset, got %v %v", jobs, err)
+	}
+}
@@ -0,0 +1,218 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"sort"
+	"sync"
+)
+
+// compactThreshold is the number of stale records the journal tolerates
+// before it rewrites itself with only the live jobs
+const compactThreshold = 256
+
+type journalRecord struct {
+	// Seq is the position of the job in the original arrival order
+	Seq     uint64    `json:"seq"`
+	Job     types.Job `json:"job"`
+	Removed bool      `json:"removed,omitempty"`
+}
+
+// Journal is a durable, append-only record of the jobs that still have to be
+// transferred. Every change to a job appends its full state, so replaying the
+// file yields the latest state of every job. Stale records are dropped by
+// compacting the file once enough of them pile up.
+type Journal struct {
+	path    string
+	file    *os.File
+	live    map[string]journalRecord
+	nextSeq uint64
+	// records is the number of records currently in the file
+	records int
+	// Mutual exclusion lock
+	lock sync.Mutex
+}
+
+// OpenJournal opens or creates the journal at path and replays it.
+func OpenJournal(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	j := &Journal{path: path, live: make(map[string]journalRecord)}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) replay() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Most likely a write torn by a crash, the rest of the file is still usable
+			slog.Warn(fmt.Sprintf("Skipping unreadable journal record on line %d: %s", line, err.Error()))
+			continue
+		}
+		if record.Removed {
+			delete(j.live, record.Job.ID)
+		} else {
+			j.live[record.Job.ID] = record
+		}
+		if record.Seq >= j.nextSeq {
+			j.nextSeq = record.Seq + 1
+		}
+	}
+	return scanner.Err()
+}
+
+// Put durably records the current state of job.
+func (j *Journal) Put(job types.Job) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	record, found := j.live[job.ID]
+	if !found {
+		record.Seq = j.nextSeq
+		j.nextSeq++
+	}
+	record.Job = job
+	if err := j.append(record); err != nil {
+		return err
+	}
+	j.live[job.ID] = record
+	return j.maybeCompact()
+}
+
+// Remove durably drops the job with the given ID from the journal.
+func (j *Journal) Remove(id string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	record, found := j.live[id]
+	if !found {
+		return nil
+	}
+	record.Removed = true
+	if err := j.append(record); err != nil {
+		return err
+	}
+	delete(j.live, id)
+	return j.maybeCompact()
+}
+
+// Jobs returns every job in the journal in their original arrival order.
+func (j *Journal) Jobs() []types.Job {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	records := j.sortedRecords()
+	jobs := make([]types.Job, len(records))
+	for i, record := range records {
+		jobs[i] = record.Job
+	}
+	return jobs
+}
+
+// Close closes the underlying file.
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// sortedRecords must be called with the lock held
+func (j *Journal) sortedRecords() []journalRecord {
+	records := make([]journalRecord, 0, len(j.live))
+	for _, record := range j.live {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Seq < records[b].Seq })
+	return records
+}
+
+// append must be called with the lock held
+func (j *Journal) append(record journalRecord) error {
+	if j.file == nil {
+		return os.ErrClosed
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.records++
+	return j.file.Sync()
+}
+
+// maybeCompact must be called with the lock held
+func (j *Journal) maybeCompact() error {
+	if j.records-len(j.live) > compactThreshold {
+		return j.compact()
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the live records and swaps it in
+// atomically. It must be called with the lock held.
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	records := j.sortedRecords()
+	w := bufio.NewWriter(tmp)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	j.records = len(records)
+	return nil
+}
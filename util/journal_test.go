@@ -0,0 +1,102 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"strings"
+	"testing"
+)
+
+func TestJournalSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.journal")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Put(types.Job{ID: "1", State: types.JobQueued, Message: types.MQTTMessage{Name: "first"}})
+	journal.Put(types.Job{ID: "2", State: types.JobQueued, Message: types.MQTTMessage{Name: "second"}})
+	journal.Put(types.Job{ID: "3", State: types.JobQueued, Message: types.MQTTMessage{Name: "third"}})
+	// Updating a job must not move it to the back of the line
+	journal.Put(types.Job{ID: "1", State: types.JobTransferring, Message: types.MQTTMessage{Name: "first"}})
+	journal.Remove("2")
+	journal.Close()
+
+	journal, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	jobs := journal.Jobs()
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got %d", len(jobs))
+	}
+	if jobs[0].ID != "1" || jobs[1].ID != "3" {
+		t.Errorf("Expected jobs in their original order, got %s, %s", jobs[0].ID, jobs[1].ID)
+	}
+	if jobs[0].State != types.JobTransferring {
+		t.Errorf("Expected the latest state %s, got %s", types.JobTransferring, jobs[0].State)
+	}
+
+	// New jobs still go to the back of the line after a restart
+	journal.Put(types.Job{ID: "4", State: types.JobQueued})
+	jobs = journal.Jobs()
+	if jobs[len(jobs)-1].ID != "4" {
+		t.Errorf("Expected job 4 last, got %s", jobs[len(jobs)-1].ID)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.journal")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	journal.Put(types.Job{ID: "keep", State: types.JobQueued})
+	for i := 0; i < compactThreshold*2; i++ {
+		id := fmt.Sprintf("job-%d", i)
+		journal.Put(types.Job{ID: id, State: types.JobQueued})
+		journal.Remove(id)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Count(string(content), "\n")
+	if lines > compactThreshold+2 {
+		t.Errorf("Expected the journal to be compacted, it has %d records", lines)
+	}
+	jobs := journal.Jobs()
+	if len(jobs) != 1 || jobs[0].ID != "keep" {
+		t.Errorf("Expected only the 'keep' job to survive compaction, got %v", jobs)
+	}
+}
+
+func TestJournalSkipsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.journal")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Put(types.Job{ID: "1", State: types.JobQueued})
+	journal.Close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":1,"job":{"id":"2"`)
+	f.Close()
+
+	journal, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if jobs := journal.Jobs(); len(jobs) != 1 || jobs[0].ID != "1" {
+		t.Errorf("Expected only job 1 to be recovered, got %v", jobs)
+	}
+}
@@ -0,0 +1,41 @@
+package util
+
+import "sync"
+
+// KeyedMutex is a mutex per key, so that work on one key doesn't hold up the others. The zero value is ready to use.
+type KeyedMutex struct {
+	lock  sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	// users is how many are holding or waiting for the lock, it is dropped when none are left
+	users int
+}
+
+// Lock locks key and returns the function that unlocks it.
+func (m *KeyedMutex) Lock(key string) (unlock func()) {
+	m.lock.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	lock, found := m.locks[key]
+	if !found {
+		lock = &keyedLock{}
+		m.locks[key] = lock
+	}
+	lock.users++
+	m.lock.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		m.lock.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(m.locks, key)
+		}
+		m.lock.Unlock()
+	}
+}
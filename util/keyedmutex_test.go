@@ -0,0 +1,46 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var mutex KeyedMutex
+	unlock := mutex.Lock("a")
+
+	// Other keys aren't held up
+	done := make(chan struct{})
+	go func() {
+		mutex.Lock("b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected b to lock while a is locked")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		unlockAgain := mutex.Lock("a")
+		close(locked)
+		unlockAgain()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Expected a to wait until it is unlocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a to lock once unlocked")
+	}
+
+	mutex.Lock("a")()
+	if len(mutex.locks) != 0 {
+		t.Errorf("Expected the unused locks to be dropped, got %d", len(mutex.locks))
+	}
+}
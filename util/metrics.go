@@ -0,0 +1,226 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics is a small registry of counters, gauges and histograms that writes
+// them in the Prometheus text exposition format.
+type Metrics struct {
+	families []*metricFamily
+	// collectors run before every write, to update gauges that are cheaper to
+	// work out on demand
+	collectors []func()
+	// Mutual exclusion lock
+	lock sync.Mutex
+}
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	// buckets are the upper bounds of a histogram, in increasing order
+	buckets []float64
+	series  map[string]*metricSeries
+	lock    sync.Mutex
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// counts per bucket, not cumulative
+	counts []uint64
+	count  uint64
+}
+
+// Counter only goes up, e.g. the number of messages received.
+type Counter struct{ family *metricFamily }
+
+// Gauge goes up and down, e.g. the depth of the queue.
+type Gauge struct{ family *metricFamily }
+
+// Histogram counts observations in buckets, e.g. the duration of transfers.
+type Histogram struct{ family *metricFamily }
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{m.register(name, help, "counter", labelNames, nil)}
+}
+
+func (m *Metrics) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{m.register(name, help, "gauge", labelNames, nil)}
+}
+
+func (m *Metrics) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{m.register(name, help, "histogram", labelNames, buckets)}
+}
+
+// OnCollect registers fn to run before the metrics are written.
+func (m *Metrics) OnCollect(fn func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.collectors = append(m.collectors, fn)
+}
+
+func (m *Metrics) register(name string, help string, kind string, labelNames []string, buckets []float64) *metricFamily {
+	family := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.families = append(m.families, family)
+	return family
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter with the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.family.update(labelValues, func(s *metricSeries) { s.value += v })
+}
+
+// Set sets the gauge with the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.family.update(labelValues, func(s *metricSeries) { s.value = v })
+}
+
+// Reset drops every series of the gauge, for gauges whose label values come and go.
+func (g *Gauge) Reset() {
+	g.family.lock.Lock()
+	defer g.family.lock.Unlock()
+	g.family.series = make(map[string]*metricSeries)
+}
+
+// Observe records v in the histogram with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.family.update(labelValues, func(s *metricSeries) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.family.buckets))
+		}
+		for i, bound := range h.family.buckets {
+			if v <= bound {
+				s.counts[i]++
+				break
+			}
+		}
+		s.value += v
+		s.count++
+	})
+}
+
+func (f *metricFamily) update(labelValues []string, fn func(s *metricSeries)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s, found := f.series[key]
+	if !found {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.lock.Lock()
+	collectors := append([]func(){}, m.collectors...)
+	families := append([]*metricFamily{}, m.families...)
+	m.lock.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	out := bufio.NewWriter(w)
+	for _, family := range families {
+		family.write(out)
+	}
+	return out.Flush()
+}
+
+func (f *metricFamily) write(w *bufio.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labels(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s.labelValues, formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labels(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labels(s.labelValues, ""), s.count)
+	}
+}
+
+// labels formats the label set of a series, with an le label for histogram buckets.
+func (f *metricFamily) labels(values []string, le string) string {
+	var pairs []string
+	for i, name := range f.labelNames {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	received := metrics.NewCounter("test_received_total", "Messages received.", "source")
+	depth := metrics.NewGauge("test_queue_depth", "Jobs waiting.")
+	durations := metrics.NewHistogram("test_duration_seconds", "How long it took.", []float64{10, 1}, "code")
+
+	received.Inc("mqtt")
+	received.Add(2, "mqtt")
+	received.Inc(`a "quoted"` + "\nvalue")
+	metrics.OnCollect(func() { depth.Set(4) })
+	durations.Observe(0.5, "V")
+	durations.Observe(5, "V")
+	durations.Observe(50, "V")
+
+	var out strings.Builder
+	if err := metrics.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_received_total Messages received.
+# TYPE test_received_total counter
+test_received_total{source="a \"quoted\"\nvalue"} 1
+test_received_total{source="mqtt"} 3
+# HELP test_queue_depth Jobs waiting.
+# TYPE test_queue_depth gauge
+test_queue_depth 4
+# HELP test_duration_seconds How long it took.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{code="V",le="1"} 1
+test_duration_seconds_bucket{code="V",le="10"} 2
+test_duration_seconds_bucket{code="V",le="+Inf"} 3
+test_duration_seconds_sum{code="V"} 55.5
+test_duration_seconds_count{code="V"} 3
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+}
+
+func TestMetricsWrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a missing label value")
+		}
+	}()
+	NewMetrics().NewCounter("test_total", "Test.", "code").Inc()
+}
@@ -1,9 +1,18 @@
 package util
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
@@ -14,6 +23,17 @@ type Handlers struct {
 	OnReceivedMessageHandler mqtt.MessageHandler
 	OnConnectionLostHandler  mqtt.ConnectionLostHandler
 	OnConnectHandler         mqtt.OnConnectHandler
+	// storeDir is set for a persistent session
+	storeDir string
+	will     *Will
+}
+
+// Will is published by the broker when the client goes away without disconnecting, e.g. when it crashes or loses
+// its network.
+type Will struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
 }
 
 func InitMQTTDefault() mqtt.Client {
@@ -28,6 +48,24 @@ func InitMQTTWithHandlers(received mqtt.MessageHandler, connLost mqtt.Connection
 	})
 }
 
+// InitMQTTSession connects with a persistent session: the broker keeps the subscriptions and the messages published
+// while the client is away under its client ID, which must be configured, and in-flight messages are kept in storeDir.
+// Messages waiting at the broker arrive as soon as the client connects, before it subscribes again, so received
+// also gets the messages of the topics subscribed with their own handlers until then. Messages are not acked
+// automatically, every handler must call Ack once it is done with a message. The acks go out in the order the
+// messages arrived, so one that is never acked holds back the acks of the rest, and the broker sends the messages
+// that weren't acked again on the next connection. The broker publishes will, if any, when the client goes away
+// without disconnecting.
+func InitMQTTSession(storeDir string, will *Will, received mqtt.MessageHandler, connLost mqtt.ConnectionLostHandler, onConn mqtt.OnConnectHandler) mqtt.Client {
+	return initMQTT(&Handlers{
+		OnReceivedMessageHandler: received,
+		OnConnectionLostHandler:  connLost,
+		OnConnectHandler:         onConn,
+		storeDir:                 storeDir,
+		will:                     will,
+	})
+}
+
 func initMQTT(handlers *Handlers) mqtt.Client {
 	var messagePubHandler mqtt.MessageHandler
 	var connectHandler mqtt.OnConnectHandler
@@ -56,15 +94,225 @@ func initMQTT(handlers *Handlers) mqtt.Client {
 		}
 	}
 
-	broker := viper.GetString("mqtt.host")
+	opts, err := MQTTOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if handlers.storeDir != "" {
+		if err := persistSession(opts, handlers.storeDir); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		opts.SetClientID(shortLivedClientID())
+	}
+	if handlers.will != nil {
+		opts.SetBinaryWill(handlers.will.Topic, handlers.will.Payload, 1, handlers.will.Retained)
+	}
+	version, err := ProtocolVersion()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if version == 5 {
+		return initMQTT5(opts, &Handlers{
+			OnReceivedMessageHandler: messagePubHandler,
+			OnConnectionLostHandler:  connectLostHandler,
+			OnConnectHandler:         connectHandler,
+			storeDir:                 handlers.storeDir,
+		})
+	}
+	var client mqtt.Client
+	if handlers.storeDir != "" {
+		session := &sessionClient{acks: new(orderedAcks)}
+		opts.SetDefaultPublishHandler(session.handler(messagePubHandler))
+		opts.OnConnect = func(mqtt.Client) {
+			session.resubscribe()
+			connectHandler(session)
+		}
+		opts.OnConnectionLost = func(_ mqtt.Client, err error) { connectLostHandler(session, err) }
+		session.Client = mqtt.NewClient(opts)
+		client = session
+	} else {
+		opts.SetDefaultPublishHandler(messagePubHandler)
+		opts.OnConnect = connectHandler
+		opts.OnConnectionLost = connectLostHandler
+		client = mqtt.NewClient(opts)
+	}
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatal(token.Error())
+	}
+	return client
+}
+
+// sessionClient is the MQTT 3.1.1 client of a persistent session. It hands its handlers messages whose acks are sent
+// in the order the messages were received, as MQTT requires, whichever order the handlers ack them in. The MQTT 5
+// client does the same by itself. It also subscribes again on every reconnection, as it isn't told whether the
+// broker still has the session: the broker may have lost it, or another client with the same ID may have ended it.
+type sessionClient struct {
+	mqtt.Client
+	acks          *orderedAcks
+	subscriptions subscriptionList
+}
+
+func (c *sessionClient) handler(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		handler(c, c.acks.add(msg))
+	}
+}
+
+func (c *sessionClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *sessionClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	wrapped := c.handler(callback)
+	c.subscriptions.add(filters, wrapped)
+	return c.Client.SubscribeMultiple(filters, wrapped)
+}
+
+func (c *sessionClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.subscriptions.remove(topics)
+	return c.Client.Unsubscribe(topics...)
+}
+
+func (c *sessionClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.Client.AddRoute(topic, c.handler(callback))
+}
+
+// resubscribe makes the subscriptions made so far again.
+func (c *sessionClient) resubscribe() {
+	for topic, subscription := range c.subscriptions.all() {
+		token := c.Client.Subscribe(topic, subscription.qos, subscription.callback)
+		if token.Wait() && token.Error() != nil {
+			slog.Error("[MQTT] Could not subscribe to " + topic + " again: " + token.Error().Error())
+		}
+	}
+}
+
+// subscriptionList remembers the subscriptions of a client, to make them again when the broker lost them.
+type subscriptionList struct {
+	lock    sync.Mutex
+	filters map[string]subscription
+}
+
+type subscription struct {
+	qos      byte
+	callback mqtt.MessageHandler
+}
+
+func (l *subscriptionList) add(filters map[string]byte, callback mqtt.MessageHandler) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.filters == nil {
+		l.filters = make(map[string]subscription)
+	}
+	for topic, qos := range filters {
+		l.filters[topic] = subscription{qos: qos, callback: callback}
+	}
+}
+
+func (l *subscriptionList) remove(topics []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, topic := range topics {
+		delete(l.filters, topic)
+	}
+}
+
+func (l *subscriptionList) all() map[string]subscription {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return maps.Clone(l.filters)
+}
+
+// orderedAcks holds back the acks of messages until the messages received before them are acked too. Acks of
+// messages from an earlier connection still go out, the broker sends those messages again with the same ID.
+type orderedAcks struct {
+	lock    sync.Mutex
+	pending []*orderedMessage
+}
+
+type orderedMessage struct {
+	mqtt.Message
+	acks  *orderedAcks
+	acked bool
+}
+
+// add must be called in the order the messages are received.
+func (a *orderedAcks) add(msg mqtt.Message) mqtt.Message {
+	if msg.Qos() == 0 {
+		return msg
+	}
+	ordered := &orderedMessage{Message: msg, acks: a}
+	a.lock.Lock()
+	a.pending = append(a.pending, ordered)
+	a.lock.Unlock()
+	return ordered
+}
+
+func (m *orderedMessage) Ack() {
+	a := m.acks
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	m.acked = true
+	for len(a.pending) > 0 && a.pending[0].acked {
+		a.pending[0].Message.Ack()
+		a.pending = a.pending[1:]
+	}
+}
+
+// persistSession makes opts keep the session at the broker and the in-flight messages on disk.
+func persistSession(opts *mqtt.ClientOptions, storeDir string) error {
+	if viper.GetString("mqtt.clientId") == "" {
+		return fmt.Errorf("mqtt.clientId is required, the broker keeps the session under it")
+	}
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return fmt.Errorf("could not create the MQTT store: %w", err)
+	}
+	opts.SetCleanSession(false)
+	opts.SetResumeSubs(true)
+	opts.SetAutoAckDisabled(true)
+	opts.SetStore(mqtt.NewFileStore(storeDir))
+	return nil
+}
+
+// shortLivedClientID is the client ID of clients without a session, such as the publish command. They must not use
+// mqtt.clientId as it is: the broker would disconnect the subscriber using it, and end its session.
+func shortLivedClientID() string {
+	clientId := viper.GetString("mqtt.clientId")
+	if clientId == "" {
+		return uuid.NewString()
+	}
+	return clientId + "-pub-" + uuid.NewString()[:8]
+}
+
+// MQTTQoS is the quality of service for the messages on the queue, 1 unless mqtt.qos says otherwise.
+func MQTTQoS() (byte, error) {
+	if !viper.IsSet("mqtt.qos") {
+		return 1, nil
+	}
+	qos := viper.GetInt("mqtt.qos")
+	if qos < 0 || qos > 2 {
+		return 0, fmt.Errorf("mqtt.qos must be 0, 1 or 2, not %d", qos)
+	}
+	return byte(qos), nil
+}
+
+// defaultPorts are the usual broker ports for each scheme
+var defaultPorts = map[string]int{"tcp": 1883, "ssl": 8883, "ws": 80, "wss": 443}
+
+// MQTTOptions reads the connection to the broker from the config: the address, the credentials, the client ID
+// and, for the ssl and wss schemes, the TLS settings.
+func MQTTOptions() (*mqtt.ClientOptions, error) {
+	broker, err := BrokerURL()
+	if err != nil {
+		return nil, err
+	}
 	slog.Info("Connecting to", "broker", broker)
 	username := viper.GetString("mqtt.username")
 	password := viper.GetString("mqtt.password")
-	port := viper.GetInt("mqtt.port")
-	if port == 0 {
-		slog.Warn("PORT var not set, using the default 1883")
-		port = 1883
-	}
 
 	clientId := viper.GetString("mqtt.clientId")
 	if clientId == "" {
@@ -72,17 +320,81 @@ func initMQTT(handlers *Handlers) mqtt.Client {
 		clientId = uuid.NewString()
 	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
+	opts.AddBroker(broker)
 	opts.SetClientID(clientId)
 	opts.SetUsername(username)
 	opts.SetPassword(password)
 	opts.SetAutoReconnect(true)
-	opts.SetDefaultPublishHandler(messagePubHandler)
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
+	if scheme := mqttScheme(); scheme == "ssl" || scheme == "wss" {
+		tlsConfig, err := MQTTTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
 	}
-	return client
+	return opts, nil
+}
+
+func mqttScheme() string {
+	scheme := strings.ToLower(viper.GetString("mqtt.scheme"))
+	if scheme == "" {
+		scheme = "tcp"
+	}
+	return scheme
+}
+
+// BrokerURL is the address of the broker, e.g. ssl://broker:8883 or wss://broker:443/mqtt. The path is only
+// used by the websocket schemes.
+func BrokerURL() (string, error) {
+	scheme := mqttScheme()
+	defaultPort, known := defaultPorts[scheme]
+	if !known {
+		return "", fmt.Errorf("unknown MQTT scheme %q, use tcp, ssl, ws or wss", scheme)
+	}
+	port := viper.GetInt("mqtt.port")
+	if port == 0 {
+		slog.Warn(fmt.Sprintf("PORT var not set, using the default %d", defaultPort))
+		port = defaultPort
+	}
+	broker := (&url.URL{Scheme: scheme, Host: net.JoinHostPort(viper.GetString("mqtt.host"), strconv.Itoa(port))}).String()
+	if scheme == "ws" || scheme == "wss" {
+		if path := viper.GetString("mqtt.path"); path != "" {
+			broker += "/" + strings.TrimPrefix(path, "/")
+		}
+	}
+	return broker, nil
+}
+
+// MQTTTLSConfig builds the TLS settings from mqtt.tls. Without a CA bundle the system roots are trusted.
+func MQTTTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         viper.GetString("mqtt.tls.serverName"),
+		InsecureSkipVerify: viper.GetBool("mqtt.tls.insecureSkipVerify"),
+	}
+	if tlsConfig.InsecureSkipVerify {
+		slog.Warn("The certificate of the MQTT server is not verified")
+	}
+	if ca := viper.GetString("mqtt.tls.ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA bundle: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the CA bundle %s", ca)
+		}
+	}
+	cert := viper.GetString("mqtt.tls.cert")
+	key := viper.GetString("mqtt.tls.key")
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("the client certificate needs both mqtt.tls.cert and mqtt.tls.key")
+	}
+	if cert != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
 }
@@ -0,0 +1,478 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	storefile "github.com/eclipse/paho.golang/paho/store/file"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// ErrNotMQTT5 is returned when MQTT 5 properties are used over an MQTT 3.1.1 connection.
+var ErrNotMQTT5 = errors.New("message properties need mqtt.protocolVersion 5")
+
+// ackInterval is how often the acks of a session go out, they are held back until the messages before are acked
+const ackInterval = 50 * time.Millisecond
+
+// MessageProperties are the MQTT 5 properties of a message.
+type MessageProperties struct {
+	// ResponseTopic is where the receiver should reply, along with the CorrelationData
+	ResponseTopic   string
+	CorrelationData []byte
+	// MessageExpiry is how long the broker keeps the message for receivers that aren't connected, 0 for ever
+	MessageExpiry  time.Duration
+	UserProperties map[string]string
+}
+
+// ProtocolVersion is the MQTT version to speak to the broker, 3 (for 3.1.1) unless mqtt.protocolVersion is 5.
+func ProtocolVersion() (int, error) {
+	version := viper.GetInt("mqtt.protocolVersion")
+	switch version {
+	case 0, 3, 4:
+		return 3, nil
+	case 5:
+		return 5, nil
+	}
+	return 0, fmt.Errorf("mqtt.protocolVersion must be 3 or 5, not %d", version)
+}
+
+// PublishWithProperties publishes payload along with MQTT 5 properties. It fails with ErrNotMQTT5 over an
+// MQTT 3.1.1 connection.
+func PublishWithProperties(client mqtt.Client, topic string, qos byte, retained bool, payload []byte, properties MessageProperties) mqtt.Token {
+	client5, ok := client.(*mqtt5Client)
+	if !ok {
+		return failedToken(ErrNotMQTT5)
+	}
+	return client5.publish(topic, qos, retained, payload, &properties)
+}
+
+// Properties returns the MQTT 5 properties of msg, or false for a message received over MQTT 3.1.1.
+func Properties(msg mqtt.Message) (MessageProperties, bool) {
+	msg5, ok := msg.(*mqtt5Message)
+	if !ok {
+		return MessageProperties{}, false
+	}
+	properties := MessageProperties{UserProperties: make(map[string]string)}
+	if p := msg5.packet.Properties; p != nil {
+		properties.ResponseTopic = p.ResponseTopic
+		properties.CorrelationData = p.CorrelationData
+		if p.MessageExpiry != nil {
+			properties.MessageExpiry = time.Duration(*p.MessageExpiry) * time.Second
+		}
+		for _, user := range p.User {
+			properties.UserProperties[user.Key] = user.Value
+		}
+	}
+	return properties, true
+}
+
+// mqtt5Client puts an MQTT 5 connection behind the same interface as the MQTT 3.1.1 client, so the rest of
+// seedstore doesn't have to care which one it talks to.
+type mqtt5Client struct {
+	manager  *autopaho.ConnectionManager
+	options  *mqtt.ClientOptions
+	handlers *Handlers
+	// routes are the handlers of the subscribed topic filters, messages no route matches go to the received handler
+	routes    map[string]mqtt.MessageHandler
+	routeLock sync.Mutex
+	// subscriptions are made again on connections without a session
+	subscriptions subscriptionList
+	connected     atomic.Bool
+	// connUp is closed once the first connection is up
+	connUp   chan struct{}
+	upOnce   sync.Once
+	lostOnce atomic.Pointer[sync.Once]
+}
+
+// initMQTT5 connects over MQTT 5 with the same settings as the MQTT 3.1.1 client in opts.
+func initMQTT5(opts *mqtt.ClientOptions, handlers *Handlers) mqtt.Client {
+	client := &mqtt5Client{
+		options:  opts,
+		handlers: handlers,
+		routes:   make(map[string]mqtt.MessageHandler),
+		connUp:   make(chan struct{}),
+	}
+	config, err := client.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client.manager, err = autopaho.NewConnection(context.Background(), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatal(token.Error())
+	}
+	return client
+}
+
+func (c *mqtt5Client) config() (autopaho.ClientConfig, error) {
+	reader := mqtt.NewOptionsReader(c.options)
+	config := autopaho.ClientConfig{
+		ServerUrls:                    reader.Servers(),
+		TlsCfg:                        reader.TLSConfig(),
+		KeepAlive:                     uint16(reader.KeepAlive().Seconds()),
+		CleanStartOnInitialConnection: reader.CleanSession(),
+		ConnectRetryDelay:             5 * time.Second,
+		OnConnectionUp: func(_ *autopaho.ConnectionManager, connack *paho.Connack) {
+			if !connack.SessionPresent {
+				// The broker lost the session or another client with the same ID ended it
+				go c.resubscribe()
+			}
+			c.connected.Store(true)
+			c.lostOnce.Store(new(sync.Once))
+			c.upOnce.Do(func() { close(c.connUp) })
+			if c.handlers.OnConnectHandler != nil {
+				c.handlers.OnConnectHandler(c)
+			}
+		},
+		OnConnectError: func(err error) {
+			slog.Error("[MQTT] Could not connect: " + err.Error())
+		},
+		ConnectPacketBuilder: func(connect *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			// Left out, this defaults to true, but set to false along with the other properties brokers
+			// leave the user properties out of the messages they send
+			if connect.Properties != nil {
+				connect.Properties.RequestProblemInfo = true
+			}
+			return connect, nil
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:           reader.ClientID(),
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){c.received},
+			OnClientError:      c.lost,
+			OnServerDisconnect: func(d *paho.Disconnect) { c.lost(fmt.Errorf("disconnected by the broker, reason %d", d.ReasonCode)) },
+		},
+	}
+	if username := reader.Username(); username != "" {
+		config.ConnectUsername = username
+		config.ConnectPassword = []byte(reader.Password())
+	}
+	if reader.WillEnabled() {
+		config.WillMessage = &paho.WillMessage{
+			Topic:   reader.WillTopic(),
+			Payload: reader.WillPayload(),
+			QoS:     reader.WillQos(),
+			Retain:  reader.WillRetained(),
+		}
+	}
+	if c.handlers.storeDir != "" {
+		// Keep the session for as long as the broker allows
+		config.SessionExpiryInterval = math.MaxUint32
+		config.EnableManualAcknowledgment = true
+		config.SendAcksInterval = ackInterval
+		session, err := fileSession(c.handlers.storeDir)
+		if err != nil {
+			return config, err
+		}
+		config.Session = session
+	}
+	return config, nil
+}
+
+// fileSession keeps the in-flight messages of both directions in storeDir.
+func fileSession(storeDir string) (*state.State, error) {
+	dir := filepath.Join(storeDir, "mqtt5")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create the MQTT store: %w", err)
+	}
+	clientStore, err := storefile.New(dir, "client_", ".msg")
+	if err != nil {
+		return nil, err
+	}
+	serverStore, err := storefile.New(dir, "server_", ".msg")
+	if err != nil {
+		return nil, err
+	}
+	return state.New(clientStore, serverStore), nil
+}
+
+// lost reports a lost connection once per connection.
+func (c *mqtt5Client) lost(err error) {
+	once := c.lostOnce.Load()
+	if once == nil {
+		return
+	}
+	once.Do(func() {
+		c.connected.Store(false)
+		if c.handlers.OnConnectionLostHandler != nil {
+			c.handlers.OnConnectionLostHandler(c, err)
+		}
+	})
+}
+
+// received runs the handlers of a message on paho's goroutine, one message after the other like the MQTT 3.1.1
+// client does. A handler that has to wait hands the message to another goroutine, or nothing else is delivered meanwhile.
+func (c *mqtt5Client) received(received paho.PublishReceived) (bool, error) {
+	msg := &mqtt5Message{packet: received.Packet, client: received.Client}
+	c.routeLock.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range c.routes {
+		if topicMatches(filter, msg.Topic()) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.routeLock.Unlock()
+	if len(handlers) == 0 && c.handlers.OnReceivedMessageHandler != nil {
+		handlers = append(handlers, c.handlers.OnReceivedMessageHandler)
+	}
+	for _, handler := range handlers {
+		handler(c, msg)
+	}
+	return true, nil
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqtt5Client) IsConnectionOpen() bool {
+	return c.connected.Load()
+}
+
+// Connect waits for the first connection, the connection manager connects and reconnects by itself.
+func (c *mqtt5Client) Connect() mqtt.Token {
+	reader := mqtt.NewOptionsReader(c.options)
+	timeout := reader.ConnectTimeout()
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return goToken(func() error {
+		select {
+		case <-c.connUp:
+			return nil
+		case <-time.After(timeout):
+			return fmt.Errorf("could not connect to the MQTT server within %s", timeout)
+		}
+	})
+}
+
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond+time.Second)
+	defer cancel()
+	if c.handlers.storeDir != "" && quiesce > 0 {
+		// Let the acks already given go out, or the broker sends their messages again
+		time.Sleep(min(2*ackInterval, time.Duration(quiesce)*time.Millisecond))
+	}
+	c.manager.Disconnect(ctx)
+	c.connected.Store(false)
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var body []byte
+	switch p := payload.(type) {
+	case []byte:
+		body = p
+	case string:
+		body = []byte(p)
+	default:
+		return failedToken(fmt.Errorf("unknown payload type %T", payload))
+	}
+	return c.publish(topic, qos, retained, body, nil)
+}
+
+// publish doesn't block, so that it can be used from a message handler.
+func (c *mqtt5Client) publish(topic string, qos byte, retained bool, payload []byte, properties *MessageProperties) mqtt.Token {
+	packet := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload}
+	if properties != nil {
+		packet.Properties = &paho.PublishProperties{
+			ResponseTopic:   properties.ResponseTopic,
+			CorrelationData: properties.CorrelationData,
+		}
+		if properties.MessageExpiry > 0 {
+			expiry := uint32(properties.MessageExpiry.Round(time.Second) / time.Second)
+			packet.Properties.MessageExpiry = &expiry
+		}
+		keys := make([]string, 0, len(properties.UserProperties))
+		for key := range properties.UserProperties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			packet.Properties.User.Add(key, properties.UserProperties[key])
+		}
+	}
+	return goToken(func() error {
+		response, err := c.manager.Publish(context.Background(), packet)
+		if err != nil {
+			return err
+		}
+		if response != nil && response.ReasonCode >= 0x80 {
+			return fmt.Errorf("publish to %s refused, reason %d", topic, response.ReasonCode)
+		}
+		return nil
+	})
+}
+
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *mqtt5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.subscriptions.add(filters, nil)
+	subscribe := &paho.Subscribe{}
+	for topic, qos := range filters {
+		if callback != nil {
+			c.AddRoute(topic, callback)
+		}
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	return goToken(func() error {
+		suback, err := c.manager.Subscribe(context.Background(), subscribe)
+		if err != nil {
+			return err
+		}
+		for i, reason := range suback.Reasons {
+			if reason >= 0x80 {
+				return fmt.Errorf("subscription to %s refused, reason %d", subscribe.Subscriptions[i].Topic, reason)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *mqtt5Client) Unsubscribe(topics ...string) mqtt.Token {
+	c.subscriptions.remove(topics)
+	c.routeLock.Lock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	c.routeLock.Unlock()
+	return goToken(func() error {
+		_, err := c.manager.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+// resubscribe makes the subscriptions made so far again, their handlers are still routed.
+func (c *mqtt5Client) resubscribe() {
+	subscribe := &paho.Subscribe{}
+	for topic, subscription := range c.subscriptions.all() {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: subscription.qos})
+	}
+	if len(subscribe.Subscriptions) == 0 {
+		return
+	}
+	if _, err := c.manager.Subscribe(context.Background(), subscribe); err != nil {
+		slog.Error("[MQTT] Could not subscribe again: " + err.Error())
+	}
+}
+
+func (c *mqtt5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.routeLock.Lock()
+	defer c.routeLock.Unlock()
+	c.routes[topic] = callback
+}
+
+func (c *mqtt5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewOptionsReader(c.options)
+}
+
+// mqtt5Message is a message received over MQTT 5.
+type mqtt5Message struct {
+	packet *paho.Publish
+	client *paho.Client
+}
+
+func (m *mqtt5Message) Duplicate() bool   { return m.packet.Duplicate() }
+func (m *mqtt5Message) Qos() byte         { return m.packet.QoS }
+func (m *mqtt5Message) Retained() bool    { return m.packet.Retain }
+func (m *mqtt5Message) Topic() string     { return m.packet.Topic }
+func (m *mqtt5Message) MessageID() uint16 { return m.packet.PacketID }
+func (m *mqtt5Message) Payload() []byte   { return m.packet.Payload }
+
+// Ack acknowledges the message, only needed with a persistent session.
+func (m *mqtt5Message) Ack() {
+	if err := m.client.Ack(m.packet); err != nil && !errors.Is(err, paho.ErrManualAcknowledgmentDisabled) {
+		slog.Error("[MQTT] Could not acknowledge a message: " + err.Error())
+	}
+}
+
+// mqtt5Token completes once fn returns.
+type mqtt5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func goToken(fn func() error) *mqtt5Token {
+	token := &mqtt5Token{done: make(chan struct{})}
+	go func() {
+		token.err = fn()
+		close(token.done)
+	}()
+	return token
+}
+
+func failedToken(err error) *mqtt5Token {
+	token := &mqtt5Token{done: make(chan struct{}), err: err}
+	close(token.done)
+	return token
+}
+
+func (t *mqtt5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqtt5Token) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *mqtt5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// topicMatches tells whether topic matches the subscription filter, with its + and # wildcards.
+func topicMatches(filter string, topic string) bool {
+	// A shared subscription gets the messages of the filter that follows its group
+	if rest, shared := strings.CutPrefix(filter, "$share/"); shared {
+		if _, sharedFilter, found := strings.Cut(rest, "/"); found {
+			filter = sharedFilter
+		}
+	}
+	// Topics like $SYS are left out of wildcards at the first level
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
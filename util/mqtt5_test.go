@@ -0,0 +1,247 @@
+package util
+
+import (
+	"errors"
+	"path/filepath"
+	"seedstore/types"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"queue", "queue", true},
+		{"queue", "queue/movies", false},
+		{"queue/+", "queue/movies", true},
+		{"queue/+", "queue", false},
+		{"queue/+/done", "queue/movies/done", true},
+		{"queue/#", "queue", true},
+		{"queue/#", "queue/movies/4k", true},
+		{"#", "queue/movies", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"$share/boxes/queue", "queue", true},
+		{"$share/boxes/queue/+", "queue/movies", true},
+		{"$share/boxes/queue", "boxes/queue", false},
+	}
+	for _, test := range tests {
+		if got := topicMatches(test.filter, test.topic); got != test.want {
+			t.Errorf("Expected %s matching %s to be %v", test.filter, test.topic, test.want)
+		}
+	}
+}
+
+func TestMQTT5Properties(t *testing.T) {
+	port := startBroker(t)
+	viper.Reset()
+	viper.Set("mqtt.host", "127.0.0.1")
+	viper.Set("mqtt.port", port)
+	viper.Set("mqtt.protocolVersion", 5)
+
+	received := make(chan mqtt.Message, 1)
+	viper.Set("mqtt.clientId", "subscriber")
+	subscriber := InitMQTTWithHandlers(nil, nil, nil)
+	defer subscriber.Disconnect(250)
+	if token := subscriber.Subscribe("queue/+", 1, func(client mqtt.Client, msg mqtt.Message) { received <- msg }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	viper.Set("mqtt.clientId", "publisher")
+	publisher := InitMQTTDefault()
+	defer publisher.Disconnect(250)
+	token := PublishWithProperties(publisher, "queue/movies", 1, false, []byte("payload"), MessageProperties{
+		ResponseTopic:   "replies",
+		CorrelationData: []byte("42"),
+		MessageExpiry:   time.Hour,
+		UserProperties:  map[string]string{"schemaVersion": "1"},
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	select {
+	case msg := <-received:
+		if msg.Topic() != "queue/movies" || string(msg.Payload()) != "payload" {
+			t.Errorf("Expected the payload on queue/movies, got %s on %s", msg.Payload(), msg.Topic())
+		}
+		properties, ok := Properties(msg)
+		if !ok {
+			t.Fatal("Expected MQTT 5 properties")
+		}
+		if properties.ResponseTopic != "replies" || string(properties.CorrelationData) != "42" {
+			t.Errorf("Expected the response topic and correlation data, got %+v", properties)
+		}
+		if properties.MessageExpiry <= 0 || properties.MessageExpiry > time.Hour {
+			t.Errorf("Expected what is left of an hour as expiry, got %s", properties.MessageExpiry)
+		}
+		if properties.UserProperties["schemaVersion"] != "1" {
+			t.Errorf("Expected the schemaVersion user property, got %v", properties.UserProperties)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message")
+	}
+}
+
+func TestMQTT5SessionAndExpiry(t *testing.T) {
+	port := startBroker(t)
+	storeDir := filepath.Join(t.TempDir(), "mqtt")
+	viper.Reset()
+	viper.Set("mqtt.host", "127.0.0.1")
+	viper.Set("mqtt.port", port)
+	viper.Set("mqtt.protocolVersion", 5)
+
+	viper.Set("mqtt.clientId", "subscriber")
+	received := make(chan string, 10)
+	properties := make(chan MessageProperties, 10)
+	onMessage := func(client mqtt.Client, msg mqtt.Message) {
+		received <- string(msg.Payload())
+		if p, ok := Properties(msg); ok {
+			properties <- p
+		}
+		msg.Ack()
+	}
+	subscriber := InitMQTTSession(storeDir, nil, onMessage, nil, nil)
+	if token := subscriber.Subscribe("queue", 1, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	subscriber.Disconnect(250)
+
+	// Published while the subscriber is down, the first one goes stale before it is back
+	viper.Set("mqtt.clientId", "publisher")
+	publisher := InitMQTTDefault()
+	expiring := PublishWithProperties(publisher, "queue", 1, false, []byte("stale"), MessageProperties{MessageExpiry: time.Second})
+	if expiring.Wait() && expiring.Error() != nil {
+		t.Fatal(expiring.Error())
+	}
+	fresh := PublishWithProperties(publisher, "queue", 1, false, []byte("fresh"), MessageProperties{UserProperties: map[string]string{"schemaVersion": "1"}})
+	if fresh.Wait() && fresh.Error() != nil {
+		t.Fatal(fresh.Error())
+	}
+	publisher.Disconnect(250)
+	// The broker counts the expiry in whole seconds and drops expired messages once a second
+	time.Sleep(3 * time.Second)
+
+	viper.Set("mqtt.clientId", "subscriber")
+	subscriber = InitMQTTSession(storeDir, nil, onMessage, nil, nil)
+	defer subscriber.Disconnect(250)
+	select {
+	case payload := <-received:
+		if payload != "fresh" {
+			t.Errorf("Expected only the fresh message, got %s", payload)
+		}
+		// A session sends connect properties, which must not keep the broker from passing on user properties
+		if p := <-properties; p.UserProperties["schemaVersion"] != "1" {
+			t.Errorf("Expected the user properties over a session, got %v", p.UserProperties)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message")
+	}
+	select {
+	case payload := <-received:
+		t.Errorf("Expected the stale message to expire, got %s", payload)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestPublishWithPropertiesNeedsMQTT5(t *testing.T) {
+	port := startBroker(t)
+	viper.Reset()
+	viper.Set("mqtt.host", "127.0.0.1")
+	viper.Set("mqtt.port", port)
+	client := InitMQTTDefault()
+	defer client.Disconnect(250)
+	token := PublishWithProperties(client, "queue", 1, false, []byte("payload"), MessageProperties{ResponseTopic: "replies"})
+	token.Wait()
+	if !errors.Is(token.Error(), ErrNotMQTT5) {
+		t.Errorf("Expected ErrNotMQTT5, got %v", token.Error())
+	}
+
+	viper.Set("mqtt.protocolVersion", 6)
+	if _, err := ProtocolVersion(); err == nil {
+		t.Error("Expected an error for MQTT 6")
+	}
+}
+
+func TestMQTT5RedeliveryAfterStoreFailure(t *testing.T) {
+	port := startBroker(t)
+	dir := t.TempDir()
+	viper.Reset()
+	viper.Set("mqtt.host", "127.0.0.1")
+	viper.Set("mqtt.port", port)
+	viper.Set("mqtt.protocolVersion", 5)
+
+	// The journal can't be written until it is opened again
+	var lock sync.Mutex
+	journal, err := OpenJournal(filepath.Join(dir, "jobs.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	failed := make(chan struct{}, 1)
+	// Handled the way the subscriber does: only acked once it is stored
+	onMessage := func(client mqtt.Client, msg mqtt.Message) {
+		payload := string(msg.Payload())
+		lock.Lock()
+		err := journal.Put(types.Job{ID: payload, Message: types.MQTTMessage{Name: payload}})
+		lock.Unlock()
+		if err != nil {
+			failed <- struct{}{}
+			return
+		}
+		msg.Ack()
+	}
+	viper.Set("mqtt.clientId", "subscriber")
+	subscriber := InitMQTTSession(filepath.Join(dir, "mqtt"), nil, onMessage, nil, nil)
+	if token := subscriber.Subscribe("queue", 1, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	viper.Set("mqtt.clientId", "publisher")
+	publisher := InitMQTTDefault()
+	defer publisher.Disconnect(250)
+	if token := publisher.Publish("queue", 1, false, "not stored"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message")
+	}
+	lock.Lock()
+	journal, err = OpenJournal(filepath.Join(dir, "jobs.journal"))
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if token := publisher.Publish("queue", 1, false, "stored"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	waitForJobs := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(journal.Jobs()) < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d jobs stored, got %v", want, journal.Jobs())
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitForJobs(1)
+	subscriber.Disconnect(250)
+
+	// The broker sends it again on the next connection
+	viper.Set("mqtt.clientId", "subscriber")
+	subscriber = InitMQTTSession(filepath.Join(dir, "mqtt"), nil, onMessage, nil, nil)
+	defer subscriber.Disconnect(250)
+	waitForJobs(2)
+}
@@ -0,0 +1,523 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/spf13/viper"
+)
+
+func TestBrokerURL(t *testing.T) {
+	tests := []struct {
+		scheme string
+		port   int
+		path   string
+		want   string
+	}{
+		{"", 0, "", "tcp://broker:1883"},
+		{"ssl", 0, "", "ssl://broker:8883"},
+		{"tcp", 1884, "/mqtt", "tcp://broker:1884"},
+		{"ws", 9001, "mqtt", "ws://broker:9001/mqtt"},
+		{"WSS", 0, "/mqtt", "wss://broker:443/mqtt"},
+	}
+	for _, test := range tests {
+		viper.Reset()
+		viper.Set("mqtt.host", "broker")
+		viper.Set("mqtt.scheme", test.scheme)
+		viper.Set("mqtt.port", test.port)
+		viper.Set("mqtt.path", test.path)
+		got, err := BrokerURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("Expected %s for scheme %q, got %s", test.want, test.scheme, got)
+		}
+	}
+
+	viper.Reset()
+	viper.Set("mqtt.scheme", "quic")
+	if _, err := BrokerURL(); err == nil {
+		t.Error("Expected an error for an unknown scheme")
+	}
+}
+
+func TestMQTTOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, nil, nil, "Test CA")
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	serverCert, serverKey := newCertificate(t, ca, caKey, "broker.test")
+	clientCert, clientKey := newCertificate(t, ca, caKey, "subscriber")
+	writePEM(t, filepath.Join(dir, "client.pem"), "CERTIFICATE", clientCert.Raw)
+	keyBytes, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "client.key"), "EC PRIVATE KEY", keyBytes)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	port := startTLSBroker(t, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+
+	tests := []struct {
+		name     string
+		settings map[string]any
+		connects bool
+	}{
+		{"trusted", map[string]any{"ca": "ca.pem", "serverName": "broker.test", "cert": "client.pem", "key": "client.key"}, true},
+		{"unknown authority", map[string]any{"serverName": "broker.test", "cert": "client.pem", "key": "client.key"}, false},
+		{"wrong server name", map[string]any{"ca": "ca.pem", "cert": "client.pem", "key": "client.key"}, false},
+		{"insecure", map[string]any{"insecureSkipVerify": true, "cert": "client.pem", "key": "client.key"}, true},
+		{"no client certificate", map[string]any{"ca": "ca.pem", "serverName": "broker.test"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Reset()
+			viper.Set("mqtt.scheme", "ssl")
+			viper.Set("mqtt.host", "127.0.0.1")
+			viper.Set("mqtt.port", port)
+			viper.Set("mqtt.clientId", "test")
+			for key, value := range test.settings {
+				if file, ok := value.(string); ok && key != "serverName" {
+					value = filepath.Join(dir, file)
+				}
+				viper.Set("mqtt.tls."+key, value)
+			}
+			opts, err := MQTTOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.SetConnectTimeout(5 * time.Second)
+			opts.SetAutoReconnect(false)
+			client := mqtt.NewClient(opts)
+			token := client.Connect()
+			if !token.WaitTimeout(10 * time.Second) {
+				t.Fatal("Timed out connecting")
+			}
+			if test.connects && token.Error() != nil {
+				t.Fatalf("Expected to connect, got %v", token.Error())
+			}
+			if !test.connects && token.Error() == nil {
+				t.Fatal("Expected the connection to be refused")
+			}
+			client.Disconnect(0)
+		})
+	}
+
+	viper.Reset()
+	viper.Set("mqtt.scheme", "ssl")
+	viper.Set("mqtt.tls.cert", filepath.Join(dir, "client.pem"))
+	if _, err := MQTTOptions(); err == nil {
+		t.Error("Expected an error for a client certificate without a key")
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	port := startBroker(t)
+	storeDir := filepath.Join(t.TempDir(), "mqtt")
+	viper.Reset()
+	viper.Set("mqtt.host", "127.0.0.1")
+	viper.Set("mqtt.port", port)
+
+	viper.Set("mqtt.clientId", "subscriber")
+	received := make(chan string, 10)
+	onMessage := func(client mqtt.Client, msg mqtt.Message) {
+		received <- string(msg.Payload())
+		msg.Ack()
+	}
+	subscriber := InitMQTTSession(storeDir, nil, onMessage, nil, nil)
+	if token := subscriber.Subscribe("queue", 1, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	subscriber.Disconnect(250)
+
+	// Published while the subscriber is down
+	viper.Set("mqtt.clientId", "publisher")
+	opts, err := MQTTOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := mqtt.NewClient(opts)
+	if token := publisher.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	for _, payload := range []string{"first", "second", "third"} {
+		if token := publisher.Publish("queue", 1, false, payload); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+	publisher.Disconnect(250)
+
+	// Back without subscribing again
+	viper.Set("mqtt.clientId", "subscriber")
+	subscriber = InitMQTTSession(storeDir, nil, onMessage, nil, nil)
+	// The broker may send them again in any order
+	got := make(map[string]bool)
+	for len(got) < 3 {
+		select {
+		case payload := <-received:
+			got[payload] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the messages, got %v", got)
+		}
+	}
+	for _, want := range []string{"first", "second", "third"} {
+		if !got[want] {
+			t.Errorf("Expected %s after reconnecting, got %v", want, got)
+		}
+	}
+
+	subscriber.Disconnect(250)
+
+	// Not acked, as if the subscriber crashed before storing it
+	publisher = mqtt.NewClient(opts)
+	if token := publisher.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := publisher.Publish("queue", 1, false, "unacked"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	publisher.Disconnect(250)
+	dropped := make(chan string, 1)
+	subscriber = InitMQTTSession(storeDir, nil, func(client mqtt.Client, msg mqtt.Message) { dropped <- string(msg.Payload()) }, nil, nil)
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message")
+	}
+	subscriber.Disconnect(250)
+	subscriber = InitMQTTSession(storeDir, nil, onMessage, nil, nil)
+	defer subscriber.Disconnect(250)
+	select {
+	case payload := <-received:
+		if payload != "unacked" {
+			t.Errorf("Expected the message that wasn't acked again, got %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the message that wasn't acked")
+	}
+
+	viper.Set("mqtt.clientId", "")
+	if err := persistSession(mqtt.NewClientOptions(), storeDir); err == nil {
+		t.Error("Expected a persistent session to require a client ID")
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("MQTT %d", version), func(t *testing.T) {
+			port := startBroker(t)
+			viper.Reset()
+			viper.Set("mqtt.host", "127.0.0.1")
+			viper.Set("mqtt.port", port)
+			viper.Set("mqtt.protocolVersion", version)
+
+			type delivery struct{ box, payload string }
+			received := make(chan delivery, 20)
+			for _, box := range []string{"box-a", "box-b"} {
+				viper.Set("mqtt.clientId", box)
+				subscriber := InitMQTTSession(filepath.Join(t.TempDir(), box), nil, func(client mqtt.Client, msg mqtt.Message) {
+					received <- delivery{box, string(msg.Payload())}
+					msg.Ack()
+				}, nil, nil)
+				defer subscriber.Disconnect(250)
+				if token := subscriber.Subscribe("$share/boxes/queue", 1, nil); token.Wait() && token.Error() != nil {
+					t.Fatal(token.Error())
+				}
+			}
+
+			viper.Set("mqtt.clientId", "publisher")
+			publisher := InitMQTTDefault()
+			defer publisher.Disconnect(250)
+			for i := range 10 {
+				if token := publisher.Publish("queue", 1, false, strconv.Itoa(i)); token.Wait() && token.Error() != nil {
+					t.Fatal(token.Error())
+				}
+			}
+
+			// Each message goes to one of the boxes only
+			seen := make(map[string]string)
+			for range 10 {
+				select {
+				case got := <-received:
+					if box, found := seen[got.payload]; found {
+						t.Errorf("Expected message %s once, got it on %s and %s", got.payload, box, got.box)
+					}
+					seen[got.payload] = got.box
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Timed out with %d of 10 messages", len(seen))
+				}
+			}
+			select {
+			case got := <-received:
+				t.Errorf("Expected no more messages, got %s on %s", got.payload, got.box)
+			case <-time.After(250 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestSharedClientID(t *testing.T) {
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("MQTT %d", version), func(t *testing.T) {
+			port := startBroker(t)
+			viper.Reset()
+			viper.Set("mqtt.host", "127.0.0.1")
+			viper.Set("mqtt.port", port)
+			viper.Set("mqtt.protocolVersion", version)
+			viper.Set("mqtt.clientId", "box")
+
+			received := make(chan string, 20)
+			lost := make(chan error, 1)
+			subscriber := InitMQTTSession(filepath.Join(t.TempDir(), "mqtt"), nil, func(client mqtt.Client, msg mqtt.Message) {
+				received <- string(msg.Payload())
+				msg.Ack()
+			}, func(client mqtt.Client, err error) {
+				select {
+				case lost <- err:
+				default:
+				}
+			}, nil)
+			defer subscriber.Disconnect(250)
+			if token := subscriber.Subscribe("queue", 1, nil); token.Wait() && token.Error() != nil {
+				t.Fatal(token.Error())
+			}
+
+			// The commands publish with the config of the subscriber
+			publisher := InitMQTTDefault()
+			defer publisher.Disconnect(250)
+			if token := publisher.Publish("queue", 1, false, "shared"); token.Wait() && token.Error() != nil {
+				t.Fatal(token.Error())
+			}
+			select {
+			case payload := <-received:
+				if payload != "shared" {
+					t.Errorf("Expected shared, got %s", payload)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for the message")
+			}
+			select {
+			case err := <-lost:
+				t.Fatalf("Expected the subscriber to stay connected, lost the connection: %v", err)
+			case <-time.After(250 * time.Millisecond):
+			}
+
+			// Another client with the same ID and a clean session ends the session of the subscriber
+			opts, err := MQTTOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.SetAutoReconnect(false)
+			intruder := mqtt.NewClient(opts)
+			if token := intruder.Connect(); token.Wait() && token.Error() != nil {
+				t.Fatal(token.Error())
+			}
+			intruder.Disconnect(250)
+
+			// Published until the subscriber is back and subscribed again
+			deadline := time.After(20 * time.Second)
+			for {
+				if token := publisher.Publish("queue", 1, false, "after"); token.Wait() && token.Error() != nil {
+					t.Fatal(token.Error())
+				}
+				select {
+				case payload := <-received:
+					if payload != "after" {
+						t.Fatalf("Expected after, got %s", payload)
+					}
+					return
+				case <-time.After(500 * time.Millisecond):
+				case <-deadline:
+					t.Fatal("Timed out waiting for the subscriber to subscribe again")
+				}
+			}
+		})
+	}
+}
+
+func TestOrderedAcks(t *testing.T) {
+	var sent []uint16
+	acks := new(orderedAcks)
+	messages := make([]mqtt.Message, 3)
+	for i := range messages {
+		messages[i] = acks.add(&fakeMessage{id: uint16(i + 1), qos: 1, sent: &sent})
+	}
+	// QoS 0 messages have no ack to wait for
+	acks.add(&fakeMessage{id: 9, sent: &sent}).Ack()
+
+	messages[2].Ack()
+	messages[1].Ack()
+	if fmt.Sprint(sent) != "[9]" {
+		t.Fatalf("Expected the acks held back until the first message is acked, sent %v", sent)
+	}
+	messages[0].Ack()
+	if fmt.Sprint(sent) != "[9 1 2 3]" {
+		t.Errorf("Expected the acks in the order the messages arrived, got %v", sent)
+	}
+}
+
+// fakeMessage records its ack in sent.
+type fakeMessage struct {
+	id   uint16
+	qos  byte
+	sent *[]uint16
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return m.qos }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return "queue" }
+func (m *fakeMessage) MessageID() uint16 { return m.id }
+func (m *fakeMessage) Payload() []byte   { return nil }
+func (m *fakeMessage) Ack()              { *m.sent = append(*m.sent, m.id) }
+
+func TestMQTTQoS(t *testing.T) {
+	viper.Reset()
+	if qos, err := MQTTQoS(); err != nil || qos != 1 {
+		t.Errorf("Expected QoS 1 by default, got %d, %v", qos, err)
+	}
+	viper.Set("mqtt.qos", 0)
+	if qos, err := MQTTQoS(); err != nil || qos != 0 {
+		t.Errorf("Expected QoS 0, got %d, %v", qos, err)
+	}
+	viper.Set("mqtt.qos", 3)
+	if _, err := MQTTQoS(); err == nil {
+		t.Error("Expected an error for QoS 3")
+	}
+}
+
+// startBroker runs an MQTT broker on a free local port.
+func startBroker(t *testing.T) int {
+	_, port := startBrokerServer(t)
+	return port
+}
+
+// startBrokerServer also returns the broker, for tests that need to act on its side.
+func startBrokerServer(t *testing.T) (*broker.Server, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	server, err := NewBroker(BrokerOptions{Listen: listener.Addr().String(), Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server, port
+}
+
+// startTLSBroker stands in for a broker: it completes the TLS handshake and accepts every CONNECT.
+func startTLSBroker(t *testing.T, config *tls.Config) int {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if readPacket(conn) != 0x10 {
+					return
+				}
+				// CONNACK, session not present, connection accepted
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+				for readPacket(conn) != 0 {
+				}
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// readPacket reads an MQTT control packet and returns its type, or 0 once the connection is closed.
+func readPacket(conn net.Conn) byte {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0
+	}
+	length, multiplier := 0, 1
+	for {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return 0
+		}
+		length += int(b[0]&0x7f) * multiplier
+		if b[0]&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(length)); err != nil {
+		return 0
+	}
+	return header[0] & 0xf0
+}
+
+// newCertificate issues a certificate for name, self-signed when parent is nil.
+func newCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
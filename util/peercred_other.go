@@ -0,0 +1,17 @@
+//go:build !linux
+
+package util
+
+import (
+	"net"
+	"os"
+)
+
+// hasPeerCredentials tells whether peerUID can tell users apart
+const hasPeerCredentials = false
+
+// peerUID can't read the credentials of the peer on this platform, so the
+// permissions of the socket are all that keeps other users out.
+func peerUID(conn net.Conn) (int, error) {
+	return os.Getuid(), nil
+}
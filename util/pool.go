@@ -0,0 +1,125 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// PoolLimits caps how many transfers may run at once. A zero or missing
+// limit means that dimension is unbounded, except MaxConcurrent which
+// defaults to a single transfer.
+type PoolLimits struct {
+	MaxConcurrent int
+	PerCode       map[string]int
+	PerServer     map[string]int
+}
+
+// WorkerPool runs transfers concurrently while respecting a global limit as
+// well as per-code and per-server limits.
+type WorkerPool struct {
+	limits   PoolLimits
+	active   int
+	byCode   map[string]int
+	byServer map[string]int
+	// freed receives a value whenever a running transfer finishes
+	freed chan struct{}
+	wg    sync.WaitGroup
+	// Mutual exclusion lock
+	lock sync.Mutex
+}
+
+func NewWorkerPool(limits PoolLimits) *WorkerPool {
+	if limits.MaxConcurrent <= 0 {
+		limits.MaxConcurrent = 1
+	}
+	return &WorkerPool{
+		limits:   PoolLimits{MaxConcurrent: limits.MaxConcurrent, PerCode: lowerKeys(limits.PerCode), PerServer: lowerKeys(limits.PerServer)},
+		byCode:   make(map[string]int),
+		byServer: make(map[string]int),
+		freed:    make(chan struct{}, 1),
+	}
+}
+
+// TryGo starts fn in a new goroutine if there is capacity for the given code
+// and server, returning false without blocking otherwise. The context passed
+// to fn is the one given here, so cancelling it stops the transfer.
+func (p *WorkerPool) TryGo(ctx context.Context, code string, server string, fn func(ctx context.Context)) bool {
+	code = strings.ToLower(code)
+	server = strings.ToLower(server)
+	p.lock.Lock()
+	if !p.hasCapacity(code, server) {
+		p.lock.Unlock()
+		return false
+	}
+	p.active++
+	p.byCode[code]++
+	p.byServer[server]++
+	p.wg.Add(1)
+	p.lock.Unlock()
+
+	go func() {
+		defer p.release(code, server)
+		fn(ctx)
+	}()
+	return true
+}
+
+// HasCapacity reports whether a transfer for code and server could start now.
+func (p *WorkerPool) HasCapacity(code string, server string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.hasCapacity(strings.ToLower(code), strings.ToLower(server))
+}
+
+func (p *WorkerPool) hasCapacity(code string, server string) bool {
+	if p.active >= p.limits.MaxConcurrent {
+		return false
+	}
+	if limit, ok := p.limits.PerCode[code]; ok && limit > 0 && p.byCode[code] >= limit {
+		return false
+	}
+	if limit, ok := p.limits.PerServer[server]; ok && limit > 0 && p.byServer[server] >= limit {
+		return false
+	}
+	return true
+}
+
+func (p *WorkerPool) release(code string, server string) {
+	p.lock.Lock()
+	p.active--
+	p.byCode[code]--
+	p.byServer[server]--
+	p.lock.Unlock()
+	p.wg.Done()
+	// Never block a worker on a slow dispatcher, one pending signal is enough
+	select {
+	case p.freed <- struct{}{}:
+	default:
+	}
+}
+
+// Freed returns a channel that is signalled whenever a slot frees up.
+func (p *WorkerPool) Freed() <-chan struct{} {
+	return p.freed
+}
+
+// Active returns the number of running transfers.
+func (p *WorkerPool) Active() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.active
+}
+
+// Wait blocks until every running transfer has returned.
+func (p *WorkerPool) Wait() {
+	p.wg.Wait()
+}
+
+func lowerKeys(m map[string]int) map[string]int {
+	lowered := make(map[string]int, len(m))
+	for k, v := range m {
+		lowered[strings.ToLower(k)] = v
+	}
+	return lowered
+}
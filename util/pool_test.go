@@ -0,0 +1,101 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolGlobalLimit(t *testing.T) {
+	pool := NewWorkerPool(PoolLimits{MaxConcurrent: 2})
+	block := make(chan struct{})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if !pool.TryGo(ctx, "A", "host", func(ctx context.Context) { <-block }) {
+			t.Fatalf("Expected transfer %d to start", i)
+		}
+	}
+	if pool.TryGo(ctx, "B", "other", func(ctx context.Context) {}) {
+		t.Fatal("Expected the global limit to reject a third transfer")
+	}
+	if pool.Active() != 2 {
+		t.Errorf("Expected 2 active transfers, got %d", pool.Active())
+	}
+
+	close(block)
+	pool.Wait()
+	if pool.Active() != 0 {
+		t.Errorf("Expected 0 active transfers, got %d", pool.Active())
+	}
+}
+
+func TestWorkerPoolPerCodeAndServerLimits(t *testing.T) {
+	pool := NewWorkerPool(PoolLimits{
+		MaxConcurrent: 10,
+		PerCode:       map[string]int{"V": 1},
+		PerServer:     map[string]int{"seedbox": 2},
+	})
+	block := make(chan struct{})
+	defer func() {
+		close(block)
+		pool.Wait()
+	}()
+	ctx := context.Background()
+	wait := func(ctx context.Context) { <-block }
+
+	if !pool.TryGo(ctx, "V", "seedbox", wait) {
+		t.Fatal("Expected the first V transfer to start")
+	}
+	// Codes are matched case-insensitively since viper lowercases map keys
+	if pool.TryGo(ctx, "v", "elsewhere", wait) {
+		t.Fatal("Expected the per-code limit to reject a second V transfer")
+	}
+	if !pool.TryGo(ctx, "A", "seedbox", wait) {
+		t.Fatal("Expected an A transfer to start while V is busy")
+	}
+	if pool.TryGo(ctx, "B", "seedbox", wait) {
+		t.Fatal("Expected the per-server limit to reject a third seedbox transfer")
+	}
+	if !pool.TryGo(ctx, "B", "elsewhere", wait) {
+		t.Fatal("Expected a transfer on another server to start")
+	}
+}
+
+func TestWorkerPoolFreedSignal(t *testing.T) {
+	pool := NewWorkerPool(PoolLimits{MaxConcurrent: 1})
+	pool.TryGo(context.Background(), "A", "host", func(ctx context.Context) {})
+
+	select {
+	case <-pool.Freed():
+	case <-time.After(time.Second):
+		t.Fatal("Expected a freed signal after the transfer finished")
+	}
+	pool.Wait()
+	if !pool.HasCapacity("A", "host") {
+		t.Error("Expected capacity once the transfer finished")
+	}
+}
+
+func TestWorkerPoolCancellation(t *testing.T) {
+	pool := NewWorkerPool(PoolLimits{MaxConcurrent: 3})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var lock sync.Mutex
+	cancelled := 0
+	for i := 0; i < 3; i++ {
+		pool.TryGo(ctx, "A", "host", func(ctx context.Context) {
+			<-ctx.Done()
+			lock.Lock()
+			cancelled++
+			lock.Unlock()
+		})
+	}
+	cancel()
+	pool.Wait()
+
+	if cancelled != 3 {
+		t.Errorf("Expected 3 cancelled transfers, got %d", cancelled)
+	}
+}
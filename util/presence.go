@@ -0,0 +1,51 @@
+package util
+
+import (
+	"encoding/json"
+	"seedstore/types"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// OnlineSubscribers reads the retained presence of the subscribers under filter, a presence topic with a wildcard
+// for the client ID, and returns the ones that are online and take jobs from topic through any of their topics. The
+// broker sends the retained messages right after the subscription, wait is how long to give it. A subscriber whose
+// last heartbeat is older than maxAge counts as offline, it may be stuck or its Last Will may not have been sent yet.
+func OnlineSubscribers(client mqtt.Client, filter string, topic string, wait time.Duration, maxAge time.Duration) ([]types.Presence, error) {
+	var lock sync.Mutex
+	presences := make(map[string]types.Presence)
+	token := client.Subscribe(filter, 1, func(client mqtt.Client, msg mqtt.Message) {
+		defer msg.Ack()
+		var presence types.Presence
+		if err := json.Unmarshal(msg.Payload(), &presence); err != nil {
+			return
+		}
+		lock.Lock()
+		presences[msg.Topic()] = presence
+		lock.Unlock()
+	})
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	time.Sleep(wait)
+	client.Unsubscribe(filter).Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	var online []types.Presence
+	for _, presence := range presences {
+		if presence.Status != types.PresenceOnline || !slices.ContainsFunc(presence.Topics, func(filter string) bool {
+			return topicMatches(filter, topic)
+		}) {
+			continue
+		}
+		if presence.Heartbeat != nil && time.Since(presence.Heartbeat.Time) > maxAge {
+			continue
+		}
+		online = append(online, presence)
+	}
+	return online, nil
+}
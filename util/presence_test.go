@@ -0,0 +1,72 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+func publishPresence(t *testing.T, client mqtt.Client, presence types.Presence) {
+	t.Helper()
+	payload, _ := json.Marshal(presence)
+	if token := client.Publish("presence/"+presence.ClientID, 1, true, payload); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+}
+
+func TestOnlineSubscribers(t *testing.T) {
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("MQTT %d", version), func(t *testing.T) {
+			server, port := startBrokerServer(t)
+			viper.Reset()
+			viper.Set("mqtt.host", "127.0.0.1")
+			viper.Set("mqtt.port", port)
+			viper.Set("mqtt.protocolVersion", version)
+
+			viper.Set("mqtt.clientId", "sub-a")
+			will, _ := json.Marshal(types.Presence{ClientID: "sub-a", Status: types.PresenceOffline, Topics: []string{"other", "queue/+"}})
+			subscriber := InitMQTTSession(filepath.Join(t.TempDir(), "mqtt"), &Will{Topic: "presence/sub-a", Payload: will, Retained: true}, nil, nil, nil)
+			defer subscriber.Disconnect(250)
+			heartbeat := &types.Heartbeat{Time: time.Now()}
+			publishPresence(t, subscriber, types.Presence{ClientID: "sub-a", Status: types.PresenceOnline, Topics: []string{"other", "queue/+"}, Heartbeat: heartbeat})
+
+			viper.Set("mqtt.clientId", "publisher")
+			publisher := InitMQTTDefault()
+			defer publisher.Disconnect(250)
+			// Online but for another topic, and online on paper but without a heartbeat for an hour
+			publishPresence(t, publisher, types.Presence{ClientID: "sub-b", Status: types.PresenceOnline, Topics: []string{"other"}, Heartbeat: heartbeat})
+			stale := &types.Heartbeat{Time: time.Now().Add(-time.Hour)}
+			publishPresence(t, publisher, types.Presence{ClientID: "sub-c", Status: types.PresenceOnline, Topics: []string{"queue/#"}, Heartbeat: stale})
+
+			online, err := OnlineSubscribers(publisher, "presence/+", "queue/movies", 500*time.Millisecond, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(online) != 1 || online[0].ClientID != "sub-a" {
+				t.Fatalf("Expected only sub-a online, got %+v", online)
+			}
+
+			// Cut off without a disconnect, the broker sends the Last Will
+			client, found := server.Clients.Get("sub-a")
+			if !found {
+				t.Fatal("Expected sub-a to be connected")
+			}
+			client.Stop(errors.New("gone"))
+			time.Sleep(250 * time.Millisecond)
+			online, err = OnlineSubscribers(publisher, "presence/+", "queue/movies", 500*time.Millisecond, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(online) != 0 {
+				t.Errorf("Expected the Last Will to take sub-a offline, got %+v", online)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"errors"
+	"seedstore/types"
+	"strings"
+)
+
+// JobOrder returns the Less function for the queue implementing a scheduling
+// policy:
+//   - "fifo" (or empty) keeps the arrival order
+//   - "priority" runs the highest priority first, taken from the message or
+//     else from the code priorities, then the oldest
+//   - "smallest" runs the smallest job first, jobs of unknown size last
+//   - "oldest" runs the job created first, even if it was retried since
+func JobOrder(policy string, codePriorities map[string]int) (func(a, b *types.Job) bool, error) {
+	codePriorities = lowerKeys(codePriorities)
+	switch policy {
+	case "", "fifo":
+		return nil, nil
+	case "priority":
+		return func(a, b *types.Job) bool {
+			pa, pb := jobPriority(a, codePriorities), jobPriority(b, codePriorities)
+			if pa != pb {
+				return pa > pb
+			}
+			return a.CreatedAt.Before(b.CreatedAt)
+		}, nil
+	case "smallest":
+		return func(a, b *types.Job) bool {
+			if a.Message.Size != b.Message.Size {
+				if a.Message.Size <= 0 || b.Message.Size <= 0 {
+					return b.Message.Size <= 0
+				}
+				return a.Message.Size < b.Message.Size
+			}
+			return a.CreatedAt.Before(b.CreatedAt)
+		}, nil
+	case "oldest":
+		return func(a, b *types.Job) bool {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}, nil
+	}
+	return nil, errors.New("unknown scheduling policy: " + policy)
+}
+
+// JobFairKey groups jobs by code so that codes take turns.
+func JobFairKey(job *types.Job) string {
+	return strings.ToLower(job.Code)
+}
+
+func jobPriority(job *types.Job, codePriorities map[string]int) int {
+	if job.Message.Priority != 0 {
+		return job.Message.Priority
+	}
+	return codePriorities[strings.ToLower(job.Code)]
+}
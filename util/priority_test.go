@@ -0,0 +1,43 @@
+package util
+
+import (
+	"context"
+	"seedstore/types"
+	"testing"
+	"time"
+)
+
+func TestJobOrder(t *testing.T) {
+	now := time.Now()
+	small := &types.Job{ID: "small", Code: "A", CreatedAt: now.Add(2 * time.Second), Message: types.MQTTMessage{Size: 10}}
+	big := &types.Job{ID: "big", Code: "V", CreatedAt: now, Message: types.MQTTMessage{Size: 1000}}
+	unknown := &types.Job{ID: "unknown", Code: "V", CreatedAt: now.Add(time.Second)}
+	urgent := &types.Job{ID: "urgent", Code: "V", CreatedAt: now.Add(3 * time.Second), Message: types.MQTTMessage{Priority: 50}}
+
+	cases := map[string][]string{
+		"priority": {"urgent", "small", "big", "unknown"},
+		"smallest": {"small", "big", "unknown", "urgent"},
+		"oldest":   {"big", "unknown", "small", "urgent"},
+	}
+	for policy, expected := range cases {
+		less, err := JobOrder(policy, map[string]int{"A": 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue := NewConcurrentQueue(QueueOptions[*types.Job]{Less: less})
+		// Enqueue in an order that matches none of the policies
+		for _, job := range []*types.Job{unknown, urgent, big, small} {
+			queue.Enqueue(context.Background(), job)
+		}
+		for _, id := range expected {
+			job, _ := queue.TryDequeue()
+			if job.ID != id {
+				t.Errorf("Expected %s next with the %s policy, got %s", id, policy, job.ID)
+			}
+		}
+	}
+
+	if _, err := JobOrder("random", nil); err == nil {
+		t.Error("Expected an unknown policy to be rejected")
+	}
+}
@@ -1,36 +1,432 @@
 package util
 
-import "sync"
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
 
+var (
+	ErrQueueClosed = errors.New("queue is closed")
+	ErrQueueFull   = errors.New("queue is full")
+)
+
+// OverflowPolicy decides what Enqueue does once a bounded queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Enqueue wait until there is room again
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject makes Enqueue fail with ErrQueueFull
+	OverflowReject
+	// OverflowDropOldest evicts the item that was enqueued first
+	OverflowDropOldest
+)
+
+// ParseOverflowPolicy maps the config value to a policy, defaulting to OverflowBlock.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "", "block":
+		return OverflowBlock, nil
+	case "reject":
+		return OverflowReject, nil
+	case "dropOldest":
+		return OverflowDropOldest, nil
+	}
+	return OverflowBlock, errors.New("unknown queue overflow policy: " + s)
+}
+
+type QueueOptions[T any] struct {
+	// Capacity bounds the queue, zero means unbounded
+	Capacity int
+	Overflow OverflowPolicy
+	// OnDrop is called with every item evicted by OverflowDropOldest
+	OnDrop func(item T)
+	// Less orders the queue, items for which it returns true come out first.
+	// Items it considers equal come out in the order they were enqueued, so
+	// without it the queue is FIFO.
+	Less func(a, b T) bool
+	// FairKey groups the items, e.g. by code. When set, consumers take turns
+	// between the groups so a busy group can't starve the others, and Less
+	// only orders the items within a group.
+	FairKey func(item T) string
+}
+
+// ConcurrentQueue is a priority queue that is safe for concurrent use.
+// Consumers block in Dequeue until an item arrives, the queue is closed or
+// their context is cancelled. The zero value is an unbounded, open FIFO queue.
 type ConcurrentQueue[T comparable] struct {
-	// array of items
-	items []T
+	// groups of items, keyed by FairKey, each kept as a heap
+	groups map[string]*queueHeap[T]
+	// ring is the order in which groups take turns, next is whose turn it is
+	ring []string
+	next int
+	size int
+	seq  uint64
+	// front counts down for every item moved to the front, so the last one moved comes out first
+	front int64
+	opts  QueueOptions[T]
+	// changed is closed and replaced whenever the queue changes, waking up
+	// every blocked producer and consumer
+	changed chan struct{}
+	closed  bool
 	// Mutual exclusion lock
 	lock sync.Mutex
 }
 
-func (q *ConcurrentQueue[T]) Enqueue(item T) {
+func NewConcurrentQueue[T comparable](opts QueueOptions[T]) *ConcurrentQueue[T] {
+	return &ConcurrentQueue[T]{opts: opts}
+}
+
+// Enqueue adds an item to the queue, applying the overflow policy when the
+// queue is full. It fails with ErrQueueClosed once Close was called.
+func (q *ConcurrentQueue[T]) Enqueue(ctx context.Context, item T) error {
+	q.lock.Lock()
+	for {
+		if q.closed {
+			q.lock.Unlock()
+			return ErrQueueClosed
+		}
+		if q.opts.Capacity <= 0 || q.size < q.opts.Capacity {
+			break
+		}
+		switch q.opts.Overflow {
+		case OverflowReject:
+			q.lock.Unlock()
+			return ErrQueueFull
+		case OverflowDropOldest:
+			dropped := q.removeOldest()
+			if q.opts.OnDrop != nil {
+				q.opts.OnDrop(dropped)
+			} else {
+				slog.Warn("Queue is full, dropping the oldest item")
+			}
+			continue
+		}
+		if err := q.wait(ctx); err != nil {
+			q.lock.Unlock()
+			return err
+		}
+	}
+	q.push(item)
+	q.broadcast()
+	q.lock.Unlock()
+	return nil
+}
+
+// Dequeue removes the item at the head of the queue, blocking until one is
+// available. Items left when the queue is closed are still handed out, after
+// that it returns ErrQueueClosed.
+func (q *ConcurrentQueue[T]) Dequeue(ctx context.Context) (T, error) {
+	return q.DequeueFunc(ctx, nil)
+}
+
+// DequeueFunc removes the first item for which eligible returns true,
+// blocking until there is one. Eligibility is re-evaluated whenever the queue
+// changes or Wake is called, so callers whose predicate depends on outside
+// state must call Wake when that state changes.
+func (q *ConcurrentQueue[T]) DequeueFunc(ctx context.Context, eligible func(T) bool) (T, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	q.items = append(q.items, item)
+	for {
+		if item, ok := q.take(eligible); ok {
+			return item, nil
+		}
+		if q.closed && q.size == 0 {
+			var zero T
+			return zero, ErrQueueClosed
+		}
+		if err := q.wait(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
 }
 
-func (q *ConcurrentQueue[T]) Dequeue() T {
+// TryDequeue removes the item at the head of the queue without blocking.
+func (q *ConcurrentQueue[T]) TryDequeue() (T, bool) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	item := q.items[0]
-	q.items = q.items[1:]
-	return item
+	return q.take(nil)
+}
+
+// RemoveFunc removes every item for which match returns true and returns them.
+func (q *ConcurrentQueue[T]) RemoveFunc(match func(T) bool) []T {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var removed []T
+	for key, group := range q.groups {
+		kept := group.entries[:0]
+		for _, entry := range group.entries {
+			if match(entry.item) {
+				removed = append(removed, entry.item)
+			} else {
+				kept = append(kept, entry)
+			}
+		}
+		group.entries = kept
+		heap.Init(group)
+		if group.Len() == 0 {
+			q.dropGroup(key)
+		}
+	}
+	q.size -= len(removed)
+	if len(removed) > 0 {
+		q.broadcast()
+	}
+	return removed
+}
+
+// MoveToFront moves the first item for which match returns true to the head of
+// the queue, ahead of whatever Less says, and makes its group the next to take
+// a turn. It reports whether an item matched.
+func (q *ConcurrentQueue[T]) MoveToFront(match func(T) bool) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, key := range q.ring {
+		group := q.groups[key]
+		for j, entry := range group.entries {
+			if !match(entry.item) {
+				continue
+			}
+			q.front--
+			group.entries[j].rank = q.front
+			heap.Fix(group, j)
+			q.next = i
+			q.broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Items returns the items in the order they would be dequeued, leaving the queue as it is.
+func (q *ConcurrentQueue[T]) Items() []T {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	clone := &ConcurrentQueue[T]{
+		groups: make(map[string]*queueHeap[T], len(q.groups)),
+		ring:   append([]string(nil), q.ring...),
+		next:   q.next,
+		size:   q.size,
+	}
+	for key, group := range q.groups {
+		clone.groups[key] = &queueHeap[T]{entries: append([]queueEntry[T](nil), group.entries...), less: group.less}
+	}
+	items := make([]T, 0, q.size)
+	for {
+		item, ok := clone.take(nil)
+		if !ok {
+			return items
+		}
+		items = append(items, item)
+	}
+}
+
+// Wake makes blocked consumers re-evaluate their eligibility predicate.
+func (q *ConcurrentQueue[T]) Wake() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.broadcast()
+}
+
+// Close stops the queue from accepting new items. Blocked producers fail
+// with ErrQueueClosed while consumers can still drain what is left.
+func (q *ConcurrentQueue[T]) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.broadcast()
 }
 
 func (q *ConcurrentQueue[T]) Size() int {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	return len(q.items)
+	return q.size
 }
 
 func (q *ConcurrentQueue[T]) IsEmpty() bool {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	return len(q.items) == 0
+	return q.size == 0
+}
+
+// push must be called with the lock held
+func (q *ConcurrentQueue[T]) push(item T) {
+	key := ""
+	if q.opts.FairKey != nil {
+		key = q.opts.FairKey(item)
+	}
+	if q.groups == nil {
+		q.groups = make(map[string]*queueHeap[T])
+	}
+	group, found := q.groups[key]
+	if !found {
+		group = &queueHeap[T]{less: q.opts.Less}
+		q.groups[key] = group
+		q.ring = append(q.ring, key)
+	}
+	heap.Push(group, queueEntry[T]{item: item, seq: q.seq})
+	q.seq++
+	q.size++
+}
+
+// take removes the best eligible item of the group whose turn it is, moving
+// on to the next groups if it has none. It must be called with the lock held.
+func (q *ConcurrentQueue[T]) take(eligible func(T) bool) (T, bool) {
+	for i := 0; i < len(q.ring); i++ {
+		index := (q.next + i) % len(q.ring)
+		key := q.ring[index]
+		group := q.groups[key]
+		best := group.best(eligible)
+		if best < 0 {
+			continue
+		}
+		entry := heap.Remove(group, best).(queueEntry[T])
+		q.size--
+		if group.Len() == 0 {
+			delete(q.groups, key)
+			q.ring = append(q.ring[:index], q.ring[index+1:]...)
+		} else {
+			index++
+		}
+		q.next = 0
+		if len(q.ring) > 0 {
+			q.next = index % len(q.ring)
+		}
+		q.broadcast()
+		return entry.item, true
+	}
+	var zero T
+	return zero, false
+}
+
+// removeOldest must be called with the lock held on a non-empty queue
+func (q *ConcurrentQueue[T]) removeOldest() T {
+	oldestKey, oldestIndex := "", -1
+	var oldestSeq uint64
+	for key, group := range q.groups {
+		for i, entry := range group.entries {
+			if oldestIndex < 0 || entry.seq < oldestSeq {
+				oldestKey, oldestIndex, oldestSeq = key, i, entry.seq
+			}
+		}
+	}
+	group := q.groups[oldestKey]
+	entry := heap.Remove(group, oldestIndex).(queueEntry[T])
+	q.size--
+	if group.Len() == 0 {
+		q.dropGroup(oldestKey)
+	}
+	return entry.item
+}
+
+// dropGroup removes an empty group without changing whose turn it is. It
+// must be called with the lock held.
+func (q *ConcurrentQueue[T]) dropGroup(key string) {
+	delete(q.groups, key)
+	for i, k := range q.ring {
+		if k == key {
+			q.ring = append(q.ring[:i], q.ring[i+1:]...)
+			if q.next > i {
+				q.next--
+			}
+			break
+		}
+	}
+	if q.next >= len(q.ring) {
+		q.next = 0
+	}
+}
+
+// wait releases the lock until the queue changes or ctx is done. It must be
+// called with the lock held and returns with the lock held.
+func (q *ConcurrentQueue[T]) wait(ctx context.Context) error {
+	if q.changed == nil {
+		q.changed = make(chan struct{})
+	}
+	changed := q.changed
+	q.lock.Unlock()
+	defer q.lock.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// broadcast must be called with the lock held
+func (q *ConcurrentQueue[T]) broadcast() {
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+type queueEntry[T any] struct {
+	item T
+	// seq is the order the item was enqueued in and breaks ties
+	seq uint64
+	// rank is below zero for items moved to the front, which come before any other
+	rank int64
+}
+
+// queueHeap implements heap.Interface for a single group of the queue
+type queueHeap[T any] struct {
+	entries []queueEntry[T]
+	less    func(a, b T) bool
+}
+
+func (h *queueHeap[T]) Len() int { return len(h.entries) }
+
+func (h *queueHeap[T]) Less(i, j int) bool {
+	return h.before(h.entries[i], h.entries[j])
+}
+
+func (h *queueHeap[T]) Swap(i, j int) { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *queueHeap[T]) Push(x any) { h.entries = append(h.entries, x.(queueEntry[T])) }
+
+func (h *queueHeap[T]) Pop() any {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+func (h *queueHeap[T]) before(a, b queueEntry[T]) bool {
+	if a.rank != b.rank {
+		return a.rank < b.rank
+	}
+	if h.less != nil {
+		if h.less(a.item, b.item) {
+			return true
+		}
+		if h.less(b.item, a.item) {
+			return false
+		}
+	}
+	return a.seq < b.seq
+}
+
+// best returns the index of the first eligible entry in heap order, or -1.
+func (h *queueHeap[T]) best(eligible func(T) bool) int {
+	if eligible == nil {
+		if len(h.entries) == 0 {
+			return -1
+		}
+		return 0
+	}
+	best := -1
+	for i, entry := range h.entries {
+		if !eligible(entry.item) {
+			continue
+		}
+		if best < 0 || h.before(entry, h.entries[best]) {
+			best = i
+		}
+	}
+	return best
 }
@@ -1,23 +1,31 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"seedstore/types"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestConcurrentQueue(t *testing.T) {
 	queue := ConcurrentQueue[types.MQTTMessage]{}
+	ctx := context.Background()
 
 	// Test Enqueue and Size
-	queue.Enqueue(types.MQTTMessage{Name: "Test1"})
-	queue.Enqueue(types.MQTTMessage{Name: "Test2"})
+	queue.Enqueue(ctx, types.MQTTMessage{Name: "Test1"})
+	queue.Enqueue(ctx, types.MQTTMessage{Name: "Test2"})
 
 	if queue.Size() != 2 {
 		t.Errorf("Expected queue size 2, got %d", queue.Size())
 	}
 
 	// Test Dequeue
-	item := queue.Dequeue()
+	item, err := queue.Dequeue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if item.Name != "Test1" {
 		t.Errorf("Expected 'Test1', got %s", item.Name)
 	}
@@ -27,8 +35,290 @@ func TestConcurrentQueue(t *testing.T) {
 	}
 
 	// Test IsEmpty
-	queue.Dequeue()
+	queue.Dequeue(ctx)
 	if !queue.IsEmpty() {
 		t.Error("Expected queue to be empty")
 	}
+
+	// Test TryDequeue on an empty queue
+	if _, ok := queue.TryDequeue(); ok {
+		t.Error("Expected TryDequeue to report an empty queue")
+	}
+}
+
+func TestConcurrentQueueBlockingDequeue(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[string]{})
+	result := make(chan string)
+	go func() {
+		item, _ := queue.Dequeue(context.Background())
+		result <- item
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	queue.Enqueue(context.Background(), "late")
+	select {
+	case item := <-result:
+		if item != "late" {
+			t.Errorf("Expected 'late', got %s", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the blocked Dequeue to wake up")
+	}
+}
+
+func TestConcurrentQueueDequeueCancelled(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[string]{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := queue.Dequeue(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+}
+
+func TestConcurrentQueueCloseDrains(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[string]{})
+	ctx := context.Background()
+	queue.Enqueue(ctx, "a")
+	queue.Enqueue(ctx, "b")
+	queue.Close()
+
+	if err := queue.Enqueue(ctx, "c"); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("Expected ErrQueueClosed, got %v", err)
+	}
+	for _, expected := range []string{"a", "b"} {
+		item, err := queue.Dequeue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != expected {
+			t.Errorf("Expected '%s', got %s", expected, item)
+		}
+	}
+	if _, err := queue.Dequeue(ctx); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("Expected ErrQueueClosed once drained, got %v", err)
+	}
+}
+
+func TestConcurrentQueueCloseWakesConsumers(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[string]{})
+	result := make(chan error)
+	go func() {
+		_, err := queue.Dequeue(context.Background())
+		result <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	queue.Close()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrQueueClosed) {
+			t.Errorf("Expected ErrQueueClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close to wake up the blocked Dequeue")
+	}
+}
+
+func TestConcurrentQueueOverflow(t *testing.T) {
+	ctx := context.Background()
+
+	rejecting := NewConcurrentQueue(QueueOptions[int]{Capacity: 1, Overflow: OverflowReject})
+	rejecting.Enqueue(ctx, 1)
+	if err := rejecting.Enqueue(ctx, 2); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	var dropped []int
+	dropping := NewConcurrentQueue(QueueOptions[int]{
+		Capacity: 2,
+		Overflow: OverflowDropOldest,
+		OnDrop:   func(item int) { dropped = append(dropped, item) },
+	})
+	for i := 1; i <= 3; i++ {
+		dropping.Enqueue(ctx, i)
+	}
+	if len(dropped) != 1 || dropped[0] != 1 {
+		t.Errorf("Expected item 1 to be dropped, got %v", dropped)
+	}
+
+	blocking := NewConcurrentQueue(QueueOptions[int]{Capacity: 1})
+	blocking.Enqueue(ctx, 1)
+	done := make(chan error)
+	go func() { done <- blocking.Enqueue(ctx, 2) }()
+	select {
+	case <-done:
+		t.Fatal("Expected Enqueue to block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	blocking.Dequeue(ctx)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentQueueDequeueFunc(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[int]{})
+	ctx := context.Background()
+	queue.Enqueue(ctx, 1)
+	queue.Enqueue(ctx, 2)
+
+	var allowed atomic.Bool
+	eligible := func(item int) bool {
+		return item == 2 || allowed.Load()
+	}
+
+	item, err := queue.DequeueFunc(ctx, eligible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != 2 {
+		t.Errorf("Expected the eligible item 2, got %d", item)
+	}
+
+	result := make(chan int)
+	go func() {
+		item, _ := queue.DequeueFunc(ctx, eligible)
+		result <- item
+	}()
+	time.Sleep(10 * time.Millisecond)
+	allowed.Store(true)
+	queue.Wake()
+	select {
+	case item := <-result:
+		if item != 1 {
+			t.Errorf("Expected item 1 after waking, got %d", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Wake to re-evaluate the predicate")
+	}
+}
+
+func TestConcurrentQueueOrdering(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[int]{
+		Less: func(a, b int) bool { return a/10 > b/10 },
+	})
+	ctx := context.Background()
+	// Items in the same band of ten are equal, so they keep their arrival order
+	for _, item := range []int{1, 22, 5, 31, 27, 3} {
+		queue.Enqueue(ctx, item)
+	}
+
+	expected := []int{31, 22, 27, 1, 5, 3}
+	for _, e := range expected {
+		item, _ := queue.TryDequeue()
+		if item != e {
+			t.Fatalf("Expected %d, got %d", e, item)
+		}
+	}
+}
+
+func TestConcurrentQueueFairness(t *testing.T) {
+	type job struct {
+		code     string
+		priority int
+	}
+	queue := NewConcurrentQueue(QueueOptions[job]{
+		Less:    func(a, b job) bool { return a.priority > b.priority },
+		FairKey: func(j job) string { return j.code },
+	})
+	ctx := context.Background()
+	// A flood of high priority V jobs must not starve the A and B jobs
+	for i := 0; i < 5; i++ {
+		queue.Enqueue(ctx, job{code: "V", priority: 100 + i})
+	}
+	queue.Enqueue(ctx, job{code: "A", priority: 1})
+	queue.Enqueue(ctx, job{code: "B", priority: 1})
+	queue.Enqueue(ctx, job{code: "A", priority: 2})
+
+	var codes string
+	for !queue.IsEmpty() {
+		j, _ := queue.TryDequeue()
+		codes += j.code
+	}
+	if codes != "VABVAVVV" {
+		t.Errorf("Expected the codes to take turns as VABVAVVV, got %s", codes)
+	}
+}
+
+func TestConcurrentQueueFairnessSkipsIneligibleGroups(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[string]{
+		FairKey: func(s string) string { return s[:1] },
+	})
+	ctx := context.Background()
+	for _, item := range []string{"a1", "a2", "b1", "b2"} {
+		queue.Enqueue(ctx, item)
+	}
+
+	// With every "a" blocked, "b" items keep coming out
+	onlyB := func(s string) bool { return s[0] == 'b' }
+	for _, expected := range []string{"b1", "b2"} {
+		item, err := queue.DequeueFunc(ctx, onlyB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != expected {
+			t.Errorf("Expected %s, got %s", expected, item)
+		}
+	}
+	if item, _ := queue.TryDequeue(); item != "a1" {
+		t.Errorf("Expected a1, got %s", item)
+	}
+}
+
+func TestConcurrentQueueRemoveFunc(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[int]{FairKey: func(i int) string { return string(rune('a' + i%2)) }})
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		queue.Enqueue(ctx, i)
+	}
+
+	removed := queue.RemoveFunc(func(i int) bool { return i == 2 || i == 3 })
+	if len(removed) != 2 {
+		t.Fatalf("Expected 2 removed items, got %v", removed)
+	}
+	if queue.Size() != 3 {
+		t.Errorf("Expected queue size 3, got %d", queue.Size())
+	}
+	if removed := queue.RemoveFunc(func(i int) bool { return i == 42 }); len(removed) != 0 {
+		t.Errorf("Expected nothing to be removed, got %v", removed)
+	}
+}
+
+func TestConcurrentQueueMoveToFront(t *testing.T) {
+	queue := NewConcurrentQueue(QueueOptions[int]{
+		Less:    func(a, b int) bool { return a > b },
+		FairKey: func(i int) string { return string(rune('a' + i%2)) },
+	})
+	ctx := context.Background()
+	for i := 1; i <= 6; i++ {
+		queue.Enqueue(ctx, i)
+	}
+	// Odd numbers are group b, whose turn comes after group a
+	if !queue.MoveToFront(func(i int) bool { return i == 1 }) {
+		t.Fatal("Expected 1 to be moved to the front")
+	}
+	queue.MoveToFront(func(i int) bool { return i == 3 })
+	if queue.MoveToFront(func(i int) bool { return i == 42 }) {
+		t.Error("Expected nothing to be moved")
+	}
+
+	expected := []int{3, 6, 1, 4, 5, 2}
+	items := queue.Items()
+	if len(items) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, items)
+	}
+	for i := range expected {
+		if items[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, items)
+		}
+	}
+	if queue.Size() != len(expected) {
+		t.Errorf("Expected Items to leave the queue alone, size is %d", queue.Size())
+	}
+	for _, want := range expected {
+		if got, _ := queue.TryDequeue(); got != want {
+			t.Fatalf("Expected %d, got %d", want, got)
+		}
+	}
 }
@@ -0,0 +1,48 @@
+package util
+
+import "strings"
+
+// redactedValue replaces secrets in redacted settings
+const redactedValue = "<redacted>"
+
+// secretKeys are the names of the secret settings: the passwords of the MQTT server, the seedboxes, the HTTP API
+// and the broker users, the token of the HTTP API and the signing secrets. Keys such as mqtt.tls.key are paths.
+var secretKeys = []string{"password", "token", "secret"}
+
+// RedactSettings returns a copy of the settings, as returned by
+// viper.AllSettings, with the values of secret settings replaced.
+func RedactSettings(settings map[string]any) map[string]any {
+	redacted := make(map[string]any, len(settings))
+	for key, value := range settings {
+		if isSecretKey(key) {
+			redacted[key] = redactedValue
+			continue
+		}
+		redacted[key] = redactValue(value)
+	}
+	return redacted
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		return RedactSettings(v)
+	case []any:
+		values := make([]any, len(v))
+		for i, item := range v {
+			values[i] = redactValue(item)
+		}
+		return values
+	}
+	return value
+}
+
+func isSecretKey(key string) bool {
+	for _, secret := range secretKeys {
+		// Viper lowercases the keys, but not inside lists
+		if strings.EqualFold(key, secret) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactSettings(t *testing.T) {
+	settings := map[string]any{
+		"mqtt": map[string]any{
+			"host":     "broker",
+			"password": "hunter2",
+			"tls":      map[string]any{"cert": "/etc/client.crt", "key": "/etc/client.key"},
+			"signing":  map[string]any{"keyid": "new", "keys": []any{map[string]any{"id": "new", "secret": "s3cret"}}},
+		},
+		"client": map[string]any{
+			"serverinfo": map[string]any{"username": "me", "password": "batquot"},
+			"http":       map[string]any{"username": "admin", "password": "changeme", "token": "abc"},
+		},
+		"subscriptions": []any{map[string]any{"topic": "seedbox/+", "serverInfo": map[string]any{"host": "a", "password": "b"}}},
+		"broker":        map[string]any{"users": []any{map[string]any{"username": "box", "password": "c"}}},
+	}
+	expected := map[string]any{
+		"mqtt": map[string]any{
+			"host":     "broker",
+			"password": redactedValue,
+			"tls":      map[string]any{"cert": "/etc/client.crt", "key": "/etc/client.key"},
+			"signing":  map[string]any{"keyid": "new", "keys": []any{map[string]any{"id": "new", "secret": redactedValue}}},
+		},
+		"client": map[string]any{
+			"serverinfo": map[string]any{"username": "me", "password": redactedValue},
+			"http":       map[string]any{"username": "admin", "password": redactedValue, "token": redactedValue},
+		},
+		"subscriptions": []any{map[string]any{"topic": "seedbox/+", "serverInfo": map[string]any{"host": "a", "password": redactedValue}}},
+		"broker":        map[string]any{"users": []any{map[string]any{"username": "box", "password": redactedValue}}},
+	}
+	if redacted := RedactSettings(settings); !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("Expected %v, got %v", expected, redacted)
+	}
+	if settings["mqtt"].(map[string]any)["password"] != "hunter2" {
+		t.Error("Expected the settings to be left alone")
+	}
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// ErrorClass groups transfer failures by what can be done about them.
+type ErrorClass string
+
+const (
+	// ErrorAuth means the seedbox refused the credentials, retrying won't help
+	ErrorAuth ErrorClass = "auth"
+	// ErrorNotFound means the remote path doesn't exist, retrying won't help
+	ErrorNotFound ErrorClass = "not-found"
+	// ErrorNetwork means the seedbox couldn't be reached or the connection dropped
+	ErrorNetwork ErrorClass = "network"
+	// ErrorVerify means the transfer finished but the download didn't check out
+	ErrorVerify ErrorClass = "verify"
+	// ErrorPostProcess means the post-processing command failed
+	ErrorPostProcess ErrorClass = "post-process"
+	// ErrorConfig means the config doesn't say how to handle the job
+	ErrorConfig  ErrorClass = "config"
+	ErrorUnknown ErrorClass = "unknown"
+)
+
+// Retryable reports whether a failure of this class may succeed on another attempt.
+func (c ErrorClass) Retryable() bool {
+	return c != ErrorAuth && c != ErrorNotFound && c != ErrorPostProcess && c != ErrorConfig
+}
+
+// lftp and ssh messages for each class, matched case-insensitively and in order
+var errorPatterns = []struct {
+	class    ErrorClass
+	patterns []string
+}{
+	{ErrorAuth, []string{"login failed", "login incorrect", "authentication failed", "permission denied (publickey", "530 "}},
+	{ErrorNetwork, []string{"connection refused", "connection reset", "connection timed out", "timed out", "network is unreachable",
+		"no route to host", "name or service not known", "could not resolve", "host not found", "max-retries exceeded", "broken pipe"}},
+	{ErrorNotFound, []string{"no such file", "not found", "does not exist", "550 "}},
+}
+
+// ClassifyOutput inspects the error output of a failed command.
+func ClassifyOutput(output string) ErrorClass {
+	lowered := strings.ToLower(output)
+	for _, group := range errorPatterns {
+		for _, pattern := range group.patterns {
+			if strings.Contains(lowered, pattern) {
+				return group.class
+			}
+		}
+	}
+	return ErrorUnknown
+}
+
+// TransferError is a failed transfer along with the class of the failure.
+type TransferError struct {
+	Class    ErrorClass
+	ExitCode int
+	Message  string
+}
+
+// NewTransferError classifies the error output of a failed command and keeps
+// its last line as the message.
+func NewTransferError(exitCode int, output string) *TransferError {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return &TransferError{
+		Class:    ClassifyOutput(output),
+		ExitCode: exitCode,
+		Message:  strings.TrimSpace(lines[len(lines)-1]),
+	}
+}
+
+func (e *TransferError) Error() string {
+	if e.ExitCode != 0 {
+		return fmt.Sprintf("%s error (exit code %d): %s", e.Class, e.ExitCode, e.Message)
+	}
+	return fmt.Sprintf("%s error: %s", e.Class, e.Message)
+}
+
+// Backoff computes exponentially growing delays between attempts.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns how long to wait before the given attempt, counting from 1.
+// Half of the delay is fixed and the other half is random, so that jobs that
+// failed together don't all retry at the same moment.
+func (b Backoff) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := b.Base
+	for i := 1; i < attempt && (b.Max <= 0 || delay < b.Max); i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
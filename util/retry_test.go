@@ -0,0 +1,54 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClassifyOutput(t *testing.T) {
+	cases := map[string]ErrorClass{
+		"mirror: Login failed: Login incorrect":                     ErrorAuth,
+		"pget: Access failed: No such file (/downloads/foo)":        ErrorNotFound,
+		"mirror: Fatal error: max-retries exceeded":                 ErrorNetwork,
+		"connect: Connection refused":                               ErrorNetwork,
+		"getaddrinfo: Name or service not known\nhost not found":    ErrorNetwork,
+		"something nobody has seen before":                          ErrorUnknown,
+		"mirror: Access failed: 550 /downloads/foo: does not exist": ErrorNotFound,
+	}
+	for output, expected := range cases {
+		if class := ClassifyOutput(output); class != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, output, class)
+		}
+	}
+}
+
+func TestErrorClassRetryable(t *testing.T) {
+	if ErrorAuth.Retryable() || ErrorNotFound.Retryable() {
+		t.Error("Expected auth and not-found errors to be permanent")
+	}
+	if !ErrorNetwork.Retryable() || !ErrorUnknown.Retryable() {
+		t.Error("Expected network and unknown errors to be retried")
+	}
+}
+
+func TestNewTransferError(t *testing.T) {
+	err := NewTransferError(1, "cd ok\nmirror: Login failed: Login incorrect\n")
+	if err.Class != ErrorAuth {
+		t.Errorf("Expected %s, got %s", ErrorAuth, err.Class)
+	}
+	if err.Message != "mirror: Login failed: Login incorrect" {
+		t.Errorf("Expected the last line as message, got %q", err.Message)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Base: time.Second, Max: 10 * time.Second}
+	for attempt, ceiling := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		for i := 0; i < 100; i++ {
+			delay := backoff.Delay(attempt)
+			if delay < ceiling/2 || delay > ceiling {
+				t.Fatalf("Expected attempt %d to wait between %s and %s, got %s", attempt, ceiling/2, ceiling, delay)
+			}
+		}
+	}
+}
@@ -16,29 +16,38 @@ func GenerateCodeFromRules(message types.MQTTMessage) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	for _, condition := range serverRules.Server.CodeConditions {
-		if evalExpression(condition, message) {
-			return condition.Code, nil
+	return CodeFromRules(serverRules.Server, message, nil), nil
+}
+
+// CodeFromRules returns the code of the first condition the message meets, or else the default code. A condition
+// on one of vars, like topic[1], looks at that variable instead of a field of the message.
+func CodeFromRules(rules types.ServerRules, message types.MQTTMessage, vars map[string]string) string {
+	for _, condition := range rules.CodeConditions {
+		if evalExpression(condition, message, vars) {
+			return condition.Code
 		}
 	}
-	return serverRules.Server.DefaultCode, nil
+	return rules.DefaultCode
 }
 
-func evalExpression(condition types.Rule, message types.MQTTMessage) bool {
-	caseFormatter := cases.Title(language.English)
-	r := reflect.ValueOf(message)
-	field := reflect.Indirect(r).FieldByName(caseFormatter.String(condition.Entity))
-	if field.String() == "" || field.String() == "<invalid value>" {
+func evalExpression(condition types.Rule, message types.MQTTMessage, vars map[string]string) bool {
+	value, found := vars[condition.Entity]
+	if !found {
+		caseFormatter := cases.Title(language.English)
+		r := reflect.ValueOf(message)
+		value = reflect.Indirect(r).FieldByName(caseFormatter.String(condition.Entity)).String()
+	}
+	if value == "" || value == "<invalid value>" {
 		return false
 	}
 	if condition.Operator == "=" || condition.Operator == "eq" {
-		return field.String() == condition.Value
+		return value == condition.Value
 	}
 	if condition.Operator == "contains" || condition.Operator == "in" {
-		return strings.Contains(field.String(), condition.Value)
+		return strings.Contains(value, condition.Value)
 	}
 	if condition.Operator == "!=" || condition.Operator == "not" {
-		return field.String() != condition.Value
+		return value != condition.Value
 	}
 	return false
 }
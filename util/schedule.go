@@ -0,0 +1,191 @@
+package util
+
+import (
+	"fmt"
+	"seedstore/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring period in which downloads may run. A window whose end
+// is before its start runs past midnight into the next day.
+type Window struct {
+	// Days the window starts on, every day when empty
+	Days  map[time.Weekday]bool
+	Start time.Duration
+	End   time.Duration
+	// RateLimit in bytes per second for transfers started in the window, zero means unlimited
+	RateLimit int64
+}
+
+// Schedule decides when jobs may start. Without windows jobs may always start.
+type Schedule struct {
+	Windows []Window
+	// OutsideMaxSize lets jobs smaller than this many bytes start outside of
+	// the windows, zero keeps every job waiting
+	OutsideMaxSize int64
+}
+
+// ParseSchedule builds a schedule from the config.
+func ParseSchedule(rules types.ScheduleRules) (*Schedule, error) {
+	schedule := &Schedule{OutsideMaxSize: rules.OutsideMaxSize}
+	for i, w := range rules.Windows {
+		window := Window{Days: make(map[time.Weekday]bool)}
+		for _, day := range w.Days {
+			weekday, found := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+			if !found {
+				return nil, fmt.Errorf("schedule window %d: unknown day %q", i, day)
+			}
+			window.Days[weekday] = true
+		}
+		var err error
+		if window.Start, err = parseClock(w.Start); err != nil {
+			return nil, fmt.Errorf("schedule window %d: %w", i, err)
+		}
+		if window.End, err = parseClock(w.End); err != nil {
+			return nil, fmt.Errorf("schedule window %d: %w", i, err)
+		}
+		if window.RateLimit, err = ParseRate(w.RateLimit); err != nil {
+			return nil, fmt.Errorf("schedule window %d: %w", i, err)
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	return schedule, nil
+}
+
+// Active returns the window covering t, if any.
+func (s *Schedule) Active(t time.Time) (Window, bool) {
+	for _, window := range s.Windows {
+		if window.covers(t) {
+			return window, true
+		}
+	}
+	return Window{}, false
+}
+
+// IsOpen reports whether jobs of any size may start at t.
+func (s *Schedule) IsOpen(t time.Time) bool {
+	if len(s.Windows) == 0 {
+		return true
+	}
+	_, open := s.Active(t)
+	return open
+}
+
+// Allows reports whether a job of the given size may start at t. Jobs of
+// unknown size only start inside a window.
+func (s *Schedule) Allows(t time.Time, size int64) bool {
+	if s.IsOpen(t) {
+		return true
+	}
+	return size > 0 && size < s.OutsideMaxSize
+}
+
+// Stops reports whether a transfer of the given size that is running at t
+// has to stop, because it may only run inside a window and none is open.
+// Transfers that could start at t keep running.
+func (s *Schedule) Stops(t time.Time, size int64) bool {
+	return !s.Allows(t, size)
+}
+
+// RateLimit returns the rate limit in bytes per second for a transfer
+// starting at t, zero meaning unlimited.
+func (s *Schedule) RateLimit(t time.Time) int64 {
+	window, _ := s.Active(t)
+	return window.RateLimit
+}
+
+// NextChange returns the next time after t at which a window opens or
+// closes, or the zero time if the schedule never changes.
+func (s *Schedule) NextChange(t time.Time) time.Time {
+	var next time.Time
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// A window starting yesterday may still close today, a week and a day covers every case
+	for offset := -1; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, window := range s.Windows {
+			if len(window.Days) > 0 && !window.Days[day.Weekday()] {
+				continue
+			}
+			start := clockOn(day, window.Start)
+			end := clockOn(day, window.End)
+			if window.End <= window.Start {
+				end = clockOn(day.AddDate(0, 0, 1), window.End)
+			}
+			for _, change := range []time.Time{start, end} {
+				if change.After(t) && (next.IsZero() || change.Before(next)) {
+					next = change
+				}
+			}
+		}
+	}
+	return next
+}
+
+func (w Window) covers(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	startsOn := func(day time.Weekday) bool { return len(w.Days) == 0 || w.Days[day] }
+	if w.End > w.Start {
+		return startsOn(t.Weekday()) && clock >= w.Start && clock < w.End
+	}
+	// The window runs past midnight, so t is either in the part before
+	// midnight or in the part after midnight of a window started yesterday
+	if clock >= w.Start {
+		return startsOn(t.Weekday())
+	}
+	return clock < w.End && startsOn(t.AddDate(0, 0, -1).Weekday())
+}
+
+// clockOn returns the time of day clock on the given day, going by the wall
+// clock so that windows stay put across daylight saving changes.
+func clockOn(day time.Time, clock time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// parseClock parses a time of day such as "22:30".
+func parseClock(s string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// ParseRate parses a rate in bytes per second, with an optional K, M or G
+// suffix in powers of 1024 as lftp does, e.g. "500K" or "1.5M". An empty
+// string means unlimited.
+func ParseRate(s string) (int64, error) {
+	original := s
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q", original)
+	}
+	return int64(value * multiplier), nil
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"seedstore/types"
+	"testing"
+	"time"
+)
+
+func TestScheduleOvernightWindow(t *testing.T) {
+	schedule, err := ParseSchedule(types.ScheduleRules{
+		Windows: []types.ScheduleWindow{
+			{Days: []string{"fri", "Saturday"}, Start: "22:00", End: "07:00", RateLimit: "2M"},
+		},
+		OutsideMaxSize: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-06-07 is a Friday
+	cases := []struct {
+		at   time.Time
+		open bool
+	}{
+		{time.Date(2024, 6, 7, 21, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, 6, 7, 22, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 6, 8, 3, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 6, 8, 7, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 6, 9, 6, 59, 0, 0, time.UTC), true},
+		// The Sunday night isn't part of the schedule
+		{time.Date(2024, 6, 9, 23, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 6, 10, 2, 0, 0, 0, time.UTC), false},
+	}
+	for _, c := range cases {
+		if open := schedule.IsOpen(c.at); open != c.open {
+			t.Errorf("Expected open=%t at %s, got %t", c.open, c.at.Format(time.RFC1123), open)
+		}
+	}
+
+	night := time.Date(2024, 6, 7, 23, 0, 0, 0, time.UTC)
+	if rate := schedule.RateLimit(night); rate != 2*1024*1024 {
+		t.Errorf("Expected the window rate limit, got %d", rate)
+	}
+	day := time.Date(2024, 6, 7, 12, 0, 0, 0, time.UTC)
+	if !schedule.Allows(day, 500) {
+		t.Error("Expected a small job to start outside the window")
+	}
+	if schedule.Allows(day, 5000) || schedule.Allows(day, 0) {
+		t.Error("Expected big and unknown size jobs to wait for the window")
+	}
+}
+
+func TestScheduleNextChange(t *testing.T) {
+	schedule, err := ParseSchedule(types.ScheduleRules{
+		Windows: []types.ScheduleWindow{{Start: "01:00", End: "06:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 6, 7, 3, 0, 0, 0, time.UTC)
+	if next := schedule.NextChange(at); !next.Equal(time.Date(2024, 6, 7, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the window to close at 06:00, got %s", next)
+	}
+	at = time.Date(2024, 6, 7, 7, 0, 0, 0, time.UTC)
+	if next := schedule.NextChange(at); !next.Equal(time.Date(2024, 6, 8, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the window to open the next day at 01:00, got %s", next)
+	}
+}
+
+func TestScheduleStopsAtClose(t *testing.T) {
+	schedule, err := ParseSchedule(types.ScheduleRules{
+		Windows:        []types.ScheduleWindow{{Start: "01:00", End: "06:00"}},
+		OutsideMaxSize: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Started inside the window, still running when it closes
+	inside := time.Date(2024, 6, 7, 5, 59, 0, 0, time.UTC)
+	closed := schedule.NextChange(inside)
+	if schedule.Stops(inside, 5000) {
+		t.Error("Expected a big transfer to keep running inside the window")
+	}
+	if !schedule.Stops(closed, 5000) || !schedule.Stops(closed, 0) {
+		t.Error("Expected big and unknown size transfers to stop once the window closed")
+	}
+	if schedule.Stops(closed, 500) {
+		t.Error("Expected a small transfer to keep running once the window closed")
+	}
+
+	always, _ := ParseSchedule(types.ScheduleRules{})
+	if always.Stops(closed, 5000) {
+		t.Error("Expected transfers to keep running without a schedule")
+	}
+}
+
+func TestScheduleWithoutWindows(t *testing.T) {
+	schedule, err := ParseSchedule(types.ScheduleRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !schedule.Allows(time.Now(), 0) {
+		t.Error("Expected jobs to always start without a schedule")
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	invalid := []types.ScheduleWindow{
+		{Days: []string{"someday"}, Start: "01:00", End: "02:00"},
+		{Start: "25:00", End: "02:00"},
+		{Start: "01:00", End: "02:00", RateLimit: "fast"},
+	}
+	for _, window := range invalid {
+		if _, err := ParseSchedule(types.ScheduleRules{Windows: []types.ScheduleWindow{window}}); err == nil {
+			t.Errorf("Expected %v to be rejected", window)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]int64{"": 0, "1000": 1000, "500K": 500 * 1024, "1.5M": 3 * 512 * 1024, "1g": 1 << 30}
+	for s, expected := range cases {
+		rate, err := ParseRate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rate != expected {
+			t.Errorf("Expected %d for %q, got %d", expected, s, rate)
+		}
+	}
+}
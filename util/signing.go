@@ -0,0 +1,278 @@
+package util
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"seedstore/types"
+	"sync"
+	"time"
+)
+
+// ErrBadSignature is returned for messages that aren't signed, or not the way the subscriber expects
+var ErrBadSignature = errors.New("bad signature")
+
+// signatureVersion starts the canonical encoding, so it can change without old signatures matching the new one
+const signatureVersion = "seedstore-v1"
+
+// Signer signs queue messages and commands, and checks their signatures. A signature is only accepted once, and
+// only while it is younger than the allowed age and not further ahead of the clock than the allowed skew.
+type Signer struct {
+	keys    map[string][]byte
+	keyID   string
+	maxSkew time.Duration
+	maxAge  time.Duration
+	now     func() time.Time
+
+	lock sync.Mutex
+	// seen are the nonces of the accepted signatures, until they are too old to be accepted anyway
+	seen map[string]time.Time
+	// path is where seen is kept across restarts, when set
+	path string
+}
+
+// NewSigner checks the signing keys and the one to sign with. The allowed skew is 5 minutes and the allowed age a
+// day unless set.
+func NewSigner(rules types.SigningRules) (*Signer, error) {
+	if len(rules.Keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	signer := &Signer{
+		keys:    make(map[string][]byte, len(rules.Keys)),
+		keyID:   rules.KeyID,
+		maxSkew: rules.MaxSkew,
+		maxAge:  rules.MaxAge,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+	for _, key := range rules.Keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, errors.New("every signing key needs an id and a secret")
+		}
+		if _, found := signer.keys[key.ID]; found {
+			return nil, fmt.Errorf("signing key %s is listed twice", key.ID)
+		}
+		signer.keys[key.ID] = []byte(key.Secret)
+	}
+	if signer.keyID == "" {
+		signer.keyID = rules.Keys[0].ID
+	}
+	if _, found := signer.keys[signer.keyID]; !found {
+		return nil, fmt.Errorf("signing key %s is not one of the keys", signer.keyID)
+	}
+	if signer.maxSkew <= 0 {
+		signer.maxSkew = 5 * time.Minute
+	}
+	if signer.maxAge <= 0 {
+		signer.maxAge = 24 * time.Hour
+	}
+	return signer, nil
+}
+
+// Sign adds a signature of msg, for the topic it is published on, with the signing key.
+func (s *Signer) Sign(topic string, msg *types.MQTTMessage) error {
+	signature, err := s.sign(topic, messageFields(*msg))
+	msg.Signature = signature
+	return err
+}
+
+// SignCommand adds a signature of command, for the topic it is published on, with the signing key.
+func (s *Signer) SignCommand(topic string, command *types.Command) error {
+	signature, err := s.sign(topic, commandFields(*command))
+	command.Signature = signature
+	return err
+}
+
+func (s *Signer) sign(topic string, fields []any) (*types.Signature, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	signature := &types.Signature{
+		KeyID:     s.keyID,
+		Timestamp: s.now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	mac, err := signatureMAC(s.keys[s.keyID], topic, signature, fields)
+	if err != nil {
+		return nil, err
+	}
+	signature.HMAC = hex.EncodeToString(mac)
+	return signature, nil
+}
+
+// Verify checks that msg, received on topic, carries a valid signature with one of the keys, that it was signed
+// recently enough and that it wasn't accepted before. The errors wrap ErrBadSignature.
+func (s *Signer) Verify(topic string, msg types.MQTTMessage) error {
+	if msg.Signature == nil {
+		return fmt.Errorf("%w: the message is not signed", ErrBadSignature)
+	}
+	return s.verify(topic, msg.Signature, messageFields(msg))
+}
+
+// VerifyCommand checks the signature of command, received on topic, like Verify does for messages.
+func (s *Signer) VerifyCommand(topic string, command types.Command) error {
+	if command.Signature == nil {
+		return fmt.Errorf("%w: the command is not signed", ErrBadSignature)
+	}
+	return s.verify(topic, command.Signature, commandFields(command))
+}
+
+func (s *Signer) verify(topic string, signature *types.Signature, fields []any) error {
+	key, found := s.keys[signature.KeyID]
+	if !found {
+		return fmt.Errorf("%w: unknown key %q", ErrBadSignature, signature.KeyID)
+	}
+	mac, err := hex.DecodeString(signature.HMAC)
+	if err != nil {
+		return fmt.Errorf("%w: the hmac is not hex", ErrBadSignature)
+	}
+	expected, err := signatureMAC(key, topic, signature, fields)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expected) {
+		return fmt.Errorf("%w: the hmac doesn't match", ErrBadSignature)
+	}
+	// Checked after the hmac, so only the time of genuine messages is reported
+	now := s.now()
+	signed := time.Unix(signature.Timestamp, 0)
+	if ahead := signed.Sub(now); ahead > s.maxSkew {
+		return fmt.Errorf("%w: signed at %s, %s ahead of the clock", ErrBadSignature, signed.Format(time.RFC3339), ahead.Round(time.Second))
+	}
+	if age := now.Sub(signed); age > s.maxAge {
+		return fmt.Errorf("%w: signed at %s, %s ago", ErrBadSignature, signed.Format(time.RFC3339), age.Round(time.Second))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for nonce, expires := range s.seen {
+		if now.After(expires) {
+			delete(s.seen, nonce)
+		}
+	}
+	nonce := signature.KeyID + "/" + signature.Nonce
+	if _, found := s.seen[nonce]; found {
+		return fmt.Errorf("%w: replay of a message already accepted", ErrBadSignature)
+	}
+	// Until it is too old to be accepted anyway
+	s.seen[nonce] = signed.Add(s.maxAge)
+	s.save()
+	return nil
+}
+
+// RememberIn keeps the nonces of the accepted signatures in the file at path, so a message can't be replayed after
+// a restart either. The nonces already in the file are read back.
+func (s *Signer) RememberIn(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		var seen map[string]time.Time
+		if err := json.Unmarshal(data, &seen); err != nil {
+			return fmt.Errorf("%s is not a list of nonces: %w", path, err)
+		}
+		now := s.now()
+		for nonce, expires := range seen {
+			if now.Before(expires) {
+				s.seen[nonce] = expires
+			}
+		}
+	}
+	s.path = path
+	return nil
+}
+
+// save writes the nonces to the file given to RememberIn, atomically. The lock must be held. A message is still
+// accepted when they can't be written, only a replay after a restart would go unnoticed.
+func (s *Signer) save() {
+	if s.path == "" {
+		return
+	}
+	if err := writeNonces(s.path, s.seen); err != nil {
+		slog.Error("Could not save the nonces of the signed messages: " + err.Error())
+	}
+}
+
+func writeNonces(path string, seen map[string]time.Time) error {
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmpPath, path)
+}
+
+// Forget lets the message with signature through once more, for one that is delivered again because it couldn't
+// be taken the first time.
+func (s *Signer) Forget(signature *types.Signature) {
+	if signature == nil {
+		return
+	}
+	s.lock.Lock()
+	delete(s.seen, signature.KeyID+"/"+signature.Nonce)
+	s.save()
+	s.lock.Unlock()
+}
+
+// messageFields are the fields of msg that its signature covers, in their canonical order.
+func messageFields(msg types.MQTTMessage) []any {
+	return []any{msg.Name, msg.Hash, msg.Location, msg.Category, msg.Priority, msg.Size, msg.Force}
+}
+
+// commandFields are the fields of command that its signature covers, after a marker that keeps the signature of a
+// command from passing for the one of a message.
+func commandFields(command types.Command) []any {
+	return []any{"command", command.Command, command.Value, command.Target, command.DeletePartial}
+}
+
+// signatureMAC is the HMAC-SHA256 with key of the canonical encoding of a message or command: a compact JSON array
+// of the signature and then the signed fields, in a fixed order, without HTML escaping, so publishers in other
+// languages don't depend on how their JSON encoder orders objects.
+func signatureMAC(key []byte, topic string, signature *types.Signature, fields []any) ([]byte, error) {
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(append([]any{
+		signatureVersion,
+		topic,
+		signature.KeyID,
+		signature.Timestamp,
+		signature.Nonce,
+	}, fields...))
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	// Without the newline the encoder ends with
+	mac.Write(bytes.TrimSuffix(canonical.Bytes(), []byte("\n")))
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,161 @@
+package util
+
+import (
+	"errors"
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	oldKey := types.SigningKey{ID: "2025", Secret: "old secret"}
+	newKey := types.SigningKey{ID: "2026", Secret: "new secret"}
+	publisher, err := NewSigner(types.SigningRules{Keys: []types.SigningKey{newKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.now = clock
+	// The subscriber takes both keys while the publishers move to the new one
+	subscriber, err := NewSigner(types.SigningRules{Keys: []types.SigningKey{oldKey, newKey}, KeyID: "2025", MaxSkew: time.Minute, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber.now = clock
+
+	sign := func(signer *Signer, topic string) types.MQTTMessage {
+		t.Helper()
+		msg := types.MQTTMessage{Name: "Tom & Jerry", Location: "/dl/Tom & Jerry", Size: 1024}
+		if err := signer.Sign(topic, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	msg := sign(publisher, "queue")
+	if msg.Signature == nil || msg.Signature.KeyID != "2026" || msg.Signature.Timestamp != now.Unix() {
+		t.Fatalf("Expected a signature with the new key and the time, got %+v", msg.Signature)
+	}
+	if err := subscriber.Verify("queue", msg); err != nil {
+		t.Fatalf("Expected the signature to be accepted, got %v", err)
+	}
+	if err := subscriber.Verify("queue", msg); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a replay to be refused, got %v", err)
+	}
+	// Still remembered once older than the skew, for as long as it could be accepted
+	subscriber.now = func() time.Time { return now.Add(30 * time.Minute) }
+	if err := subscriber.Verify("queue", msg); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a later replay to be refused, got %v", err)
+	}
+	// Waited at the broker while the subscriber was down
+	if err := subscriber.Verify("queue", sign(publisher, "queue")); err != nil {
+		t.Errorf("Expected a message younger than the allowed age to be accepted, got %v", err)
+	}
+	subscriber.now = clock
+	// Delivered again because it couldn't be taken the first time
+	subscriber.Forget(msg.Signature)
+	if err := subscriber.Verify("queue", msg); err != nil {
+		t.Errorf("Expected a forgotten signature to be accepted again, got %v", err)
+	}
+	if err := subscriber.Verify("queue", sign(subscriber, "queue")); err != nil {
+		t.Errorf("Expected the old key to be accepted, got %v", err)
+	}
+
+	tampered := sign(publisher, "queue")
+	tampered.Location = "/etc"
+	unsigned := types.MQTTMessage{Name: "x", Location: "/x"}
+	unknown := sign(publisher, "queue")
+	unknown.Signature.KeyID = "2024"
+	garbled := sign(publisher, "queue")
+	garbled.Signature.HMAC = "not hex"
+	tests := []struct {
+		name  string
+		topic string
+		msg   types.MQTTMessage
+		at    time.Time
+	}{
+		{"tampered", "queue", tampered, now},
+		{"other topic", "other", sign(publisher, "queue"), now},
+		{"unsigned", "queue", unsigned, now},
+		{"unknown key", "queue", unknown, now},
+		{"garbled", "queue", garbled, now},
+		{"too old", "queue", sign(publisher, "queue"), now.Add(2 * time.Hour)},
+		{"from the future", "queue", sign(publisher, "queue"), now.Add(-2 * time.Minute)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subscriber.now = func() time.Time { return test.at }
+			defer func() { subscriber.now = clock }()
+			if err := subscriber.Verify(test.topic, test.msg); !errors.Is(err, ErrBadSignature) {
+				t.Errorf("Expected a bad signature, got %v", err)
+			}
+		})
+	}
+
+	command := types.Command{Command: types.CommandCancel, Target: "abc", DeletePartial: true}
+	if err := publisher.SignCommand("seedstore/command", &command); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.VerifyCommand("seedstore/command", command); err != nil {
+		t.Errorf("Expected the signed command to be accepted, got %v", err)
+	}
+	if err := subscriber.VerifyCommand("seedstore/command", command); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a replayed command to be refused, got %v", err)
+	}
+	tamperedCommand := types.Command{Command: types.CommandCancel, Target: "abc"}
+	if err := publisher.SignCommand("seedstore/command", &tamperedCommand); err != nil {
+		t.Fatal(err)
+	}
+	tamperedCommand.DeletePartial = true
+	if err := subscriber.VerifyCommand("seedstore/command", tamperedCommand); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a tampered command to be refused, got %v", err)
+	}
+	if err := subscriber.VerifyCommand("seedstore/command", types.Command{Command: types.CommandCancel, Target: "abc"}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected an unsigned command to be refused, got %v", err)
+	}
+
+	// The canonical encoding doesn't change under publishers in other languages
+	canonical := types.MQTTMessage{Name: "Tom & Jerry", Hash: "ABC", Location: "/dl/Tom & Jerry", Category: "tv", Priority: 2, Size: 1024}
+	canonical.Signature = &types.Signature{KeyID: "k1", Timestamp: 1700000000, Nonce: "00ff",
+		HMAC: "ecab2aee9733c6e4e06ac3adcbb37a4513e29ecedae670f922d7946397fd2197"}
+	known, _ := NewSigner(types.SigningRules{Keys: []types.SigningKey{{ID: "k1", Secret: "secret"}}})
+	known.now = clock
+	if err := known.Verify("queue", canonical); err != nil {
+		t.Errorf("Expected the reference signature to be accepted, got %v", err)
+	}
+
+	// The nonces outlive a restart
+	path := filepath.Join(t.TempDir(), "nonces.json")
+	restart := func(at time.Time) *Signer {
+		t.Helper()
+		restarted, _ := NewSigner(types.SigningRules{Keys: []types.SigningKey{newKey}, MaxAge: time.Hour})
+		restarted.now = func() time.Time { return at }
+		if err := restarted.RememberIn(path); err != nil {
+			t.Fatal(err)
+		}
+		return restarted
+	}
+	captured := sign(publisher, "queue")
+	if err := restart(now).Verify("queue", captured); err != nil {
+		t.Fatalf("Expected the signature to be accepted, got %v", err)
+	}
+	if err := restart(now.Add(time.Minute)).Verify("queue", captured); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a replay after a restart to be refused, got %v", err)
+	}
+	if restarted := restart(now.Add(2 * time.Hour)); len(restarted.seen) != 0 {
+		t.Errorf("Expected the nonces older than the allowed age to be dropped, got %v", restarted.seen)
+	}
+
+	for _, rules := range []types.SigningRules{
+		{},
+		{Keys: []types.SigningKey{{ID: "a"}}},
+		{Keys: []types.SigningKey{oldKey, oldKey}},
+		{Keys: []types.SigningKey{oldKey}, KeyID: "2026"},
+	} {
+		if _, err := NewSigner(rules); err == nil {
+			t.Errorf("Expected %+v to be refused", rules)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"maps"
+	"seedstore/types"
+	"sync"
+)
+
+// Standby keeps the messages whose item another subscriber claimed, by claim ID, to take them over if their owner
+// dies. They were acked when they came in, so the list is kept on disk to outlive a restart. The messages are
+// stored as jobs that only carry the topic, the message and where to reply.
+type Standby struct {
+	lock     sync.Mutex
+	file     jobFile
+	messages map[string]types.Job
+}
+
+// OpenStandby reads the list at path, which is created on the first message.
+func OpenStandby(path string) (*Standby, error) {
+	s := &Standby{file: jobFile{path: path}, messages: make(map[string]types.Job)}
+	err := s.file.withLock(func() error {
+		jobs, err := s.file.read()
+		for _, job := range jobs {
+			s.messages[ClaimID(job.Message)] = job
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add keeps msg, which came in on topic, until it is taken over or its owner is done with it.
+func (s *Standby) Add(topic string, msg types.MQTTMessage, replyTo *types.ReplyTo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages[ClaimID(msg)] = types.Job{Topic: topic, Message: msg, ReplyTo: replyTo}
+	return s.save()
+}
+
+// Remove drops the message of the item id.
+func (s *Standby) Remove(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, found := s.messages[id]; !found {
+		return nil
+	}
+	delete(s.messages, id)
+	return s.save()
+}
+
+// All returns the messages by claim ID.
+func (s *Standby) All() map[string]types.Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return maps.Clone(s.messages)
+}
+
+func (s *Standby) save() error {
+	jobs := make([]types.Job, 0, len(s.messages))
+	for _, job := range s.messages {
+		jobs = append(jobs, job)
+	}
+	return s.file.withLock(func() error {
+		return s.file.write(jobs)
+	})
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"path/filepath"
+	"seedstore/types"
+	"testing"
+)
+
+func TestStandby(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "standby.jsonl")
+	standby, err := OpenStandby(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := types.MQTTMessage{Name: "first", Hash: "aaa", Location: "/data"}
+	second := types.MQTTMessage{Name: "second", Location: "/data"}
+	replyTo := &types.ReplyTo{Topic: "replies", CorrelationData: []byte("1")}
+	if err := standby.Add("seedbox/queue", first, replyTo); err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Add("seedbox/queue", second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Remove(ClaimID(second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// As after a restart
+	standby, err = OpenStandby(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := standby.All()
+	if len(messages) != 1 {
+		t.Fatalf("Expected one message left, got %v", messages)
+	}
+	kept, found := messages[ClaimID(first)]
+	if !found {
+		t.Fatalf("Expected the first message under its claim ID, got %v", messages)
+	}
+	if kept.Topic != "seedbox/queue" || kept.Message.Name != "first" || kept.ReplyTo == nil || kept.ReplyTo.Topic != "replies" {
+		t.Errorf("Expected the topic, message and reply topic back, got %+v", kept)
+	}
+}
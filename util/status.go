@@ -0,0 +1,23 @@
+package util
+
+import (
+	"seedstore/types"
+	"strings"
+)
+
+// StatusTopic fills in the status topic template for job: {hash} is its torrent hash, or its ID for a job without
+// one, {id} its ID and {code} its code.
+func StatusTopic(template string, job types.Job) string {
+	hash := job.Message.Hash
+	if hash == "" {
+		hash = job.ID
+	}
+	return strings.NewReplacer("{hash}", hash, "{id}", job.ID, "{code}", job.Code).Replace(template)
+}
+
+// ProgressStep returns the last multiple of step that a transfer at percent reached, and whether it is past
+// reported, the one of its last progress event.
+func ProgressStep(percent float64, step int, reported int) (reached int, progressed bool) {
+	reached = int(percent) / step * step
+	return reached, reached > reported
+}
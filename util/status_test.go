@@ -0,0 +1,47 @@
+package util
+
+import (
+	"seedstore/types"
+	"testing"
+)
+
+func TestStatusTopic(t *testing.T) {
+	job := types.Job{ID: "42", Code: "tv", Message: types.MQTTMessage{Name: "Show", Hash: "abc"}}
+	if topic := StatusTopic("seedstore/status/{hash}", job); topic != "seedstore/status/abc" {
+		t.Errorf("Expected the hash in the topic, got %s", topic)
+	}
+	if topic := StatusTopic("jobs/{code}/{id}/{hash}", job); topic != "jobs/tv/42/abc" {
+		t.Errorf("Expected every placeholder filled in, got %s", topic)
+	}
+	job.Message.Hash = ""
+	if topic := StatusTopic("seedstore/status/{hash}", job); topic != "seedstore/status/42" {
+		t.Errorf("Expected the ID for a job without a hash, got %s", topic)
+	}
+}
+
+func TestProgressStep(t *testing.T) {
+	tests := []struct {
+		percent    float64
+		step       int
+		reported   int
+		reached    int
+		progressed bool
+	}{
+		{0, 10, 0, 0, false},
+		{9.9, 10, 0, 0, false},
+		{10, 10, 0, 10, true},
+		{19.9, 10, 10, 10, false},
+		{35, 10, 10, 30, true},
+		{100, 10, 90, 100, true},
+		{100, 10, 100, 100, false},
+		{26, 25, 0, 25, true},
+		{3, 1, 2, 3, true},
+	}
+	for _, test := range tests {
+		reached, progressed := ProgressStep(test.percent, test.step, test.reported)
+		if reached != test.reached || progressed != test.progressed {
+			t.Errorf("At %.1f%% with steps of %d after %d, expected %d %v, got %d %v",
+				test.percent, test.step, test.reported, test.reached, test.progressed, reached, progressed)
+		}
+	}
+}
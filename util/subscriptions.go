@@ -0,0 +1,84 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"seedstore/types"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Subscriptions reads the topic subscriptions from the config, each with a topic.
+func Subscriptions() ([]types.Subscription, error) {
+	var subscriptions []types.Subscription
+	if err := viper.UnmarshalKey("subscriptions", &subscriptions); err != nil {
+		return nil, err
+	}
+	for i, subscription := range subscriptions {
+		if subscription.Topic == "" {
+			return nil, fmt.Errorf("subscription %d has no topic", i+1)
+		}
+	}
+	return subscriptions, nil
+}
+
+// SubscriptionFor finds the first of subscriptions that topic matches.
+func SubscriptionFor(subscriptions []types.Subscription, topic string) (types.Subscription, bool) {
+	for _, subscription := range subscriptions {
+		if topicMatches(subscription.Topic, topic) {
+			return subscription, true
+		}
+	}
+	return types.Subscription{}, false
+}
+
+// TopicVars are the variables of a message that came in on topic: topic for the whole of it, and topic[0],
+// topic[1]... for each of its levels, so topic[1] is the + in seedbox/+/complete.
+func TopicVars(topic string) map[string]string {
+	if topic == "" {
+		return nil
+	}
+	vars := map[string]string{"topic": topic}
+	for i, level := range strings.Split(topic, "/") {
+		vars[fmt.Sprintf("topic[%d]", i)] = level
+	}
+	return vars
+}
+
+// ExpandVars replaces every {name} in template with the variable of that name. Unknown ones are left as they are.
+func ExpandVars(template string, vars map[string]string) string {
+	replacements := make([]string, 0, 2*len(vars))
+	for name, value := range vars {
+		replacements = append(replacements, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// safePathLevelPattern is what a topic level going into a path may hold
+var safePathLevelPattern = regexp.MustCompile(`^[\p{L}\p{N}._-]+$`)
+
+// ExpandPath is ExpandVars for a local path. The topic comes from whoever published the message, so the variables
+// used in template must only hold levels of letters, digits, dots, dashes and underscores, other than . and ..,
+// which can't lead the path out of its destination or mean anything to a shell.
+func ExpandPath(template string, vars map[string]string) (string, error) {
+	for name, value := range vars {
+		if !strings.Contains(template, "{"+name+"}") {
+			continue
+		}
+		for _, level := range strings.Split(value, "/") {
+			if !safePathLevel(level) {
+				return "", fmt.Errorf("%w: topic level \"%s\" can't go into a path", types.ErrInvalidMessage, level)
+			}
+		}
+	}
+	return ExpandVars(template, vars), nil
+}
+
+// safePathLevel tells whether level only holds letters, digits, dots, dashes and underscores, and isn't . or ..
+func safePathLevel(level string) bool {
+	if level == "." || level == ".." {
+		return false
+	}
+	return safePathLevelPattern.MatchString(level)
+}
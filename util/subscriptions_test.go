@@ -0,0 +1,89 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"seedstore/types"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSubscriptions(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("json")
+	err := viper.ReadConfig(bytes.NewBufferString(`
+	{
+	  "subscriptions": [
+		{
+		  "topic": "seedbox/+/complete",
+		  "serverInfo": {"host": "box.example.com"},
+		  "codeDestinations": {"V": "/downloads/{topic[1]}"},
+		  "codeConditions": [{"entity": "topic[1]", "operator": "=", "value": "anime", "code": "A"}]
+		},
+		{"topic": "queue/#"}
+	  ]
+	}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriptions, err := Subscriptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 2 || subscriptions[0].ServerInfo.Host != "box.example.com" {
+		t.Fatalf("Expected both subscriptions with their server, got %+v", subscriptions)
+	}
+
+	subscription, found := SubscriptionFor(subscriptions, "seedbox/anime/complete")
+	if !found || subscription.Topic != "seedbox/+/complete" {
+		t.Fatalf("Expected the seedbox subscription, got %+v", subscription)
+	}
+	if _, found := SubscriptionFor(subscriptions, "seedbox/anime/started"); found {
+		t.Error("Expected no subscription for seedbox/anime/started")
+	}
+	if subscription, _ := SubscriptionFor(subscriptions, "queue/movies/4k"); subscription.Topic != "queue/#" {
+		t.Errorf("Expected the queue subscription, got %+v", subscription)
+	}
+
+	vars := TopicVars("seedbox/anime/complete")
+	if vars["topic"] != "seedbox/anime/complete" || vars["topic[0]"] != "seedbox" || vars["topic[1]"] != "anime" {
+		t.Errorf("Expected the topic and its levels, got %v", vars)
+	}
+	if path := ExpandVars(subscription.CodeDestinations["v"], vars); path != "/downloads/anime" {
+		t.Errorf("Expected /downloads/anime, got %s", path)
+	}
+	if path := ExpandVars("/downloads/{topic[7]}", vars); path != "/downloads/{topic[7]}" {
+		t.Errorf("Expected an unknown variable to be left alone, got %s", path)
+	}
+
+	if path, err := ExpandPath("/downloads/{topic[1]}", vars); err != nil || path != "/downloads/anime" {
+		t.Errorf("Expected /downloads/anime, got %s, %v", path, err)
+	}
+	for _, topic := range []string{"seedbox/../complete", "seedbox/./complete", "seedbox//complete", `seedbox/a\b/complete`, "seedbox/$(touch x)/complete", "seedbox/a;b/complete", "seedbox/a b/complete"} {
+		if path, err := ExpandPath("/downloads/{topic[1]}", TopicVars(topic)); !errors.Is(err, types.ErrInvalidMessage) {
+			t.Errorf("Expected %s to be refused in a path, got %s, %v", topic, path, err)
+		}
+	}
+	if _, err := ExpandPath("/downloads/{topic}", TopicVars("seedbox/../../etc")); !errors.Is(err, types.ErrInvalidMessage) {
+		t.Errorf("Expected a topic with .. to be refused in a path, got %v", err)
+	}
+	// Only the variables in the path matter
+	if path, err := ExpandPath("/downloads/{topic[2]}", TopicVars("seedbox//complete")); err != nil || path != "/downloads/complete" {
+		t.Errorf("Expected /downloads/complete, got %s, %v", path, err)
+	}
+
+	rules := types.ServerRules{DefaultCode: "V", CodeConditions: subscription.CodeConditions}
+	if code := CodeFromRules(rules, types.MQTTMessage{Name: "show"}, vars); code != "A" {
+		t.Errorf("Expected the topic rule to pick A, got %s", code)
+	}
+	if code := CodeFromRules(rules, types.MQTTMessage{Name: "show"}, TopicVars("seedbox/movies/complete")); code != "V" {
+		t.Errorf("Expected the default code, got %s", code)
+	}
+
+	viper.Set("subscriptions", []map[string]any{{"serverInfo": map[string]any{"host": "x"}}})
+	if _, err := Subscriptions(); err == nil {
+		t.Error("Expected a subscription without a topic to fail")
+	}
+}